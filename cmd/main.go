@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -24,6 +25,9 @@ func main() {
 	pythonPath := flag.String("python", "python3", "Path to Python interpreter")
 	scriptDir := flag.String("outdir", "output", "Directory for output files")
 	debug := flag.Bool("debug", false, "Enable debug mode (verbose output)")
+	cachePath := flag.String("cache", "", "Cache file of model responses (overrides PRAGMA CACHE)")
+	noCache := flag.Bool("no-cache", false, "Disable the cache of model responses")
+	resume := flag.Bool("resume", false, "Continue the generation from the checkpoints of an interrupted run")
 
 	// Parse command line
 	flag.Parse()
@@ -52,7 +56,7 @@ func main() {
 	fmt.Println(green("  ╚══════╝   ╚═╝   ╚═╝  ╚═══╝ ╚═════╝"))
 	fmt.Println()
 
-	executeDSL(filePath, *saveScript, *pythonPath, *scriptDir, *debug)
+	executeDSL(filePath, *saveScript, *pythonPath, *scriptDir, *debug, *cachePath, *noCache, *resume)
 }
 
 // formatDuration converts duration to a readable format
@@ -76,7 +80,7 @@ func formatDuration(d time.Duration) string {
 }
 
 // executeDSL executes DSL code from a file
-func executeDSL(filePath string, saveScript bool, pythonPath, scriptDir string, debug bool) {
+func executeDSL(filePath string, saveScript bool, pythonPath, scriptDir string, debug bool, cachePath string, noCache, resume bool) {
 	// Set up colored output
 	green := color.New(color.FgGreen).SprintFunc()
 	red := color.New(color.FgRed).SprintFunc()
@@ -99,6 +103,12 @@ func executeDSL(filePath string, saveScript bool, pythonPath, scriptDir string,
 	// Set debug mode
 	dslEngine.SetDebug(debug)
 
+	// Set the cache of model responses
+	dslEngine.SetCache(cachePath, noCache)
+
+	// Set resuming from the checkpoints of an interrupted run
+	dslEngine.SetResume(resume)
+
 	// Stop spinner
 	s.Stop()
 
@@ -115,10 +125,25 @@ func executeDSL(filePath string, saveScript bool, pythonPath, scriptDir string,
 	// Parse and compile
 	pythonCode, err := dslEngine.ParseAndCompile(string(content))
 	if err != nil {
+		// Show source-located diagnostics if available
+		var diags dsl.Diagnostics
+		if errors.As(err, &diags) {
+			formatter := dsl.NewDiagnosticFormatter(filePath, string(content), !color.NoColor)
+			fmt.Fprint(os.Stderr, formatter.FormatAll(diags))
+			fmt.Printf("%s Compilation failed with %d error(s)\n", red("✗"), diags.ErrorCount())
+			os.Exit(1)
+		}
+
 		fmt.Printf("%s Compilation error: %v\n", red("✗"), err)
 		os.Exit(1)
 	}
 
+	// Show warnings of the semantic analysis
+	if warnings := dslEngine.Diagnostics(); len(warnings) > 0 {
+		formatter := dsl.NewDiagnosticFormatter(filePath, string(content), !color.NoColor)
+		fmt.Fprint(os.Stderr, formatter.FormatAll(warnings))
+	}
+
 	fmt.Printf("%s Code successfully compiled (generated %d bytes of Python code).\n", green("✓"), len(pythonCode))
 	fmt.Println()
 
@@ -1,9 +1,16 @@
 package dsl
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Node represents a basic AST element
 type Node interface {
 	// GetNodeType returns the node type
 	GetNodeType() string
+	// GetSpan returns the location of the node in the source code
+	GetSpan() Span
 }
 
 // Program represents the root node of the program
@@ -15,103 +22,638 @@ func (p *Program) GetNodeType() string {
 	return "Program"
 }
 
+func (p *Program) GetSpan() Span {
+	if len(p.Statements) == 0 {
+		return Span{}
+	}
+	return Span{Start: p.Statements[0].GetSpan().Start, End: p.Statements[len(p.Statements)-1].GetSpan().End}
+}
+
 // FromStatement represents a FROM operator
 type FromStatement struct {
-	Dataset string
+	Dataset string // Name of the dataset on the hub, or path of a local file or directory
+	Source  string // Where the dataset is loaded from: "hub", "file" or "disk"
+	Alias   string // Name given with AS; empty if not set
 	Block   *Block // New: block of instructions related to this dataset
+	Span    Span   // Location in the source code
 }
 
 func (f *FromStatement) GetNodeType() string {
 	return "FromStatement"
 }
 
+func (f *FromStatement) GetSpan() Span {
+	return f.Span
+}
+
 // WithStatement represents a WITH block
 type WithStatement struct {
-	Type  string // "CONCURRENCY", "STREAM", etc.
-	Value interface{}
+	Type  string   // "CONCURRENCY", "STREAM", etc.
+	Value *Literal // Setting value: an integer for CONCURRENCY, a boolean for STREAM
 	Block *Block
+	Span  Span // Location in the source code
 }
 
 func (w *WithStatement) GetNodeType() string {
 	return "WithStatement"
 }
 
+func (w *WithStatement) GetSpan() Span {
+	return w.Span
+}
+
 // Block represents a block of code in curly braces
 type Block struct {
 	Statements []Node
+	Span       Span // Location in the source code
 }
 
 func (b *Block) GetNodeType() string {
 	return "Block"
 }
 
+func (b *Block) GetSpan() Span {
+	return b.Span
+}
+
 // FieldsStatement represents a FIELDS operator
 type FieldsStatement struct {
 	Fields []string
+	Span   Span // Location in the source code
 }
 
 func (f *FieldsStatement) GetNodeType() string {
 	return "FieldsStatement"
 }
 
+func (f *FieldsStatement) GetSpan() Span {
+	return f.Span
+}
+
 // UsingStatement represents a USING operator
 type UsingStatement struct {
-	Type  string // "MODEL", "KEY", "URL"
-	Value string
+	Type   string   // "MODEL", "KEY", "URL", "RETRIES", "TIMEOUT", "RPM", "TPM"
+	Value  string   // Value of MODEL, KEY and URL
+	Number *Literal // Value of RETRIES, RPM and TPM (integer) and TIMEOUT (float)
+	Span   Span     // Location in the source code
 }
 
 func (u *UsingStatement) GetNodeType() string {
 	return "UsingStatement"
 }
 
+func (u *UsingStatement) GetSpan() Span {
+	return u.Span
+}
+
 // UsingBlock represents a USING block with multiple parameters
 type UsingBlock struct {
 	Statements []UsingStatement
+	Span       Span // Location in the source code
 }
 
 func (u *UsingBlock) GetNodeType() string {
 	return "UsingBlock"
 }
 
+func (u *UsingBlock) GetSpan() Span {
+	return u.Span
+}
+
+// LoadOptionStatement represents an option of loading the dataset of a FROM block
+type LoadOptionStatement struct {
+	Type   string   // "FORMAT", "CONFIG", "SPLIT" or "REVISION"
+	Values []string // Option values; only SPLIT accepts a list
+	Span   Span     // Location in the source code
+}
+
+func (l *LoadOptionStatement) GetNodeType() string {
+	return "LoadOptionStatement"
+}
+
+func (l *LoadOptionStatement) GetSpan() Span {
+	return l.Span
+}
+
 // FilterStatement represents a FILTER operator
 type FilterStatement struct {
-	Field    string
-	Operator string // "=", ">=", "<", etc.
-	Value    interface{}
+	Condition Expr // Condition a record must satisfy to be kept
+	Span      Span // Location in the source code
 }
 
 func (f *FilterStatement) GetNodeType() string {
 	return "FilterStatement"
 }
 
-// FilterBlock represents a FILTER block with multiple conditions
+func (f *FilterStatement) GetSpan() Span {
+	return f.Span
+}
+
+// FilterBlock represents a FILTER block with multiple conditions on the attributes of a field.
+// All conditions must be satisfied; field paths in them are relative to Field.
 type FilterBlock struct {
-	Field      string
-	Conditions []FilterStatement
+	Field      FieldPath
+	Conditions []Expr
+	Span       Span // Location in the source code
 }
 
 func (f *FilterBlock) GetNodeType() string {
 	return "FilterBlock"
 }
 
+func (f *FilterBlock) GetSpan() Span {
+	return f.Span
+}
+
+// Expr represents a node of a boolean FILTER expression
+type Expr interface {
+	Node
+	// String returns the expression in DSL syntax
+	String() string
+}
+
+// BinaryExpr represents a logical AND or OR of two expressions
+type BinaryExpr struct {
+	Operator string // "AND" or "OR"
+	Left     Expr
+	Right    Expr
+	Span     Span // Location in the source code
+}
+
+func (b *BinaryExpr) GetNodeType() string {
+	return "BinaryExpr"
+}
+
+func (b *BinaryExpr) GetSpan() Span {
+	return b.Span
+}
+
+func (b *BinaryExpr) String() string {
+	return exprOperand(b.Left, b.Operator) + " " + b.Operator + " " + exprOperand(b.Right, b.Operator)
+}
+
+// NotExpr represents a logical negation
+type NotExpr struct {
+	Operand Expr
+	Span    Span // Location in the source code
+}
+
+func (n *NotExpr) GetNodeType() string {
+	return "NotExpr"
+}
+
+func (n *NotExpr) GetSpan() Span {
+	return n.Span
+}
+
+func (n *NotExpr) String() string {
+	return "NOT " + exprOperand(n.Operand, "NOT")
+}
+
+// ComparisonExpr represents a comparison of a field with a value
+type ComparisonExpr struct {
+	Field      FieldPath
+	Operator   string   // "=", ">=", "<", etc. or CONTAINS, STARTSWITH, ENDSWITH, MATCHES, IN
+	Value      *Literal // For IN - a list of values, for MATCHES - the pattern
+	IgnoreCase bool     // Case-insensitive variant of the operator, such as ICONTAINS
+	Negated    bool     // Operator preceded by NOT, such as NOT IN
+	Span       Span     // Location in the source code
+}
+
+func (c *ComparisonExpr) GetNodeType() string {
+	return "ComparisonExpr"
+}
+
+func (c *ComparisonExpr) GetSpan() Span {
+	return c.Span
+}
+
+func (c *ComparisonExpr) String() string {
+	operator := c.Operator
+	if c.IgnoreCase {
+		operator = "I" + operator
+	}
+	if c.Negated {
+		operator = "NOT " + operator
+	}
+	value := c.Value.String()
+	if c.Operator == "MATCHES" {
+		value = Token{Type: TokenRegex, Value: fmt.Sprint(c.Value.Value)}.String()
+	}
+	return fmt.Sprintf("%s %s %s", c.Field, operator, value)
+}
+
+// IsNullExpr represents a check that a field is missing or null: IS NULL or IS NOT NULL
+type IsNullExpr struct {
+	Field   FieldPath
+	Negated bool // IS NOT NULL
+	Span    Span // Location in the source code
+}
+
+func (i *IsNullExpr) GetNodeType() string {
+	return "IsNullExpr"
+}
+
+func (i *IsNullExpr) GetSpan() Span {
+	return i.Span
+}
+
+func (i *IsNullExpr) String() string {
+	if i.Negated {
+		return i.Field.String() + " IS NOT NULL"
+	}
+	return i.Field.String() + " IS NULL"
+}
+
+// FieldExpr represents a field used as a condition on its own: the record is kept if the value is truthy
+type FieldExpr struct {
+	Field FieldPath
+	Span  Span // Location in the source code
+}
+
+func (f *FieldExpr) GetNodeType() string {
+	return "FieldExpr"
+}
+
+func (f *FieldExpr) GetSpan() Span {
+	return f.Span
+}
+
+func (f *FieldExpr) String() string {
+	return f.Field.String()
+}
+
+// PathElement is a step of a field path: a key of a nested value or a list index
+type PathElement struct {
+	Key   string // Key of a nested value; empty for a list index
+	Index int    // List index, used when Key is empty
+}
+
+// FieldPath is a path to a value of a record, for example answers.text[0].
+// The first element is a column; the last key may also name a computed
+// attribute of the value (length, words, tokens, lines).
+type FieldPath []PathElement
+
+func (f FieldPath) String() string {
+	var sb strings.Builder
+	for i, element := range f {
+		key := element.Key
+		if strings.ContainsAny(key, ". []") {
+			key = fmt.Sprintf("%q", key) // Written in quotes in the source
+		}
+		switch {
+		case element.Key == "":
+			sb.WriteString(fmt.Sprintf("[%d]", element.Index))
+		case i > 0:
+			sb.WriteString("." + key)
+		default:
+			sb.WriteString(key)
+		}
+	}
+	return sb.String()
+}
+
+// Join returns the path of a field nested in this one
+func (f FieldPath) Join(other FieldPath) FieldPath {
+	path := make(FieldPath, 0, len(f)+len(other))
+	return append(append(path, f...), other...)
+}
+
+// exprOperand formats an operand of a logical operator, adding parentheses where the precedence requires them
+func exprOperand(e Expr, operator string) string {
+	if b, ok := e.(*BinaryExpr); ok && b.Operator != operator {
+		return "(" + b.String() + ")"
+	}
+	return e.String()
+}
+
 // DatasetMergeStatement represents a MERGE operator
 type DatasetMergeStatement struct {
-	Datasets []string // List of dataset names to merge
+	Datasets     []string        // List of dataset names to merge
+	Alias        string          // Name of the merged dataset given with AS; empty if not set
+	Align        string          // How columns that not all datasets have are handled, set by ALIGN; empty for strict
+	Mappings     []ColumnMapping // Columns renamed with MAP before merging
+	SourceColumn string          // Column recording the dataset of every record, set by SOURCE; empty if not set
+	Span         Span            // Location in the source code
+}
+
+// ColumnMapping is a MAP old -> new setting of a MERGE block
+type ColumnMapping struct {
+	From string
+	To   string
+	Span Span
 }
 
 func (d *DatasetMergeStatement) GetNodeType() string {
 	return "DatasetMergeStatement"
 }
 
+func (d *DatasetMergeStatement) GetSpan() Span {
+	return d.Span
+}
+
+// DatasetJoinStatement represents a JOIN operator
+type DatasetJoinStatement struct {
+	Left  string   // Name of the left dataset, whose records come first
+	Right string   // Name of the right dataset
+	Keys  []string // Columns that records of both datasets are matched on
+	Mode  string   // Kind of join: inner, left or outer
+	Alias string   // Name of the joined dataset given with AS; empty if not set
+	Span  Span     // Location in the source code
+}
+
+func (d *DatasetJoinStatement) GetNodeType() string {
+	return "DatasetJoinStatement"
+}
+
+func (d *DatasetJoinStatement) GetSpan() Span {
+	return d.Span
+}
+
 // SaveStatement represents a SAVE operator
 type SaveStatement struct {
-	Filename string
+	Dataset     string // Dataset named with SAVE <dataset> TO; empty for the dataset of the enclosing scope
+	Filename    string
+	Format      string   // File format set by FORMAT; empty to detect it by the extension
+	Compression string   // Compression set by COMPRESSION; empty to detect it by the extension
+	ShardRows   *Literal // Maximum number of rows per file set by SHARD; nil to write a single file
+	Span        Span     // Location in the source code
 }
 
 func (s *SaveStatement) GetNodeType() string {
 	return "SaveStatement"
 }
 
+func (s *SaveStatement) GetSpan() Span {
+	return s.Span
+}
+
+// RenameStatement represents a RENAME operator: RENAME old -> new
+type RenameStatement struct {
+	From string
+	To   string
+	Span Span // Location in the source code
+}
+
+func (r *RenameStatement) GetNodeType() string {
+	return "RenameStatement"
+}
+
+func (r *RenameStatement) GetSpan() Span {
+	return r.Span
+}
+
+// DropStatement represents a DROP operator removing columns
+type DropStatement struct {
+	Columns []string
+	Span    Span // Location in the source code
+}
+
+func (d *DropStatement) GetNodeType() string {
+	return "DropStatement"
+}
+
+func (d *DropStatement) GetSpan() Span {
+	return d.Span
+}
+
+// CastStatement represents a CAST operator converting the values of a column: CAST difficulty AS float
+type CastStatement struct {
+	Column string
+	Type   string // "int", "float", "string" or "bool"
+	Span   Span   // Location in the source code
+}
+
+func (c *CastStatement) GetNodeType() string {
+	return "CastStatement"
+}
+
+func (c *CastStatement) GetSpan() Span {
+	return c.Span
+}
+
+// SetStatement represents a SET operator computing a column from an expression: SET n_words = words(question)
+type SetStatement struct {
+	Column string
+	Value  ValueExpr
+	Span   Span // Location in the source code
+}
+
+func (s *SetStatement) GetNodeType() string {
+	return "SetStatement"
+}
+
+func (s *SetStatement) GetSpan() Span {
+	return s.Span
+}
+
+// LimitStatement represents a LIMIT operator keeping the first records of a dataset
+type LimitStatement struct {
+	Count *Literal
+	Span  Span // Location in the source code
+}
+
+func (l *LimitStatement) GetNodeType() string {
+	return "LimitStatement"
+}
+
+func (l *LimitStatement) GetSpan() Span {
+	return l.Span
+}
+
+// SampleStatement represents a SAMPLE operator keeping random records: SAMPLE 100 SEED 42 or SAMPLE 0.1
+type SampleStatement struct {
+	Size *Literal // Number of records, or a fraction of them between 0 and 1
+	Seed *Literal // Seed of the random generator; nil for a different sample on every run
+	Span Span     // Location in the source code
+}
+
+func (s *SampleStatement) GetNodeType() string {
+	return "SampleStatement"
+}
+
+func (s *SampleStatement) GetSpan() Span {
+	return s.Span
+}
+
+// ShuffleStatement represents a SHUFFLE operator putting records in random order
+type ShuffleStatement struct {
+	Seed *Literal // Seed of the random generator; nil for a different order on every run
+	Span Span     // Location in the source code
+}
+
+func (s *ShuffleStatement) GetNodeType() string {
+	return "ShuffleStatement"
+}
+
+func (s *ShuffleStatement) GetSpan() Span {
+	return s.Span
+}
+
+// SortStatement represents a SORT BY operator
+type SortStatement struct {
+	Keys []SortKey
+	Span Span // Location in the source code
+}
+
+// SortKey is a field records are sorted by, with its direction
+type SortKey struct {
+	Field      FieldPath
+	Descending bool
+}
+
+func (s *SortStatement) GetNodeType() string {
+	return "SortStatement"
+}
+
+func (s *SortStatement) GetSpan() Span {
+	return s.Span
+}
+
+// DedupStatement represents a DEDUP operator removing records with the same or similar values of fields
+type DedupStatement struct {
+	Fields    []FieldPath
+	Normalize []string       // Normalizations applied to text before comparing it: case, whitespace, punctuation
+	Threshold *Literal       // Similarity of FUZZY matching between 0 and 1; nil for exact matching
+	Removed   *SaveStatement // File the removed records are written to; nil to discard them
+	Span      Span           // Location in the source code
+}
+
+func (d *DedupStatement) GetNodeType() string {
+	return "DedupStatement"
+}
+
+func (d *DedupStatement) GetSpan() Span {
+	return d.Span
+}
+
+// AggregateStatement represents an AGGREGATE operator computing statistics of groups of records
+type AggregateStatement struct {
+	Aggregates []Aggregate
+	By         []string // Columns the records are grouped by; empty for the whole dataset
+	Into       string   // Name of the dataset with the results; empty to only print them
+	Span       Span     // Location in the source code
+}
+
+// Aggregate is an aggregate function applied to the records of a group, such as avg(difficulty)
+type Aggregate struct {
+	Function string
+	Args     []string // Columns the function is applied to; empty for count()
+	Alias    string   // Name of the result column set by AS
+	Span     Span     // Location in the source code
+}
+
+// Column returns the name of the result column: the alias, or the function and its column, e.g. avg_difficulty
+func (a Aggregate) Column() string {
+	if a.Alias != "" {
+		return a.Alias
+	}
+	return strings.Join(append([]string{a.Function}, a.Args...), "_")
+}
+
+func (a Aggregate) String() string {
+	return a.Function + "(" + strings.Join(a.Args, ", ") + ")"
+}
+
+func (a *AggregateStatement) GetNodeType() string {
+	return "AggregateStatement"
+}
+
+func (a *AggregateStatement) GetSpan() Span {
+	return a.Span
+}
+
+// isDatasetOperation checks if a statement processes the records of a loaded dataset: changes its columns
+// or records, or computes statistics of them. Dataset operations and GENERATE run in the order they are written,
+// after the dataset is loaded.
+func isDatasetOperation(node Node) bool {
+	switch node.(type) {
+	case *RenameStatement, *DropStatement, *CastStatement, *SetStatement,
+		*LimitStatement, *SampleStatement, *ShuffleStatement, *SortStatement, *DedupStatement, *AggregateStatement:
+		return true
+	}
+	return false
+}
+
+// ValueExpr represents a node of an expression computing a value in SET
+type ValueExpr interface {
+	Node
+	// String returns the expression in DSL syntax
+	String() string
+}
+
+// FieldRef represents the value of a field of the record
+type FieldRef struct {
+	Field FieldPath
+	Span  Span // Location in the source code
+}
+
+func (f *FieldRef) GetNodeType() string {
+	return "FieldRef"
+}
+
+func (f *FieldRef) GetSpan() Span {
+	return f.Span
+}
+
+func (f *FieldRef) String() string {
+	return f.Field.String()
+}
+
+// ArithmeticExpr represents +, -, * or / of two values. Adding a string joins the values as text.
+type ArithmeticExpr struct {
+	Operator string
+	Left     ValueExpr
+	Right    ValueExpr
+	Span     Span // Location in the source code
+}
+
+func (a *ArithmeticExpr) GetNodeType() string {
+	return "ArithmeticExpr"
+}
+
+func (a *ArithmeticExpr) GetSpan() Span {
+	return a.Span
+}
+
+func (a *ArithmeticExpr) String() string {
+	right := a.Right.String()
+	if r, ok := a.Right.(*ArithmeticExpr); ok && arithmeticPrecedence[r.Operator] <= arithmeticPrecedence[a.Operator] {
+		right = "(" + right + ")"
+	}
+	left := a.Left.String()
+	if l, ok := a.Left.(*ArithmeticExpr); ok && arithmeticPrecedence[l.Operator] < arithmeticPrecedence[a.Operator] {
+		left = "(" + left + ")"
+	}
+	return left + " " + a.Operator + " " + right
+}
+
+// arithmeticPrecedence is the binding strength of the arithmetic operators
+var arithmeticPrecedence = map[string]int{"+": 1, "-": 1, "*": 2, "/": 2}
+
+// CallExpr represents a call of a function of SET expressions, such as words(question)
+type CallExpr struct {
+	Function string
+	Args     []ValueExpr
+	Span     Span // Location in the source code
+}
+
+func (c *CallExpr) GetNodeType() string {
+	return "CallExpr"
+}
+
+func (c *CallExpr) GetSpan() Span {
+	return c.Span
+}
+
+func (c *CallExpr) String() string {
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = arg.String()
+	}
+	return c.Function + "(" + strings.Join(args, ", ") + ")"
+}
+
 // GenerateStatement represents a GENERATE operator for creating new data with LLM
 type GenerateStatement struct {
 	SourceField     string   // Source field for generation
@@ -120,30 +662,116 @@ type GenerateStatement struct {
 	Temperature     float64  // Generation temperature (optional)
 	Tokens          int      // Maximum number of tokens (optional)
 	PromptTemplates []string // Prompt templates, if used
+	OnError         string   // What to do with records whose generation failed: keep, skip or fail; empty for keep
+	ErrorColumn     bool     // Whether to add the __syn_error column with the error of every record
+	Span            Span     // Location in the source code
 }
 
 func (g *GenerateStatement) GetNodeType() string {
 	return "GenerateStatement"
 }
 
+func (g *GenerateStatement) GetSpan() Span {
+	return g.Span
+}
+
 // PromptStatement represents a PROMPT operator for defining a request template
 type PromptStatement struct {
 	Name       string   // Template name
 	Template   string   // Template text
 	Fields     []string // Fields used in the template
 	PromptType string   // Prompt type: "system" or "user"
+	Span       Span     // Location in the source code
 }
 
 func (p *PromptStatement) GetNodeType() string {
 	return "PromptStatement"
 }
 
+func (p *PromptStatement) GetSpan() Span {
+	return p.Span
+}
+
 // PragmaStatement represents a compiler directive PRAGMA
 type PragmaStatement struct {
-	Type  string      // Directive type, for example: "AUTOSAVE"
-	Value interface{} // Directive value
+	Type  string   // Directive type, for example: "AUTOSAVE"
+	Value *Literal // Directive value
+	Span  Span     // Location in the source code
 }
 
 func (p *PragmaStatement) GetNodeType() string {
 	return "PragmaStatement"
 }
+
+func (p *PragmaStatement) GetSpan() Span {
+	return p.Span
+}
+
+// LiteralKind is the type of a literal value
+type LiteralKind int
+
+const (
+	LiteralString LiteralKind = iota
+	LiteralInt
+	LiteralFloat
+	LiteralBool
+	LiteralNull
+	LiteralList
+)
+
+// String returns the name of the type as shown to the user
+func (k LiteralKind) String() string {
+	switch k {
+	case LiteralString:
+		return "string"
+	case LiteralInt:
+		return "integer"
+	case LiteralFloat:
+		return "float"
+	case LiteralBool:
+		return "boolean"
+	case LiteralNull:
+		return "null"
+	default:
+		return "list"
+	}
+}
+
+// Literal represents a constant value written in the source code
+type Literal struct {
+	Kind  LiteralKind
+	Value interface{} // string, int, float64, bool, nil or []*Literal, according to Kind
+	Span  Span        // Location in the source code
+}
+
+func (l *Literal) GetNodeType() string {
+	return "Literal"
+}
+
+func (l *Literal) GetSpan() Span {
+	return l.Span
+}
+
+// String returns the literal in DSL syntax
+func (l *Literal) String() string {
+	switch l.Kind {
+	case LiteralString:
+		return fmt.Sprintf("%q", l.Value)
+	case LiteralNull:
+		return "null"
+	case LiteralList:
+		items := l.Value.([]*Literal)
+		values := make([]string, len(items))
+		for i, item := range items {
+			values[i] = item.String()
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	default:
+		return fmt.Sprint(l.Value)
+	}
+}
+
+// IsNumber checks if the literal is an integer or a float
+func (l *Literal) IsNumber() bool {
+	return l.Kind == LiteralInt || l.Kind == LiteralFloat
+}
@@ -0,0 +1,1069 @@
+package dsl
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// scopeKind describes where a statement is located
+type scopeKind int
+
+const (
+	scopeProgram  scopeKind = iota // Top level of the program, including top-level WITH blocks
+	scopeFrom                      // Block of a FROM statement
+	scopeFromWith                  // WITH block nested in a FROM block
+)
+
+// scope is a lexical scope of the program.
+// Datasets, prompts and settings live in the checker's global tables because the
+// generated Python keeps them in global variables; a scope only knows what kind
+// of block it is and which columns the dataset of the enclosing FROM has.
+type scope struct {
+	kind    scopeKind
+	columns map[string]bool // Columns of the dataset; nil if unknown (no FIELDS)
+}
+
+// promptSymbol is a prompt declared by a PROMPT statement
+type promptSymbol struct {
+	stmt *PromptStatement
+	used bool
+}
+
+// identifierRe matches names given to datasets with AS
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// placeholderRe matches {field} placeholders in prompt templates
+var placeholderRe = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Checker performs semantic analysis of a parsed program before it is compiled.
+// It resolves references to datasets and prompts, checks that the settings needed
+// by GENERATE are configured and reports statements placed where they have no effect.
+type Checker struct {
+	program      *Program
+	diagnostics  Diagnostics
+	datasets     map[string]Span          // Datasets produced so far, by variable name
+	bindings     map[string]string        // Dataset variables by the names statements refer to them with
+	datasetOrder []string                 // Dataset names in order of creation: the alias or the variable name
+	loadedAs     map[string]string        // Names of the datasets by the dataset name or path written in FROM
+	current      string                   // Name of the dataset that statements outside FROM blocks work on
+	currentFrom  bool                     // Whether the current dataset was loaded by FROM rather than made by MERGE or JOIN
+	prompts      map[string]*promptSymbol // User prompts by name
+	systems      map[string]*promptSymbol // System prompts by name
+	promptOrder  []*promptSymbol          // All prompts in order of declaration
+	settings     map[string]Span          // USING settings (MODEL, KEY, URL) configured so far
+}
+
+// NewChecker creates a new Checker
+func NewChecker(program *Program) *Checker {
+	return &Checker{
+		program:  program,
+		datasets: make(map[string]Span),
+		bindings: make(map[string]string),
+		loadedAs: make(map[string]string),
+		prompts:  make(map[string]*promptSymbol),
+		systems:  make(map[string]*promptSymbol),
+		settings: make(map[string]Span),
+	}
+}
+
+// Check analyzes the program and returns the diagnostics found
+func (c *Checker) Check() Diagnostics {
+	root := &scope{kind: scopeProgram}
+	for _, stmt := range c.program.Statements {
+		c.checkStatement(root, stmt)
+	}
+
+	// Prompts that no GENERATE refers to
+	for _, symbol := range c.promptOrder {
+		if symbol.used {
+			continue
+		}
+		hint := "reference it with PROMPT " + symbol.stmt.Name + " inside a GENERATE block"
+		if symbol.stmt.PromptType == "system" {
+			hint = "a system prompt is sent by GENERATE blocks whose PROMPT has the same name; " +
+				"name it like the user prompt it belongs to"
+		}
+		c.warning(symbol.stmt.Span, fmt.Sprintf("prompt %s is never used", symbol.stmt.Name), hint)
+	}
+
+	sort.SliceStable(c.diagnostics, func(i, j int) bool {
+		return c.diagnostics[i].Span.Start.Offset < c.diagnostics[j].Span.Start.Offset
+	})
+
+	return c.diagnostics
+}
+
+// checkStatement checks a single statement in the given scope
+func (c *Checker) checkStatement(s *scope, node Node) {
+	switch n := node.(type) {
+	case *FromStatement:
+		c.checkFrom(s, n)
+
+	case *WithStatement:
+		if n.Type == "CONCURRENCY" {
+			c.checkConcurrency(n.Value)
+		}
+		if n.Block == nil {
+			return
+		}
+		inner := s
+		if s.kind != scopeProgram {
+			inner = &scope{kind: scopeFromWith, columns: s.columns}
+		}
+		c.checkBlock(inner, n.Block.Statements)
+
+	case *PragmaStatement:
+		if s.kind != scopeProgram {
+			c.warning(n.Span, "PRAGMA inside a FROM block has no effect",
+				"move the directive to the top level of the script")
+		}
+		if n.Type == "CONCURRENCY" {
+			c.checkConcurrency(n.Value)
+		}
+		if n.Type == "CACHE" && n.Value.Value == "" {
+			c.error(n.Value.Span, "PRAGMA CACHE needs a file name", "write PRAGMA CACHE \"cache/responses.db\"")
+		}
+
+	case *FieldsStatement:
+		if s.kind == scopeProgram {
+			c.warning(n.Span, "FIELDS outside a FROM block has no effect",
+				"move it into the block: FROM <dataset> { FIELDS [...] }")
+		}
+
+	case *FilterStatement:
+		if s.kind == scopeProgram {
+			c.error(node.GetSpan(), "FILTER is only allowed inside a FROM block",
+				"move it into the block: FROM <dataset> { FILTER ... }")
+		}
+		c.checkFilterExpr(n.Condition)
+
+	case *FilterBlock:
+		if s.kind == scopeProgram {
+			c.error(node.GetSpan(), "FILTER is only allowed inside a FROM block",
+				"move it into the block: FROM <dataset> { FILTER ... }")
+		}
+		for _, condition := range n.Conditions {
+			c.checkFilterExpr(condition)
+		}
+
+	case *LoadOptionStatement:
+		if s.kind != scopeFrom {
+			c.error(n.Span, n.Type+" is only allowed directly in a FROM block",
+				"move it into the block: FROM <dataset> { "+n.Type+" ... }")
+		}
+
+	case *UsingStatement:
+		c.checkUsing(n)
+
+	case *UsingBlock:
+		for i := range n.Statements {
+			c.checkUsing(&n.Statements[i])
+		}
+
+	case *DatasetMergeStatement:
+		c.checkMerge(s, n)
+
+	case *DatasetJoinStatement:
+		c.checkJoin(s, n)
+
+	case *SaveStatement:
+		c.checkSave(s, n)
+
+	case *RenameStatement, *DropStatement, *CastStatement, *SetStatement,
+		*LimitStatement, *SampleStatement, *ShuffleStatement, *SortStatement, *DedupStatement, *AggregateStatement:
+		c.checkDatasetOperation(s, n)
+
+	case *PromptStatement:
+		c.declarePrompt(n)
+
+	case *GenerateStatement:
+		c.checkGenerate(s, n)
+	}
+}
+
+// checkBlock checks the statements of a block in the order in which the compiler emits them:
+// inside FROM, setup statements come first, then GENERATE, dataset operations and SAVE in the order they are written
+func (c *Checker) checkBlock(s *scope, statements []Node) {
+	if s.kind == scopeProgram {
+		for _, stmt := range statements {
+			c.checkStatement(s, stmt)
+		}
+		return
+	}
+
+	var orderedStatements []Node
+	for _, stmt := range statements {
+		switch stmt.(type) {
+		case *GenerateStatement, *RenameStatement, *DropStatement, *CastStatement, *SetStatement,
+			*LimitStatement, *SampleStatement, *ShuffleStatement, *SortStatement, *DedupStatement, *AggregateStatement,
+			*SaveStatement:
+			orderedStatements = append(orderedStatements, stmt)
+		default:
+			c.checkStatement(s, stmt)
+		}
+	}
+	for _, stmt := range orderedStatements {
+		c.checkStatement(s, stmt)
+	}
+}
+
+// checkFrom checks a FROM statement and its block
+func (c *Checker) checkFrom(s *scope, n *FromStatement) {
+	if s.kind != scopeProgram {
+		c.error(n.Span, "FROM cannot be nested inside another FROM block",
+			"close the enclosing block before loading the next dataset")
+		return
+	}
+
+	c.checkAlias(n.Alias, n.Span)
+
+	// FROM <name> of a dataset defined earlier continues working with it
+	datasetVar := fromVarName(n)
+	name := n.Alias
+	sourceVar, reopened := reopenedDataset(n, c.bindings)
+	switch {
+	case reopened && n.Alias == "":
+		datasetVar = sourceVar
+		name = n.Dataset
+	case n.Alias == "":
+		name = datasetVar
+		if previous, taken := c.datasetDefined(name, datasetVar); taken {
+			c.error(n.Span, fmt.Sprintf("dataset %s is already loaded as %s at %s", n.Dataset, name, previous.Start),
+				fmt.Sprintf("load it under another name with AS: FROM %s AS <name>", n.Dataset))
+		}
+	default:
+		c.checkAliasTaken(name, datasetVar, n.Span)
+	}
+	if !reopened {
+		c.loadedAs[n.Dataset] = name
+	}
+
+	inner := &scope{kind: scopeFrom}
+	if n.Block != nil {
+		// FIELDS are applied when the dataset is loaded, wherever they appear in the block
+		for _, stmt := range n.Block.Statements {
+			if fields, ok := stmt.(*FieldsStatement); ok {
+				inner.columns = make(map[string]bool)
+				for _, field := range fields.Fields {
+					inner.columns[field] = true
+				}
+			}
+		}
+	}
+
+	c.declareDataset(name, datasetVar, n.Span)
+	c.currentFrom = true
+
+	if n.Block == nil {
+		return
+	}
+	if reopened {
+		for _, stmt := range n.Block.Statements {
+			if option, ok := stmt.(*LoadOptionStatement); ok {
+				c.error(option.Span, fmt.Sprintf("%s cannot be applied to %s, which is already loaded", option.Type, n.Dataset),
+					"set it in the FROM that loads the dataset")
+			}
+		}
+	} else {
+		c.checkLoadOptions(n)
+	}
+	c.checkBlock(inner, n.Block.Statements)
+}
+
+// checkAlias checks a name given to a dataset with AS
+func (c *Checker) checkAlias(alias string, span Span) {
+	if alias != "" && !identifierRe.MatchString(alias) {
+		c.error(span, fmt.Sprintf("invalid dataset name %q after AS", alias),
+			"use letters, digits and underscores, e.g. AS questions")
+	}
+}
+
+// checkAliasTaken reports a name given with AS that is already taken by another dataset
+func (c *Checker) checkAliasTaken(alias, variable string, span Span) {
+	if previous, taken := c.datasetDefined(alias, variable); taken {
+		c.error(span, fmt.Sprintf("dataset name %s is already used by the dataset defined at %s", alias, previous.Start),
+			"choose another name after AS")
+	}
+}
+
+// datasetDefined returns the location of a dataset that already has the given name or variable
+func (c *Checker) datasetDefined(name, variable string) (Span, bool) {
+	if span, ok := c.datasets[variable]; ok {
+		return span, true
+	}
+	if other, ok := c.bindings[name]; ok {
+		return c.datasets[other], true
+	}
+	return Span{}, false
+}
+
+// splitRe matches a split of a Hub dataset with an optional slice, such as train, test[:100] or train[10%:20%];
+// several splits can be combined with +
+var splitRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+(\[-?\d*%?:-?\d*%?\])?(\+[A-Za-z0-9_.-]+(\[-?\d*%?:-?\d*%?\])?)*$`)
+
+// checkLoadOptions checks the loading options of a FROM block against the source of the dataset
+func (c *Checker) checkLoadOptions(n *FromStatement) {
+	seen := make(map[string]Span)
+	for _, stmt := range n.Block.Statements {
+		option, ok := stmt.(*LoadOptionStatement)
+		if !ok {
+			continue
+		}
+		if previous, ok := seen[option.Type]; ok {
+			c.error(option.Span, fmt.Sprintf("duplicate %s in FROM block", option.Type),
+				fmt.Sprintf("it was first set at %s", previous.Start))
+		}
+		seen[option.Type] = option.Span
+
+		switch option.Type {
+		case "FORMAT":
+			if n.Source != "file" {
+				c.error(option.Span, fmt.Sprintf("FORMAT only applies to local data files, but %s is loaded from %s", n.Dataset, sourceName(n.Source)),
+					fmt.Sprintf("load a file with FROM file(%q)", n.Dataset))
+			} else if !fileFormats[strings.ToLower(option.Values[0])] {
+				c.error(option.Span, fmt.Sprintf("unknown file format %s", option.Values[0]),
+					"supported formats: "+strings.Join(sortedKeys(fileFormats), ", "))
+			}
+
+		case "CONFIG", "REVISION":
+			if n.Source != "hub" {
+				c.error(option.Span, fmt.Sprintf("%s only applies to datasets on the Hugging Face Hub, but %s is loaded from %s", option.Type, n.Dataset, sourceName(n.Source)),
+					"remove it; CONFIG selects a configuration and REVISION a branch, tag or commit of a Hub dataset")
+			}
+
+		case "SPLIT":
+			c.checkSplits(n, option)
+		}
+	}
+}
+
+// checkSplits checks the splits selected by SPLIT. Several splits are loaded as a DatasetDict
+// keyed by split name, so their names must differ.
+func (c *Checker) checkSplits(n *FromStatement, option *LoadOptionStatement) {
+	names := make(map[string]bool)
+	for _, split := range option.Values {
+		if !splitRe.MatchString(split) {
+			c.error(option.Span, fmt.Sprintf("invalid split %q", split),
+				"write a split name with an optional slice: train, test[:100], train[10%:20%]")
+			continue
+		}
+
+		name, _, sliced := strings.Cut(split, "[")
+		switch {
+		case n.Source == "disk" && (sliced || strings.Contains(split, "+")):
+			c.error(option.Span, fmt.Sprintf("split %q of a dataset saved with SAVE cannot be sliced or combined", split),
+				"select whole splits by name, e.g. SPLIT [train, test]")
+		case n.Source == "file" && name != "train":
+			c.error(option.Span, fmt.Sprintf("local files have no split %s", name),
+				"all files are loaded as the train split; select a part of it with SPLIT \"train[:10%]\"")
+		}
+
+		if names[name] {
+			c.error(option.Span, fmt.Sprintf("split %s is selected more than once", name),
+				"several splits are kept by name, so each one can be selected only once")
+		}
+		names[name] = true
+	}
+}
+
+// sourceName describes the source of a dataset for messages
+func sourceName(source string) string {
+	switch source {
+	case "disk":
+		return "a directory saved with SAVE"
+	case "file":
+		return "local files"
+	default:
+		return "the Hugging Face Hub"
+	}
+}
+
+// checkMerge checks that all merged datasets exist and declares the merged dataset
+func (c *Checker) checkMerge(s *scope, n *DatasetMergeStatement) {
+	if s.kind != scopeProgram {
+		c.error(n.Span, "MERGE is only allowed at the top level of the script",
+			"move it after the closing brace of the FROM block")
+		return
+	}
+
+	for _, name := range n.Datasets {
+		if _, ok := c.bindings[name]; !ok {
+			c.error(n.Span, fmt.Sprintf("undefined dataset %s in MERGE", name), c.datasetHint(name))
+		}
+	}
+
+	c.checkMergeColumns(n)
+	c.checkAlias(n.Alias, n.Span)
+
+	// Same naming scheme as the compiler
+	mergedVar := mergedVarName(n, len(c.datasets))
+	name := n.Alias
+	if name == "" {
+		name = mergedVar
+	}
+	if n.Alias != "" {
+		c.checkAliasTaken(name, mergedVar, n.Span)
+	}
+	c.declareDataset(name, mergedVar, n.Span)
+	c.currentFrom = false
+}
+
+// checkMergeColumns checks the ALIGN mode, the MAP settings and the SOURCE column of a MERGE block
+func (c *Checker) checkMergeColumns(n *DatasetMergeStatement) {
+	if n.Align != "" && !alignModes[n.Align] {
+		c.error(n.Span, fmt.Sprintf("unknown ALIGN mode %s", n.Align),
+			"supported modes: "+strings.Join(sortedKeys(alignModes), ", "))
+	}
+
+	mapped := make(map[string]Span)
+	for _, mapping := range n.Mappings {
+		if previous, ok := mapped[mapping.From]; ok {
+			c.error(mapping.Span, fmt.Sprintf("column %s is mapped twice", mapping.From),
+				fmt.Sprintf("it was first mapped at %s", previous.Start))
+		}
+		mapped[mapping.From] = mapping.Span
+		if mapping.From == mapping.To {
+			c.warning(mapping.Span, fmt.Sprintf("MAP %s -> %s has no effect", mapping.From, mapping.To),
+				"remove it or give the column another name")
+		}
+		if mapping.To == n.SourceColumn {
+			c.error(mapping.Span, fmt.Sprintf("column %s is also the SOURCE column", mapping.To),
+				"name the SOURCE column differently: SOURCE origin")
+		}
+	}
+}
+
+// checkJoin checks that both joined datasets exist and the key columns are listed once,
+// and declares the joined dataset
+func (c *Checker) checkJoin(s *scope, n *DatasetJoinStatement) {
+	if s.kind != scopeProgram {
+		c.error(n.Span, "JOIN is only allowed at the top level of the script",
+			"move it after the closing brace of the FROM block")
+		return
+	}
+
+	for _, name := range []string{n.Left, n.Right} {
+		if _, ok := c.bindings[name]; !ok {
+			c.error(n.Span, fmt.Sprintf("undefined dataset %s in JOIN", name), c.datasetHint(name))
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range n.Keys {
+		if seen[key] {
+			c.error(n.Span, fmt.Sprintf("column %s is listed twice after ON", key), "list every key column once")
+		}
+		seen[key] = true
+	}
+
+	c.checkAlias(n.Alias, n.Span)
+
+	// Same naming scheme as the compiler
+	joinedVar := joinedVarName(n, len(c.datasets))
+	name := n.Alias
+	if name == "" {
+		name = joinedVar
+	}
+	if n.Alias != "" {
+		c.checkAliasTaken(name, joinedVar, n.Span)
+	}
+	c.declareDataset(name, joinedVar, n.Span)
+	c.currentFrom = false
+}
+
+// checkSave checks that there is a dataset to save
+func (c *Checker) checkSave(s *scope, n *SaveStatement) {
+	if s.kind == scopeFromWith {
+		c.error(n.Span, "SAVE inside a WITH block of FROM runs before the dataset is loaded",
+			"place SAVE directly in the FROM block")
+		return
+	}
+	switch {
+	case n.Dataset != "":
+		if _, ok := c.bindings[n.Dataset]; !ok {
+			c.error(n.Span, fmt.Sprintf("undefined dataset %s in SAVE", n.Dataset), c.datasetHint(n.Dataset))
+		}
+	case len(c.datasets) == 0:
+		c.error(n.Span, "SAVE without a loaded dataset", "load a dataset with FROM before saving")
+	case s.kind == scopeProgram && c.currentFrom && len(c.datasets) > 1:
+		// Outside FROM blocks SAVE writes the dataset of the last FROM, which is easy to miss
+		c.warning(n.Span, fmt.Sprintf("SAVE writes %s, the dataset of the last FROM", c.current),
+			fmt.Sprintf("name the dataset to save: SAVE %s TO %q", c.current, n.Filename))
+	}
+	c.checkSaveTarget(n)
+}
+
+// checkSaveTarget checks that the format and compression of the file written by SAVE are supported
+func (c *Checker) checkSaveTarget(n *SaveStatement) {
+	format, compression := saveTarget(n)
+
+	switch {
+	case n.Format != "" && !saveFormats[n.Format]:
+		c.error(n.Span, fmt.Sprintf("unknown file format %s", n.Format),
+			"supported formats: "+strings.Join(sortedKeys(saveFormats), ", "))
+		return
+	case strings.HasSuffix(strings.ToLower(n.Filename), ".zip"):
+		c.error(n.Span, "SAVE cannot write zip archives", "compress the file with .gz or .zst instead")
+		return
+	case format == "":
+		c.error(n.Span, fmt.Sprintf("cannot tell the format of %s from its extension", n.Filename),
+			"use .json, .jsonl, .csv, .tsv or .parquet, a name without an extension for an Arrow directory, or set FORMAT: SAVE \"...\" { FORMAT jsonl }")
+		return
+	case !saveFormats[format]:
+		c.error(n.Span, fmt.Sprintf("SAVE cannot write %s files", format),
+			"supported formats: "+strings.Join(sortedKeys(saveFormats), ", "))
+		return
+	}
+
+	switch {
+	case n.Compression != "" && compressionCodecs[n.Compression] == "":
+		c.error(n.Span, fmt.Sprintf("unknown compression %s", n.Compression),
+			"supported compressions: "+strings.Join(sortedKeys(compressionCodecs), ", "))
+	case compression != "" && format == "arrow":
+		c.error(n.Span, "an Arrow directory cannot be compressed", "save to a .parquet file to get a compressed file")
+	case compression != "" && format == "parquet" && n.Compression == "":
+		c.error(n.Span, fmt.Sprintf("%s is not a valid name for a Parquet file", n.Filename),
+			"Parquet files are compressed inside: SAVE \"data.parquet\" { COMPRESSION zstd }")
+	case format == "parquet" && compression != "" && compression != "gzip" && compression != "zstd":
+		c.error(n.Span, fmt.Sprintf("Parquet files cannot be compressed with %s", compression),
+			"use COMPRESSION gzip or COMPRESSION zstd")
+	}
+
+	if n.ShardRows != nil {
+		if rows := n.ShardRows.Value.(int); rows < 1 {
+			c.error(n.ShardRows.Span, fmt.Sprintf("SHARD must be at least 1 row, got %d", rows), "")
+		}
+	}
+}
+
+// sortedKeys returns the keys of a map in alphabetical order
+func sortedKeys[V any](set map[string]V) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkGenerate checks references and settings used by a GENERATE statement
+func (c *Checker) checkGenerate(s *scope, n *GenerateStatement) {
+	if s.kind == scopeFromWith {
+		c.error(n.Span, "GENERATE inside a WITH block of FROM runs before the dataset is loaded",
+			"place GENERATE directly in the FROM block")
+		return
+	}
+	if len(c.datasets) == 0 {
+		c.error(n.Span, "GENERATE without a loaded dataset", "load a dataset with FROM before generating")
+		return
+	}
+
+	// Generation parameters
+	if n.Tokens < 1 {
+		c.error(n.Span, fmt.Sprintf("TOKENS must be at least 1, got %d", n.Tokens), "")
+	}
+	if n.Temperature < 0 {
+		c.error(n.Span, fmt.Sprintf("TEMPERATURE cannot be negative, got %s", pyFloat(n.Temperature)), "")
+	} else if n.Temperature > 2 {
+		c.warning(n.Span, fmt.Sprintf("TEMPERATURE %s is above 2, which most APIs reject", pyFloat(n.Temperature)),
+			"use a value from 0 to 2")
+	}
+
+	if n.OnError != "" && !errorPolicies[n.OnError] {
+		c.error(n.Span, fmt.Sprintf("unknown ON_ERROR policy %s", strings.ToUpper(n.OnError)),
+			"use ON_ERROR KEEP, SKIP or FAIL")
+	}
+
+	// Settings needed to call the API
+	if n.Model == "" {
+		if _, ok := c.settings["MODEL"]; !ok {
+			c.error(n.Span, fmt.Sprintf("no model configured for generating %s", n.TargetField),
+				"add USING MODEL <name> before GENERATE or MODEL <name> to the GENERATE block")
+		}
+	}
+	if _, ok := c.settings["KEY"]; !ok {
+		c.error(n.Span, fmt.Sprintf("no API key configured for generating %s", n.TargetField),
+			"add USING KEY <key> before GENERATE")
+	}
+
+	// Prompts; the compiler uses only the first one
+	var template *PromptStatement
+	for i, name := range n.PromptTemplates {
+		user, isUser := c.prompts[name]
+		system, isSystem := c.systems[name]
+		if !isUser && !isSystem {
+			c.error(n.Span, fmt.Sprintf("undefined prompt %s", name), c.promptHint(name))
+			continue
+		}
+		if i > 0 {
+			c.warning(n.Span, fmt.Sprintf("prompt %s is ignored: GENERATE uses only the first PROMPT", name),
+				"give a system prompt the same name as the user prompt to use them together")
+			continue
+		}
+		if isUser {
+			user.used = true
+			template = user.stmt
+		}
+		if isSystem {
+			system.used = true
+		}
+	}
+
+	// Columns the generation reads
+	if s.columns != nil {
+		if template != nil {
+			for _, field := range template.Fields {
+				if !s.columns[field] {
+					c.error(n.Span, fmt.Sprintf("prompt %s uses field %s, which is not selected by FIELDS", template.Name, field),
+						fmt.Sprintf("add %q to FIELDS of the dataset", field))
+				}
+			}
+		} else if !s.columns[n.SourceField] {
+			c.error(n.Span, fmt.Sprintf("source field %s is not selected by FIELDS", n.SourceField),
+				fmt.Sprintf("add %q to FIELDS of the dataset", n.SourceField))
+		}
+		s.columns[n.TargetField] = true
+	}
+}
+
+// checkDatasetOperation checks the operations on a loaded dataset and keeps track of the columns they change
+func (c *Checker) checkDatasetOperation(s *scope, node Node) {
+	keyword := strings.ToUpper(strings.TrimSuffix(node.GetNodeType(), "Statement"))
+	if s.kind == scopeFromWith {
+		c.error(node.GetSpan(), keyword+" inside a WITH block of FROM runs before the dataset is loaded",
+			"place "+keyword+" directly in the FROM block")
+		return
+	}
+	if s.kind == scopeProgram && len(c.datasets) == 0 {
+		c.error(node.GetSpan(), keyword+" without a loaded dataset", "load a dataset with FROM first")
+		return
+	}
+
+	switch n := node.(type) {
+	case *RenameStatement:
+		if !c.requireColumn(s, n.From, n.Span) {
+			return
+		}
+		if n.From == n.To {
+			c.warning(n.Span, fmt.Sprintf("RENAME %s -> %s has no effect", n.From, n.To), "give the column another name")
+			return
+		}
+		if s.columns != nil && s.columns[n.To] {
+			c.error(n.Span, fmt.Sprintf("column %s already exists", n.To), "DROP it first or choose another name")
+			return
+		}
+		if s.columns != nil {
+			delete(s.columns, n.From)
+			s.columns[n.To] = true
+		}
+
+	case *DropStatement:
+		for _, column := range n.Columns {
+			c.requireColumn(s, column, n.Span)
+			if s.columns != nil {
+				delete(s.columns, column)
+			}
+		}
+
+	case *CastStatement:
+		if castTypes[n.Type] == "" {
+			c.error(n.Span, fmt.Sprintf("unknown type %s in CAST", n.Type),
+				"supported types: "+strings.Join(sortedKeys(castTypes), ", "))
+		}
+		c.requireColumn(s, n.Column, n.Span)
+
+	case *SetStatement:
+		c.checkValueExpr(s, n.Value)
+		if s.columns != nil {
+			s.columns[n.Column] = true
+		}
+
+	case *LimitStatement:
+		if count := n.Count.Value.(int); count < 1 {
+			c.error(n.Count.Span, fmt.Sprintf("LIMIT must be at least 1, got %d", count), "")
+		}
+
+	case *SampleStatement:
+		switch size := n.Size.Value.(type) {
+		case int:
+			if size < 1 {
+				c.error(n.Size.Span, fmt.Sprintf("SAMPLE must be at least 1 record, got %d", size), "")
+			}
+		case float64:
+			if size <= 0 || size >= 1 {
+				c.error(n.Size.Span, fmt.Sprintf("SAMPLE fraction must be between 0 and 1, got %s", n.Size),
+					"write a whole number to sample a number of records")
+			}
+		}
+
+	case *SortStatement:
+		seen := make(map[string]bool, len(n.Keys))
+		for _, key := range n.Keys {
+			if seen[key.Field.String()] {
+				c.error(n.Span, fmt.Sprintf("SORT BY uses field %s twice", key.Field), "")
+			}
+			seen[key.Field.String()] = true
+			if key.Field[0].Key != "" {
+				c.requireColumn(s, key.Field[0].Key, n.Span)
+			}
+		}
+
+	case *DedupStatement:
+		seen := make(map[string]bool, len(n.Fields))
+		for _, field := range n.Fields {
+			if seen[field.String()] {
+				c.error(n.Span, fmt.Sprintf("DEDUP BY uses field %s twice", field), "")
+			}
+			seen[field.String()] = true
+			if field[0].Key != "" {
+				c.requireColumn(s, field[0].Key, n.Span)
+			}
+		}
+		for _, name := range n.Normalize {
+			if !normalizations[name] {
+				c.error(n.Span, fmt.Sprintf("unknown normalization %s in DEDUP", name),
+					"supported normalizations: "+strings.Join(sortedKeys(normalizations), ", "))
+			}
+		}
+		if n.Threshold != nil {
+			threshold, ok := n.Threshold.Value.(float64)
+			if !ok {
+				threshold = float64(n.Threshold.Value.(int))
+			}
+			if threshold <= 0 || threshold > 1 {
+				c.error(n.Threshold.Span, fmt.Sprintf("FUZZY similarity must be above 0 and at most 1, got %s", n.Threshold),
+					"0.85 drops records that are at least 85% similar to an earlier one")
+			}
+		}
+		if n.Removed != nil {
+			c.checkSaveTarget(n.Removed)
+		}
+
+	case *AggregateStatement:
+		c.checkAggregate(s, n)
+	}
+}
+
+// checkAggregate checks the functions and columns of AGGREGATE and declares the dataset of its results
+func (c *Checker) checkAggregate(s *scope, n *AggregateStatement) {
+	columns := make(map[string]bool)
+	for _, column := range n.By {
+		if columns[column] {
+			c.error(n.Span, fmt.Sprintf("column %s is listed twice after BY", column), "list every column once")
+		}
+		columns[column] = true
+		c.requireColumn(s, column, n.Span)
+	}
+
+	for _, item := range n.Aggregates {
+		arity, ok := aggregateFunctions[item.Function]
+		switch {
+		case !ok:
+			hint := "supported functions: " + strings.Join(sortedKeys(aggregateFunctions), ", ")
+			if suggestion := closestName(item.Function, sortedKeys(aggregateFunctions)); suggestion != "" {
+				hint = fmt.Sprintf("did you mean %s?", suggestion)
+			}
+			c.error(item.Span, fmt.Sprintf("unknown aggregate function %s", item.Function), hint)
+		case len(item.Args) < arity[0] || len(item.Args) > arity[1]:
+			c.error(item.Span, fmt.Sprintf("%s takes %s, got %d", item.Function, argumentCount(arity), len(item.Args)), "")
+		}
+		for _, column := range item.Args {
+			c.requireColumn(s, column, item.Span)
+		}
+
+		if columns[item.Column()] {
+			c.error(item.Span, fmt.Sprintf("AGGREGATE makes column %s twice", item.Column()),
+				fmt.Sprintf("name the result with AS: %s AS <name>", item))
+		}
+		columns[item.Column()] = true
+	}
+
+	if n.Into == "" {
+		return
+	}
+	if !identifierRe.MatchString(n.Into) {
+		c.error(n.Span, fmt.Sprintf("invalid dataset name %q after INTO", n.Into),
+			"use letters, digits and underscores, e.g. INTO stats")
+		return
+	}
+	variable := datasetVarName(n.Into)
+	if previous, taken := c.datasetDefined(n.Into, variable); taken {
+		c.error(n.Span, fmt.Sprintf("dataset name %s is already used by the dataset defined at %s", n.Into, previous.Start),
+			"choose another name after INTO")
+		return
+	}
+
+	// The results are a dataset of their own; the aggregated dataset stays the current one
+	current, currentFrom := c.current, c.currentFrom
+	c.declareDataset(n.Into, variable, n.Span)
+	c.current, c.currentFrom = current, currentFrom
+}
+
+// checkValueExpr checks the functions and fields of a SET expression
+func (c *Checker) checkValueExpr(s *scope, expr ValueExpr) {
+	switch e := expr.(type) {
+	case *ArithmeticExpr:
+		c.checkValueExpr(s, e.Left)
+		c.checkValueExpr(s, e.Right)
+
+	case *FieldRef:
+		// a/b and n-1 without spaces are single words, which would read a field that does not exist
+		for i, element := range e.Field {
+			if !strings.ContainsAny(element.Key, "/-") || (i == 0 && s.columns[element.Key]) {
+				continue
+			}
+			spaced := strings.NewReplacer("/", " / ", "-", " - ").Replace(element.Key)
+			c.error(e.Span, fmt.Sprintf("%s is read as a single field name, not as an arithmetic expression", element.Key),
+				fmt.Sprintf("put spaces around the operator: %s", spaced))
+			return
+		}
+		if len(e.Field) > 0 && e.Field[0].Key != "" {
+			c.requireColumn(s, e.Field[0].Key, e.Span)
+		}
+
+	case *CallExpr:
+		arity, ok := valueFunctions[e.Function]
+		switch {
+		case !ok:
+			hint := "supported functions: " + strings.Join(sortedKeys(valueFunctions), ", ")
+			if suggestion := closestName(e.Function, sortedKeys(valueFunctions)); suggestion != "" {
+				hint = fmt.Sprintf("did you mean %s?", suggestion)
+			}
+			c.error(e.Span, fmt.Sprintf("unknown function %s", e.Function), hint)
+		case len(e.Args) < arity[0] || (arity[1] >= 0 && len(e.Args) > arity[1]):
+			c.error(e.Span, fmt.Sprintf("%s takes %s, got %d", e.Function, argumentCount(arity), len(e.Args)), "")
+		}
+		for _, arg := range e.Args {
+			c.checkValueExpr(s, arg)
+		}
+	}
+}
+
+// argumentCount describes the number of arguments a function takes
+func argumentCount(arity [2]int) string {
+	plural := func(n int) string {
+		if n == 1 {
+			return "1 argument"
+		}
+		return fmt.Sprintf("%d arguments", n)
+	}
+	switch {
+	case arity[1] < 0:
+		return "at least " + plural(arity[0])
+	case arity[0] == arity[1]:
+		return plural(arity[0])
+	default:
+		return fmt.Sprintf("%d to %d arguments", arity[0], arity[1])
+	}
+}
+
+// requireColumn reports a column that the dataset does not have, if its columns are known
+func (c *Checker) requireColumn(s *scope, column string, span Span) bool {
+	if s.columns != nil && !s.columns[column] {
+		c.error(span, fmt.Sprintf("the dataset has no column %s at this point", column),
+			"columns available here: "+strings.Join(sortedKeys(s.columns), ", "))
+		return false
+	}
+	return true
+}
+
+// checkUsing checks the value of a USING setting and records that it is configured
+func (c *Checker) checkUsing(n *UsingStatement) {
+	c.settings[n.Type] = n.Span
+
+	switch n.Type {
+	case "RETRIES":
+		if retries := n.Number.Value.(int); retries < 0 {
+			c.error(n.Number.Span, fmt.Sprintf("RETRIES cannot be negative, got %d", retries),
+				"RETRIES 0 makes a single attempt")
+		}
+	case "TIMEOUT":
+		if timeout := n.Number.Value.(float64); !(timeout > 0) {
+			c.error(n.Number.Span, fmt.Sprintf("TIMEOUT must be a positive number of seconds, got %s", n.Number), "")
+		}
+	case "RPM", "TPM":
+		if limit := n.Number.Value.(int); limit < 1 {
+			c.error(n.Number.Span, fmt.Sprintf("%s must be at least 1, got %d", n.Type, limit),
+				"RPM limits the requests and TPM the tokens sent per minute")
+		}
+	}
+}
+
+// checkConcurrency checks the value of a CONCURRENCY setting
+func (c *Checker) checkConcurrency(value *Literal) {
+	if n, ok := value.Value.(int); ok && n < 1 {
+		c.error(value.Span, fmt.Sprintf("CONCURRENCY must be at least 1, got %d", n), "")
+	}
+}
+
+// checkFilterExpr checks that the values in a FILTER expression can be used with their operators
+func (c *Checker) checkFilterExpr(expr Expr) {
+	switch e := expr.(type) {
+	case *BinaryExpr:
+		c.checkFilterExpr(e.Left)
+		c.checkFilterExpr(e.Right)
+
+	case *NotExpr:
+		c.checkFilterExpr(e.Operand)
+
+	case *ComparisonExpr:
+		switch e.Operator {
+		case "=", "==", "!=":
+		case ">", ">=", "<", "<=":
+			if !e.Value.IsNumber() && e.Value.Kind != LiteralString {
+				c.error(e.Value.Span, fmt.Sprintf("cannot compare %s with %s using %s", e.Field, e.Value.Kind, e.Operator),
+					"ordering operators work with numbers and strings")
+			}
+		case "IN":
+			for _, item := range e.Value.Value.([]*Literal) {
+				if item.Kind == LiteralNull {
+					c.error(item.Span, "null in a list of IN never matches",
+						fmt.Sprintf("use %s IS NULL OR %s IN [...]", e.Field, e.Field))
+				}
+			}
+		default:
+			if e.Value.Kind == LiteralNull {
+				c.error(e.Value.Span, fmt.Sprintf("%s with null never matches", e.Operator),
+					fmt.Sprintf("use %s IS NULL to check for a missing value", e.Field))
+			}
+		}
+	}
+}
+
+// declarePrompt declares a prompt and checks its template
+func (c *Checker) declarePrompt(n *PromptStatement) {
+	table := c.prompts
+	if n.PromptType == "system" {
+		table = c.systems
+	}
+
+	if previous, ok := table[n.Name]; ok {
+		c.error(n.Span, fmt.Sprintf("%s prompt %s is already defined", n.PromptType, n.Name),
+			fmt.Sprintf("the previous definition is at %s; use a different name", previous.stmt.Span.Start))
+		return
+	}
+
+	symbol := &promptSymbol{stmt: n}
+	table[n.Name] = symbol
+	c.promptOrder = append(c.promptOrder, symbol)
+
+	placeholders := placeholderRe.FindAllStringSubmatch(n.Template, -1)
+
+	if n.PromptType == "system" {
+		if len(placeholders) > 0 {
+			c.warning(n.Span, fmt.Sprintf("placeholder {%s} is not substituted in system prompts", placeholders[0][1]),
+				"use fields in a USER PROMPT with FIELDS")
+		}
+		return
+	}
+
+	listed := make(map[string]bool, len(n.Fields))
+	for _, field := range n.Fields {
+		listed[field] = true
+	}
+
+	used := make(map[string]bool, len(placeholders))
+	for _, match := range placeholders {
+		field := match[1]
+		if used[field] {
+			continue
+		}
+		used[field] = true
+		if !listed[field] {
+			c.error(n.Span, fmt.Sprintf("placeholder {%s} in prompt %s is not listed in FIELDS", field, n.Name),
+				fmt.Sprintf("add %q to FIELDS of the prompt, otherwise it is sent to the model as is", field))
+		}
+	}
+
+	for _, field := range n.Fields {
+		if !used[field] {
+			c.warning(n.Span, fmt.Sprintf("field %s is listed in FIELDS of prompt %s but not used in its template", field, n.Name),
+				fmt.Sprintf("insert {%s} into the template or remove the field", field))
+		}
+	}
+}
+
+// declareDataset registers a dataset produced by FROM, MERGE or JOIN under its name and variable,
+// and makes it the current dataset
+func (c *Checker) declareDataset(name, variable string, span Span) {
+	if _, ok := c.bindings[name]; !ok {
+		c.datasetOrder = append(c.datasetOrder, name)
+	}
+	c.datasets[variable] = span
+	c.bindings[name] = variable
+	c.bindings[variable] = variable
+	c.current = name
+}
+
+// datasetHint suggests a dataset name for an undefined reference
+func (c *Checker) datasetHint(name string) string {
+	if loaded, ok := c.loadedAs[name]; ok {
+		return fmt.Sprintf("the dataset loaded by FROM %s is called %s", name, loaded)
+	}
+	if suggestion := closestName(name, c.datasetOrder); suggestion != "" {
+		return fmt.Sprintf("did you mean %s?", suggestion)
+	}
+	if len(c.datasetOrder) == 0 {
+		return "no datasets are loaded at this point"
+	}
+	return "datasets available here: " + strings.Join(c.datasetOrder, ", ")
+}
+
+// promptHint suggests a prompt name for an undefined reference
+func (c *Checker) promptHint(name string) string {
+	names := make([]string, 0, len(c.promptOrder))
+	for _, symbol := range c.promptOrder {
+		names = append(names, symbol.stmt.Name)
+	}
+	if suggestion := closestName(name, names); suggestion != "" {
+		return fmt.Sprintf("did you mean %s?", suggestion)
+	}
+	return "define it with PROMPT " + name + " { ... } before GENERATE"
+}
+
+// error records an error diagnostic
+func (c *Checker) error(span Span, message, hint string) {
+	c.diagnostics = append(c.diagnostics, Diagnostic{Severity: SeverityError, Message: message, Span: span, Hint: hint})
+}
+
+// warning records a warning diagnostic
+func (c *Checker) warning(span Span, message, hint string) {
+	c.diagnostics = append(c.diagnostics, Diagnostic{Severity: SeverityWarning, Message: message, Span: span, Hint: hint})
+}
+
+// closestName returns the candidate most similar to name, or "" if none is close enough
+func closestName(name string, candidates []string) string {
+	best := ""
+	bestDistance := len(name)/3 + 1
+	for _, candidate := range candidates {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(candidate)); d < bestDistance {
+			best = candidate
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+// editDistance computes the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,152 @@
+package dsl
+
+import (
+	"reflect"
+	"testing"
+)
+
+// check parses the input, failing the test on syntax errors, and returns the diagnostics of the checker
+func check(t *testing.T, input string) Diagnostics {
+	t.Helper()
+	return NewChecker(parse(t, input)).Check()
+}
+
+// errorMessages formats the errors among the diagnostics as line:column: message
+func errorMessages(diags Diagnostics) []string {
+	var errors Diagnostics
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			errors = append(errors, d)
+		}
+	}
+	return messages(errors)
+}
+
+func TestCheckJoin(t *testing.T) {
+	const datasets = "FROM ./questions.jsonl AS questions\nFROM ./answers.jsonl AS answers\n"
+
+	tests := []struct {
+		name   string
+		input  string
+		errors []string
+	}{
+		{
+			name:  "valid",
+			input: datasets + "JOIN questions, answers ON [id, lang] LEFT AS qa\nSAVE qa TO \"out.jsonl\"",
+		},
+		{
+			name:   "undefined datasets",
+			input:  datasets + "JOIN questions, answrs ON id\nJOIN nothing, answers ON id",
+			errors: []string{"3:1: undefined dataset answrs in JOIN", "4:1: undefined dataset nothing in JOIN"},
+		},
+		{
+			name:   "key listed twice",
+			input:  datasets + "JOIN questions, answers ON [id, lang, id]",
+			errors: []string{"3:1: column id is listed twice after ON"},
+		},
+		{
+			name:   "alias taken by a loaded dataset",
+			input:  datasets + "JOIN questions, answers ON id AS questions",
+			errors: []string{"3:1: dataset name questions is already used by the dataset defined at 1:1"},
+		},
+		{
+			name:   "alias taken by another join",
+			input:  datasets + "JOIN questions, answers ON id AS qa\nJOIN answers, questions ON id AS qa",
+			errors: []string{"4:1: dataset name qa is already used by the dataset defined at 3:1"},
+		},
+		{
+			name:   "invalid alias",
+			input:  datasets + "JOIN questions, answers ON id AS qa-pairs",
+			errors: []string{`3:1: invalid dataset name "qa-pairs" after AS`},
+		},
+		{
+			name:   "inside FROM",
+			input:  datasets + "FROM ./extra.jsonl { JOIN questions, answers ON id }",
+			errors: []string{"3:22: JOIN is only allowed at the top level of the script"},
+		},
+		{
+			name:   "undefined joined dataset in SAVE",
+			input:  datasets + "JOIN questions, answers ON id\nSAVE qa TO \"out.jsonl\"",
+			errors: []string{"4:1: undefined dataset qa in SAVE"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorMessages(check(t, tt.input)); !reflect.DeepEqual(got, tt.errors) {
+				t.Errorf("errors\n got: %q\nwant: %q", got, tt.errors)
+			}
+		})
+	}
+}
+
+func TestCheckAggregate(t *testing.T) {
+	const from = "FROM ./math.jsonl {\n    FIELDS [\"topic\", \"level\", \"difficulty\"]\n"
+
+	tests := []struct {
+		name   string
+		input  string
+		errors []string
+	}{
+		{
+			name:  "valid",
+			input: from + "    AGGREGATE count(), count(level), avg(difficulty), max(difficulty) AS hardest BY topic INTO stats\n}\nSAVE stats TO \"stats.jsonl\"",
+		},
+		{
+			name:  "arity",
+			input: from + "    AGGREGATE count(topic, level), avg(), sum(difficulty, level)\n}",
+			errors: []string{
+				"3:15: count takes 0 to 1 arguments, got 2",
+				"3:36: avg takes 1 argument, got 0",
+				"3:43: sum takes 1 argument, got 2",
+			},
+		},
+		{
+			name:   "unknown function",
+			input:  from + "    AGGREGATE mean(difficulty)\n}",
+			errors: []string{"3:15: unknown aggregate function mean"},
+		},
+		{
+			name:   "default column names collide",
+			input:  from + "    AGGREGATE avg(difficulty), avg(difficulty)\n}",
+			errors: []string{"3:32: AGGREGATE makes column avg_difficulty twice"},
+		},
+		{
+			name:   "alias collides with a BY column",
+			input:  from + "    AGGREGATE count() AS topic BY topic\n}",
+			errors: []string{"3:15: AGGREGATE makes column topic twice"},
+		},
+		{
+			name:  "aliases resolve a collision",
+			input: from + "    AGGREGATE avg(difficulty) AS mean, avg(difficulty) AS mean_again\n}",
+		},
+		{
+			name:   "BY column listed twice",
+			input:  from + "    AGGREGATE count() BY topic, topic\n}",
+			errors: []string{"3:5: column topic is listed twice after BY"},
+		},
+		{
+			name:   "unknown columns",
+			input:  from + "    AGGREGATE avg(score) BY grade\n}",
+			errors: []string{"3:5: the dataset has no column grade at this point", "3:15: the dataset has no column score at this point"},
+		},
+		{
+			name:   "INTO name taken",
+			input:  from + "    AGGREGATE count() INTO stats\n    AGGREGATE avg(difficulty) INTO stats\n}",
+			errors: []string{"4:5: dataset name stats is already used by the dataset defined at 3:5"},
+		},
+		{
+			name:   "invalid INTO name",
+			input:  from + "    AGGREGATE count() INTO topic-stats\n}",
+			errors: []string{`3:5: invalid dataset name "topic-stats" after INTO`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorMessages(check(t, tt.input)); !reflect.DeepEqual(got, tt.errors) {
+				t.Errorf("errors\n got: %q\nwant: %q", got, tt.errors)
+			}
+		})
+	}
+}
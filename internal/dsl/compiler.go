@@ -2,6 +2,7 @@ package dsl
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 )
 
@@ -9,9 +10,12 @@ import (
 type Compiler struct {
 	program             *Program
 	imports             []string
-	datasets            map[string]bool // Tracks created datasets
+	datasets            map[string]bool   // Tracks created datasets
+	bindings            map[string]string // Python variables of datasets by the names scripts refer to them with
+	current             string            // Variable of the dataset that statements outside FROM blocks work on
 	debug               bool
 	enableSigIntHandler bool // Flag for enabling SIGINT signal handler
+	generateSteps       int  // Number of GENERATE statements compiled, names their checkpoints
 }
 
 // NewCompiler creates a new compiler
@@ -20,18 +24,34 @@ func NewCompiler(program *Program) *Compiler {
 		program: program,
 		imports: []string{
 			"import datasets",
-			"from datasets import load_dataset, Dataset, concatenate_datasets",
+			"from datasets import load_dataset, load_from_disk, Dataset, DatasetDict, IterableDatasetDict, concatenate_datasets",
 			"import pandas as pd",
 			"import os",
+			"import io",
+			"import gzip",
+			"import bz2",
+			"import lzma",
+			"import glob",
 			"import sys",
 			"import json",
-			"from openai import AsyncOpenAI",
+			"import operator",
+			"import re",
+			"import random",
+			"import statistics",
+			"import unicodedata",
+			"import zlib",
+			"import numpy as np",
+			"from openai import AsyncOpenAI, APIConnectionError",
+			"import email.utils",
+			"import hashlib",
+			"import sqlite3",
 			"import time",
 			"import asyncio",
 			"from tqdm import tqdm",
 			"import signal",
 		},
 		datasets:            make(map[string]bool),
+		bindings:            make(map[string]string),
 		debug:               false,
 		enableSigIntHandler: false, // Disabled by default
 	}
@@ -63,6 +83,8 @@ func (c *Compiler) Compile() string {
 	// Get debug mode from environment variable
 	builder.WriteString("    # Define debug mode\n")
 	builder.WriteString("    debug = os.environ.get('SYN_DEBUG', '0') == '1'\n")
+	builder.WriteString("    # Continue the generation from the checkpoints of an interrupted run\n")
+	builder.WriteString("    resume = os.environ.get('SYN_RESUME', '0') == '1'\n")
 	builder.WriteString("\n")
 
 	// Default variable declarations
@@ -72,11 +94,20 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("    model = None\n")
 	builder.WriteString("    api_key = None\n")
 	builder.WriteString("    api_url = None\n")
+	builder.WriteString("    max_retries = 3  # Repeated attempts of a failed API request\n")
+	builder.WriteString("    request_timeout = 60.0  # Timeout in seconds of one API request\n")
+	builder.WriteString("    requests_per_minute = None  # Limit of API requests per minute, no limit by default\n")
+	builder.WriteString("    tokens_per_minute = None  # Limit of tokens per minute, no limit by default\n")
+	builder.WriteString("    cache_path = None  # File of the cache of model responses, set by PRAGMA CACHE\n")
 	builder.WriteString("    output_file = 'output.json'\n")
+	builder.WriteString("    output_options = {'data_format': 'json'}\n")
+	builder.WriteString("    saved_files = set()\n")
 	builder.WriteString("    loaded_datasets = {}\n")
+	builder.WriteString("    current_dataset = None\n")
 	builder.WriteString("    was_saved = False\n")
 	builder.WriteString("    prompt_templates = {}\n")
 	builder.WriteString("    system_prompts = {}\n")
+	builder.WriteString("    generation_errors = {}  # Records whose generation failed, by dataset\n")
 	builder.WriteString("    shutdown = False\n")
 	builder.WriteString(fmt.Sprintf("    sigint_handler_registered = %s  # Flag indicating whether SIGINT handler is registered\n",
 		func() string {
@@ -109,54 +140,378 @@ func (c *Compiler) Compile() string {
 		builder.WriteString("    # SIGINT signal handler is disabled\n\n")
 	}
 
+	// Add functions for writing datasets to files
+	builder.WriteString("    # Function to insert a suffix into a file name before its extensions: data.jsonl.gz -> data_train.jsonl.gz\n")
+	builder.WriteString("    def add_file_suffix(path, suffix):\n")
+	builder.WriteString("        root, compressed = path, ''\n")
+	builder.WriteString("        for ext in compression_extensions:\n")
+	builder.WriteString("            if root.lower().endswith(ext):\n")
+	builder.WriteString("                root, compressed = root[:-len(ext)], root[-len(ext):]\n")
+	builder.WriteString("                break\n")
+	builder.WriteString("        root, ext = os.path.splitext(root)\n")
+	builder.WriteString("        return f'{root}{suffix}{ext}{compressed}'\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to get the file of failed generations written next to a saved dataset: data.jsonl.gz -> data.errors.jsonl\n")
+	builder.WriteString("    def errors_file_path(path):\n")
+	builder.WriteString("        root = path\n")
+	builder.WriteString("        for ext in compression_extensions:\n")
+	builder.WriteString("            if root.lower().endswith(ext):\n")
+	builder.WriteString("                root = root[:-len(ext)]\n")
+	builder.WriteString("                break\n")
+	builder.WriteString("        return os.path.splitext(root)[0] + '.errors.jsonl'\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to write failed generations to a JSONL file, so that they can be generated again later\n")
+	builder.WriteString("    def write_generation_errors(failures, path):\n")
+	builder.WriteString("        os.makedirs(os.path.dirname(path) or '.', exist_ok=True)\n")
+	builder.WriteString("        with open_output(path) as f:\n")
+	builder.WriteString("            write_records(failures, f, 'jsonl')\n")
+	builder.WriteString("        print(f'⚠️ {len(failures)} failed generations saved to {path}')\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to pass the failed generations of the source datasets to a dataset made of them by MERGE, JOIN or FROM,\n")
+	builder.WriteString("    # so that SAVE of the new dataset writes them too\n")
+	builder.WriteString("    def carry_generation_errors(target, sources):\n")
+	builder.WriteString("        for source in dict.fromkeys(sources):\n")
+	builder.WriteString("            if source != target and generation_errors.get(source):\n")
+	builder.WriteString("                generation_errors.setdefault(target, []).extend(generation_errors[source])\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to open a text file for writing, compressed with gzip, bz2, xz or zstd\n")
+	builder.WriteString("    def open_output(path, compression=None):\n")
+	builder.WriteString("        if compression == 'gzip':\n")
+	builder.WriteString("            return gzip.open(path, 'wt', encoding='utf-8')\n")
+	builder.WriteString("        if compression == 'bz2':\n")
+	builder.WriteString("            return bz2.open(path, 'wt', encoding='utf-8')\n")
+	builder.WriteString("        if compression == 'xz':\n")
+	builder.WriteString("            return lzma.open(path, 'wt', encoding='utf-8')\n")
+	builder.WriteString("        if compression == 'zstd':\n")
+	builder.WriteString("            import zstandard\n")
+	builder.WriteString("            return io.TextIOWrapper(zstandard.ZstdCompressor().stream_writer(open(path, 'wb')), encoding='utf-8')\n")
+	builder.WriteString("        return open(path, 'w', encoding='utf-8')\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to write the records of a dataset to a text file one by one, without loading them all into memory\n")
+	builder.WriteString("    def write_records(dataset, f, data_format):\n")
+	builder.WriteString("        if data_format == 'jsonl':\n")
+	builder.WriteString("            for item in dataset:\n")
+	builder.WriteString("                f.write(json.dumps(item, ensure_ascii=False, default=str) + '\\n')\n")
+	builder.WriteString("        elif data_format == 'json':\n")
+	builder.WriteString("            f.write('[')\n")
+	builder.WriteString("            for i, item in enumerate(dataset):\n")
+	builder.WriteString("                f.write((',\\n' if i else '\\n') + json.dumps(item, ensure_ascii=False, indent=2, default=str))\n")
+	builder.WriteString("            f.write('\\n]\\n')\n")
+	builder.WriteString("        else:\n")
+	builder.WriteString("            # CSV and TSV are written in batches, the header only once\n")
+	builder.WriteString("            sep = '\\t' if data_format == 'tsv' else ','\n")
+	builder.WriteString("            batch, header = [], True\n")
+	builder.WriteString("            for item in dataset:\n")
+	builder.WriteString("                batch.append(item)\n")
+	builder.WriteString("                if len(batch) == 1000:\n")
+	builder.WriteString("                    pd.DataFrame(batch).to_csv(f, sep=sep, index=False, header=header)\n")
+	builder.WriteString("                    batch, header = [], False\n")
+	builder.WriteString("            if batch or header:\n")
+	builder.WriteString("                pd.DataFrame(batch).to_csv(f, sep=sep, index=False, header=header)\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to write a dataset in the given format, optionally compressed and split into files of at most shard_rows rows.\n")
+	builder.WriteString("    # Every split of a DatasetDict goes to its own file; an Arrow directory keeps all splits. Returns the written paths.\n")
+	builder.WriteString("    def write_dataset(dataset, path, data_format='json', compression=None, shard_rows=None):\n")
+	builder.WriteString("        directory = os.path.dirname(path)\n")
+	builder.WriteString("        if directory:\n")
+	builder.WriteString("            os.makedirs(directory, exist_ok=True)\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        if data_format == 'arrow':\n")
+	builder.WriteString("            num_shards = None\n")
+	builder.WriteString("            if shard_rows and isinstance(dataset, dict):\n")
+	builder.WriteString("                num_shards = {split: max(1, -(-d.num_rows // shard_rows)) for split, d in dataset.items()}\n")
+	builder.WriteString("            elif shard_rows:\n")
+	builder.WriteString("                num_shards = max(1, -(-dataset.num_rows // shard_rows))\n")
+	builder.WriteString("            dataset.save_to_disk(path, num_shards=num_shards)\n")
+	builder.WriteString("            return [path]\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        if isinstance(dataset, dict):\n")
+	builder.WriteString("            paths = []\n")
+	builder.WriteString("            for split, split_dataset in dataset.items():\n")
+	builder.WriteString("                paths += write_dataset(split_dataset, add_file_suffix(path, f'_{split}'), data_format, compression, shard_rows)\n")
+	builder.WriteString("            return paths\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        num_shards = max(1, -(-dataset.num_rows // shard_rows)) if shard_rows else 1\n")
+	builder.WriteString("        paths = []\n")
+	builder.WriteString("        for index in range(num_shards):\n")
+	builder.WriteString("            shard = dataset.shard(num_shards, index, contiguous=True) if num_shards > 1 else dataset\n")
+	builder.WriteString("            shard_path = add_file_suffix(path, f'-{index:05d}-of-{num_shards:05d}') if num_shards > 1 else path\n")
+	builder.WriteString("            if data_format == 'parquet':\n")
+	builder.WriteString("                shard.to_parquet(shard_path, **({'compression': compression} if compression else {}))\n")
+	builder.WriteString("            else:\n")
+	builder.WriteString("                with open_output(shard_path, compression) as f:\n")
+	builder.WriteString("                    write_records(shard, f, data_format)\n")
+	builder.WriteString("            paths.append(shard_path)\n")
+	builder.WriteString("        return paths\n")
+	builder.WriteString("    \n")
+
 	// Add function to save current results
 	builder.WriteString("    # Function to save current results\n")
-	builder.WriteString("    def save_current_results():\n")
-	builder.WriteString("        if not loaded_datasets:\n")
+	builder.WriteString("    def save_current_results(dataset_name=None):\n")
+	builder.WriteString("        # Select the dataset given by SAVE, or the current dataset of the script when interrupted\n")
+	builder.WriteString("        dataset_name = dataset_name or current_dataset\n")
+	builder.WriteString("        if dataset_name not in loaded_datasets:\n")
 	builder.WriteString("            print('❌ No data to save.')\n")
 	builder.WriteString("            return\n")
-	builder.WriteString("        \n")
-	builder.WriteString("        # Select the last loaded dataset\n")
-	builder.WriteString("        last_dataset_name = list(loaded_datasets.keys())[-1]\n")
-	builder.WriteString("        last_dataset = loaded_datasets[last_dataset_name]\n")
-	builder.WriteString("        \n")
-	builder.WriteString("        # Create output directory if it doesn't exist\n")
-	builder.WriteString("        os.makedirs('output', exist_ok=True)\n")
+	builder.WriteString("        dataset = loaded_datasets[dataset_name]\n")
 	builder.WriteString("        \n")
 	builder.WriteString("        # Generate emergency save filename if name is not specified\n")
 	builder.WriteString("        save_filename = output_file\n")
+	builder.WriteString("        save_options = output_options\n")
 	builder.WriteString("        if not was_saved:\n")
 	builder.WriteString("            # Get timestamp for filename\n")
 	builder.WriteString("            timestamp = time.strftime('%Y%m%d_%H%M%S')\n")
-	builder.WriteString("            save_filename = f'emergency_save_{timestamp}.json'\n")
+	builder.WriteString("            save_filename = os.path.join('output', f'emergency_save_{timestamp}.json')\n")
+	builder.WriteString("            save_options = {'data_format': 'json'}\n")
 	builder.WriteString("        \n")
-	builder.WriteString("        # Form the full path to the directory where the dataset will be saved\n")
-	builder.WriteString("        dataset_dir = os.path.join('output', os.path.splitext(save_filename)[0])\n")
-	builder.WriteString("        json_path = os.path.join('output', save_filename)\n")
-	builder.WriteString("        \n")
-	builder.WriteString("        # Check if the directory for saving already exists\n")
-	builder.WriteString("        if os.path.exists(dataset_dir):\n")
-	builder.WriteString("            print(f'ℹ️ Dataset already saved to {dataset_dir}. Skipping re-save.')\n")
+	builder.WriteString("        # Check if the file was already written in this run, e.g. by SAVE before Ctrl+C\n")
+	builder.WriteString("        if save_filename in saved_files:\n")
+	builder.WriteString("            print(f'ℹ️ Dataset already saved to {save_filename}. Skipping re-save.')\n")
 	builder.WriteString("            return\n")
 	builder.WriteString("        \n")
-	builder.WriteString("        print(f'💾 Saving dataset {last_dataset_name} to {dataset_dir}...')\n")
+	builder.WriteString("        print(f'💾 Saving dataset {dataset_name} to {save_filename}...')\n")
 	builder.WriteString("        \n")
 	builder.WriteString("        try:\n")
-	builder.WriteString("            # Save the dataset using Hugging Face's native method\n")
-	builder.WriteString("            last_dataset.save_to_disk(dataset_dir)\n")
+	builder.WriteString("            paths = write_dataset(dataset, save_filename, **save_options)\n")
+	builder.WriteString("            saved_files.add(save_filename)\n")
 	builder.WriteString("            \n")
-	builder.WriteString("            # Also create a JSON version for compatibility\n")
-	builder.WriteString("            with open(json_path, 'w', encoding='utf-8') as f:\n")
-	builder.WriteString("                json.dump([item for item in last_dataset], f, ensure_ascii=False, indent=2)\n")
+	builder.WriteString("            if isinstance(dataset, dict):\n")
+	builder.WriteString("                num_rows = sum(split_dataset.num_rows for split_dataset in dataset.values())\n")
+	builder.WriteString("            else:\n")
+	builder.WriteString("                num_rows = dataset.num_rows\n")
+	builder.WriteString("            print(f'✅ Done! Processed {num_rows} records. Dataset saved to {\", \".join(paths)}')\n")
 	builder.WriteString("            \n")
-	builder.WriteString("            print(f'✅ Done! Processed {last_dataset.num_rows} records. Dataset saved to {dataset_dir} and as JSON to {json_path}')\n")
+	builder.WriteString("            # Failed generations go to a separate file, so that they can be generated again later\n")
+	builder.WriteString("            failures = generation_errors.get(dataset_name)\n")
+	builder.WriteString("            if failures:\n")
+	builder.WriteString("                write_generation_errors(failures, errors_file_path(save_filename))\n")
 	builder.WriteString("        except Exception as e:\n")
 	builder.WriteString("            print(f'❌ Error saving results: {e}')\n")
 	builder.WriteString("    \n")
 
+	// Add functions for retrying failed API requests
+	builder.WriteString("    # HTTP statuses of errors that may pass when the request is repeated: timeouts, conflicts, rate limits and server errors\n")
+	builder.WriteString("    retryable_statuses = {408, 409, 429}\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to check if a failed API request is worth repeating; errors in the request itself, such as a wrong key or model, are fatal\n")
+	builder.WriteString("    def is_retryable(error):\n")
+	builder.WriteString("        status = getattr(error, 'status_code', None)\n")
+	builder.WriteString("        if status is not None:\n")
+	builder.WriteString("            return status in retryable_statuses or status >= 500\n")
+	builder.WriteString("        # Errors without a response: timeouts and connection failures\n")
+	builder.WriteString("        return isinstance(error, (APIConnectionError, asyncio.TimeoutError))\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to get the delay before the next attempt: the one asked by the server in Retry-After,\n")
+	builder.WriteString("    # otherwise exponential backoff with jitter, so that parallel requests do not retry all at once\n")
+	builder.WriteString("    def retry_delay(error, attempt, base_delay=1.0, max_delay=60.0):\n")
+	builder.WriteString("        headers = getattr(getattr(error, 'response', None), 'headers', None) or {}\n")
+	builder.WriteString("        try:\n")
+	builder.WriteString("            if headers.get('retry-after-ms'):\n")
+	builder.WriteString("                return max(0.0, float(headers['retry-after-ms']) / 1000)\n")
+	builder.WriteString("            if headers.get('retry-after'):\n")
+	builder.WriteString("                value = headers['retry-after']\n")
+	builder.WriteString("                if value.strip().replace('.', '', 1).isdigit():\n")
+	builder.WriteString("                    return float(value)\n")
+	builder.WriteString("                # Retry-After can also be an HTTP date\n")
+	builder.WriteString("                return max(0.0, email.utils.parsedate_to_datetime(value).timestamp() - time.time())\n")
+	builder.WriteString("        except (TypeError, ValueError):\n")
+	builder.WriteString("            pass\n")
+	builder.WriteString("        delay = min(max_delay, base_delay * 2 ** attempt)\n")
+	builder.WriteString("        return delay / 2 + random.uniform(0, delay / 2)\n")
+	builder.WriteString("    \n")
+
+	// Add rate limiting of requests and tokens per minute
+	builder.WriteString("    # Rate limiters of the API URLs, shared by all GENERATE statements that send requests to the same URL\n")
+	builder.WriteString("    rate_limiters = {}\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Token bucket that holds a minute of its rate and refills continuously\n")
+	builder.WriteString("    class TokenBucket:\n")
+	builder.WriteString("        def __init__(self, per_minute):\n")
+	builder.WriteString("            self.capacity = per_minute\n")
+	builder.WriteString("            self.available = float(per_minute)\n")
+	builder.WriteString("            self.updated = time.monotonic()\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        # Seconds to wait until the amount is available; an amount above the capacity waits for a full bucket\n")
+	builder.WriteString("        def wait_time(self, amount):\n")
+	builder.WriteString("            now = time.monotonic()\n")
+	builder.WriteString("            self.available = min(self.capacity, self.available + (now - self.updated) * self.capacity / 60)\n")
+	builder.WriteString("            self.updated = now\n")
+	builder.WriteString("            return max(0.0, min(amount, self.capacity) - self.available) * 60 / self.capacity\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Limiter of the requests (RPM) and tokens (TPM) per minute sent to one API URL\n")
+	builder.WriteString("    class RateLimiter:\n")
+	builder.WriteString("        def __init__(self):\n")
+	builder.WriteString("            self.requests = None\n")
+	builder.WriteString("            self.tokens = None\n")
+	builder.WriteString("            self.waiting = 0\n")
+	builder.WriteString("            self.throttled = 0\n")
+	builder.WriteString("            self.pbar = None\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        # Sets the limits given by USING; a bucket keeps its state while its limit stays the same\n")
+	builder.WriteString("        def configure(self, rpm, tpm):\n")
+	builder.WriteString("            if rpm != (self.requests.capacity if self.requests else None):\n")
+	builder.WriteString("                self.requests = TokenBucket(rpm) if rpm else None\n")
+	builder.WriteString("            if tpm != (self.tokens.capacity if self.tokens else None):\n")
+	builder.WriteString("                self.tokens = TokenBucket(tpm) if tpm else None\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        # Shows the throttled requests next to the progress bar\n")
+	builder.WriteString("        def show(self):\n")
+	builder.WriteString("            if self.pbar is not None:\n")
+	builder.WriteString("                self.pbar.set_postfix_str(f'rate limit: {self.waiting} waiting, {self.throttled} throttled')\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        # Waits until a request of the given number of tokens fits into the limits and takes it from the buckets\n")
+	builder.WriteString("        async def acquire(self, tokens):\n")
+	builder.WriteString("            throttled = False\n")
+	builder.WriteString("            while True:\n")
+	builder.WriteString("                delay = 0.0\n")
+	builder.WriteString("                if self.requests:\n")
+	builder.WriteString("                    delay = max(delay, self.requests.wait_time(1))\n")
+	builder.WriteString("                if self.tokens:\n")
+	builder.WriteString("                    delay = max(delay, self.tokens.wait_time(tokens))\n")
+	builder.WriteString("                if delay <= 0:\n")
+	builder.WriteString("                    break\n")
+	builder.WriteString("                if not throttled:\n")
+	builder.WriteString("                    throttled = True\n")
+	builder.WriteString("                    self.throttled += 1\n")
+	builder.WriteString("                    self.waiting += 1\n")
+	builder.WriteString("                    self.show()\n")
+	builder.WriteString("                await asyncio.sleep(delay)\n")
+	builder.WriteString("            if throttled:\n")
+	builder.WriteString("                self.waiting -= 1\n")
+	builder.WriteString("                self.show()\n")
+	builder.WriteString("            if self.requests:\n")
+	builder.WriteString("                self.requests.available -= 1\n")
+	builder.WriteString("            if self.tokens:\n")
+	builder.WriteString("                self.tokens.available -= tokens\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        # Corrects the estimated tokens of a request by the tokens the API has actually counted\n")
+	builder.WriteString("        def settle(self, estimated, used):\n")
+	builder.WriteString("            if self.tokens and used:\n")
+	builder.WriteString("                self.tokens.available += estimated - used\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to get the rate limiter of the current API URL, or None when USING sets no RPM and TPM\n")
+	builder.WriteString("    def get_rate_limiter():\n")
+	builder.WriteString("        if not requests_per_minute and not tokens_per_minute:\n")
+	builder.WriteString("            return None\n")
+	builder.WriteString("        limiter = rate_limiters.setdefault(api_url or 'default', RateLimiter())\n")
+	builder.WriteString("        limiter.configure(requests_per_minute, tokens_per_minute)\n")
+	builder.WriteString("        return limiter\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to estimate the tokens of a request before it is sent: about 4 characters per token of the messages plus the maximum response\n")
+	builder.WriteString("    def estimate_tokens(messages, max_tokens):\n")
+	builder.WriteString("        return sum(len(message['content']) for message in messages) // 4 + max_tokens\n\n")
+
+	// Add the cache of model responses
+	builder.WriteString("    # Caches of model responses in SQLite by file, opened on the first request; None when the file cannot be opened\n")
+	builder.WriteString("    response_caches = {}\n")
+	builder.WriteString("    cache_stats = {'hits': 0, 'misses': 0}\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to get the response cache: the file given by --cache or PRAGMA CACHE, or None when the cache is off or turned off by --no-cache\n")
+	builder.WriteString("    def get_response_cache():\n")
+	builder.WriteString("        path = os.environ.get('SYN_CACHE') or cache_path\n")
+	builder.WriteString("        if not path or os.environ.get('SYN_NO_CACHE') == '1':\n")
+	builder.WriteString("            return None\n")
+	builder.WriteString("        if path not in response_caches:\n")
+	builder.WriteString("            try:\n")
+	builder.WriteString("                os.makedirs(os.path.dirname(path) or '.', exist_ok=True)\n")
+	builder.WriteString("                cache = sqlite3.connect(path)\n")
+	builder.WriteString("                cache.execute('CREATE TABLE IF NOT EXISTS responses (key TEXT PRIMARY KEY, response TEXT NOT NULL, created REAL NOT NULL)')\n")
+	builder.WriteString("                cache.commit()\n")
+	builder.WriteString("                print(f'💾 Using response cache {path}')\n")
+	builder.WriteString("            except (OSError, sqlite3.Error) as e:\n")
+	builder.WriteString("                print(f'⚠️ Cannot open response cache {path}: {e}. Requests will not be cached')\n")
+	builder.WriteString("                cache = None\n")
+	builder.WriteString("            response_caches[path] = cache\n")
+	builder.WriteString("        return response_caches[path]\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to get the cache key of a request: everything that changes the response of the model\n")
+	builder.WriteString("    def cache_key(model_name, messages, temperature, max_tokens):\n")
+	builder.WriteString("        request = {'model': model_name, 'url': api_url, 'messages': messages, 'temperature': temperature, 'max_tokens': max_tokens}\n")
+	builder.WriteString("        return hashlib.sha256(json.dumps(request, sort_keys=True, ensure_ascii=False).encode('utf-8')).hexdigest()\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to save a response to the cache; a failed write only loses the cached response\n")
+	builder.WriteString("    def store_cached_response(cache, key, response):\n")
+	builder.WriteString("        try:\n")
+	builder.WriteString("            cache.execute('INSERT OR REPLACE INTO responses (key, response, created) VALUES (?, ?, ?)', (key, response, time.time()))\n")
+	builder.WriteString("            cache.commit()\n")
+	builder.WriteString("        except sqlite3.Error as e:\n")
+	builder.WriteString("            print(f'⚠️ Cannot save response to cache: {e}')\n\n")
+
+	// Add checkpoints of generation
+	builder.WriteString("    # Checkpoints of GENERATE: the responses are appended to a file after every batch, so that --resume can continue an interrupted run.\n")
+	builder.WriteString("    # checkpoints tells for every file whether its step has processed all records; they are removed when the script runs to the end\n")
+	builder.WriteString("    # The directory is named after the DSL file and a hash of its absolute path, so that scripts with the same name have their own checkpoints\n")
+	builder.WriteString("    checkpoint_source = os.path.abspath(os.environ.get('SYN_SOURCE') or sys.argv[0])\n")
+	builder.WriteString("    checkpoint_dir = os.path.join('output', 'checkpoints', os.path.splitext(os.path.basename(checkpoint_source))[0] + '-' + hashlib.sha256(checkpoint_source.encode('utf-8')).hexdigest()[:12])\n")
+	builder.WriteString("    checkpoints = {}\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to get the fingerprint of a GENERATE step: a checkpoint is resumed only for the same records and generation settings\n")
+	builder.WriteString("    def checkpoint_fingerprint(records, *settings):\n")
+	builder.WriteString("        digest = hashlib.sha256(json.dumps(settings, sort_keys=True, default=str, ensure_ascii=False).encode('utf-8'))\n")
+	builder.WriteString("        for record in records:\n")
+	builder.WriteString("            digest.update(json.dumps(record, sort_keys=True, default=str, ensure_ascii=False).encode('utf-8'))\n")
+	builder.WriteString("        return digest.hexdigest()\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to read the responses of a checkpoint by record index, if it was written with the same fingerprint\n")
+	builder.WriteString("    def read_checkpoint(path, fingerprint):\n")
+	builder.WriteString("        restored = {}\n")
+	builder.WriteString("        with open(path, encoding='utf-8') as f:\n")
+	builder.WriteString("            try:\n")
+	builder.WriteString("                header = json.loads(f.readline())\n")
+	builder.WriteString("            except ValueError:\n")
+	builder.WriteString("                header = None\n")
+	builder.WriteString("            if not isinstance(header, dict) or header.get('fingerprint') != fingerprint:\n")
+	builder.WriteString("                print(f'⚠️ Checkpoint {path} was written for other records or generation settings, starting over')\n")
+	builder.WriteString("                return {}\n")
+	builder.WriteString("            for line in f:\n")
+	builder.WriteString("                try:\n")
+	builder.WriteString("                    entry = json.loads(line)\n")
+	builder.WriteString("                except ValueError:\n")
+	builder.WriteString("                    continue  # The last line may be cut by the interruption\n")
+	builder.WriteString("                restored[entry['index']] = entry['response']\n")
+	builder.WriteString("        print(f'♻️ Resuming from checkpoint {path}: {len(restored)} records already generated')\n")
+	builder.WriteString("        return restored\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to open the checkpoint of a GENERATE step; returns the file to append to and the responses restored by --resume.\n")
+	builder.WriteString("    # The file is named by the fingerprint, so a checkpoint of other records or generation settings is kept rather than overwritten\n")
+	builder.WriteString("    def open_checkpoint(step, fingerprint):\n")
+	builder.WriteString("        path = os.path.join(checkpoint_dir, f'{step}-{fingerprint[:16]}.jsonl')\n")
+	builder.WriteString("        restored = {}\n")
+	builder.WriteString("        if os.path.exists(path):\n")
+	builder.WriteString("            if resume:\n")
+	builder.WriteString("                restored = read_checkpoint(path, fingerprint)\n")
+	builder.WriteString("            else:\n")
+	builder.WriteString("                print(f'ℹ️ Checkpoint {path} of an earlier run is started over; run with --resume to continue it')\n")
+	builder.WriteString("        elif resume and glob.glob(os.path.join(glob.escape(checkpoint_dir), f'{glob.escape(step)}-*.jsonl')):\n")
+	builder.WriteString("            print(f'⚠️ Checkpoints of {step} in {checkpoint_dir} were written for other records or generation settings, starting over')\n")
+	builder.WriteString("        os.makedirs(checkpoint_dir, exist_ok=True)\n")
+	builder.WriteString("        checkpoint = open(path, 'a' if restored else 'w', encoding='utf-8')\n")
+	builder.WriteString("        if not restored:\n")
+	builder.WriteString("            checkpoint.write(json.dumps({'fingerprint': fingerprint}) + '\\n')\n")
+	builder.WriteString("        checkpoints[path] = False\n")
+	builder.WriteString("        return checkpoint, restored\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to append the generated responses of a batch to a checkpoint; failed records are generated again on resume\n")
+	builder.WriteString("    def save_checkpoint(checkpoint, generated, target_field):\n")
+	builder.WriteString("        for index, (item_dict, error) in generated.items():\n")
+	builder.WriteString("            if error is None:\n")
+	builder.WriteString("                checkpoint.write(json.dumps({'index': index, 'response': item_dict[target_field]}, ensure_ascii=False) + '\\n')\n")
+	builder.WriteString("        checkpoint.flush()\n")
+	builder.WriteString("        os.fsync(checkpoint.fileno())\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function to remove the checkpoints of the steps that have processed all records\n")
+	builder.WriteString("    def remove_checkpoints():\n")
+	builder.WriteString("        for path, completed in checkpoints.items():\n")
+	builder.WriteString("            if completed and os.path.exists(path):\n")
+	builder.WriteString("                os.remove(path)\n")
+	builder.WriteString("        try:\n")
+	builder.WriteString("            os.rmdir(checkpoint_dir)\n")
+	builder.WriteString("        except OSError:\n")
+	builder.WriteString("            pass  # Not empty: an interrupted step can still be resumed\n\n")
+
 	// Add functions for asynchronous content generation with OpenAI
 	builder.WriteString("    # Function for asynchronous OpenAI API calls\n")
-	builder.WriteString("    async def call_openai_api_async(prompt, model_name='gpt-3.5-turbo', temperature=0.7, max_tokens=1024, semaphore=None, system_prompt=None):\n")
+	builder.WriteString("    async def call_openai_api_async(prompt, model_name='gpt-3.5-turbo', temperature=0.7, max_tokens=1024, semaphore=None, system_prompt=None, limiter=None):\n")
 	builder.WriteString("        client = None\n")
 	builder.WriteString("        \n")
 	builder.WriteString("        # If semaphore is provided, use it to control concurrency\n")
@@ -168,27 +523,52 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("                    if system_prompt:\n")
 	builder.WriteString("                        print(f'System prompt: {system_prompt[:100]}...' if len(system_prompt) > 100 else f'System prompt: {system_prompt}')\n")
 	builder.WriteString("                \n")
-	builder.WriteString("                client = AsyncOpenAI(api_key=api_key, base_url=api_url if api_url else None)\n")
-	builder.WriteString("                \n")
-	builder.WriteString("                # Set timeout to 30 seconds\n")
-	builder.WriteString("                start_time = time.time()\n")
-	builder.WriteString("                max_time = 30  # maximum wait time in seconds\n")
-	builder.WriteString("                \n")
 	builder.WriteString("                # Format messages based on whether a system prompt is provided\n")
 	builder.WriteString("                messages = []\n")
 	builder.WriteString("                if system_prompt:\n")
 	builder.WriteString("                    messages.append({'role': 'system', 'content': system_prompt})\n")
 	builder.WriteString("                messages.append({'role': 'user', 'content': prompt})\n")
 	builder.WriteString("                \n")
-	builder.WriteString("                response = await client.chat.completions.create(\n")
-	builder.WriteString("                    model=model_name,\n")
-	builder.WriteString("                    messages=messages,\n")
-	builder.WriteString("                    temperature=temperature,\n")
-	builder.WriteString("                    max_tokens=max_tokens,\n")
-	builder.WriteString("                    timeout=20  # Timeout in seconds for HTTP request\n")
-	builder.WriteString("                )\n")
+	builder.WriteString("                # A response cached by an earlier request is used without sending it again\n")
+	builder.WriteString("                cache = get_response_cache()\n")
+	builder.WriteString("                if cache is not None:\n")
+	builder.WriteString("                    key = cache_key(model_name, messages, temperature, max_tokens)\n")
+	builder.WriteString("                    row = cache.execute('SELECT response FROM responses WHERE key = ?', (key,)).fetchone()\n")
+	builder.WriteString("                    if row is not None:\n")
+	builder.WriteString("                        cache_stats['hits'] += 1\n")
+	builder.WriteString("                        return row[0]\n")
+	builder.WriteString("                    cache_stats['misses'] += 1\n")
 	builder.WriteString("                \n")
-	builder.WriteString("                return response.choices[0].message.content.strip()\n")
+	builder.WriteString("                # The client does not retry by itself: retries are made below to honor RETRIES\n")
+	builder.WriteString("                client = AsyncOpenAI(api_key=api_key, base_url=api_url if api_url else None, max_retries=0)\n")
+	builder.WriteString("                \n")
+	builder.WriteString("                attempt = 0\n")
+	builder.WriteString("                estimated = estimate_tokens(messages, max_tokens)\n")
+	builder.WriteString("                while True:\n")
+	builder.WriteString("                    try:\n")
+	builder.WriteString("                        # Every attempt is a request counted by RPM and TPM\n")
+	builder.WriteString("                        if limiter:\n")
+	builder.WriteString("                            await limiter.acquire(estimated)\n")
+	builder.WriteString("                        response = await client.chat.completions.create(\n")
+	builder.WriteString("                            model=model_name,\n")
+	builder.WriteString("                            messages=messages,\n")
+	builder.WriteString("                            temperature=temperature,\n")
+	builder.WriteString("                            max_tokens=max_tokens,\n")
+	builder.WriteString("                            timeout=request_timeout  # Timeout in seconds for HTTP request\n")
+	builder.WriteString("                        )\n")
+	builder.WriteString("                        if limiter:\n")
+	builder.WriteString("                            limiter.settle(estimated, getattr(getattr(response, 'usage', None), 'total_tokens', None))\n")
+	builder.WriteString("                        content = response.choices[0].message.content.strip()\n")
+	builder.WriteString("                        if cache is not None:\n")
+	builder.WriteString("                            store_cached_response(cache, key, content)\n")
+	builder.WriteString("                        return content\n")
+	builder.WriteString("                    except Exception as e:\n")
+	builder.WriteString("                        if attempt >= max_retries or shutdown or not is_retryable(e):\n")
+	builder.WriteString("                            raise\n")
+	builder.WriteString("                        delay = retry_delay(e, attempt)\n")
+	builder.WriteString("                        attempt += 1\n")
+	builder.WriteString("                        print(f'⚠️ {type(e).__name__}: retry {attempt} of {max_retries} in {delay:.1f}s')\n")
+	builder.WriteString("                        await asyncio.sleep(delay)\n")
 	builder.WriteString("            except Exception as e:\n")
 	builder.WriteString("                error_msg = str(e)\n")
 	builder.WriteString("                print(f'Error calling OpenAI API: {error_msg}')\n")
@@ -196,7 +576,7 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("                    print('Problem with API key. Check your key.')\n")
 	builder.WriteString("                elif 'timeout' in error_msg.lower() or 'connection' in error_msg.lower():\n")
 	builder.WriteString("                    print('Timeout exceeded. Check your internet connection or API availability.')\n")
-	builder.WriteString("                return f'[Generation error: {error_msg}]'\n")
+	builder.WriteString("                raise\n")
 	builder.WriteString("            finally:\n")
 	builder.WriteString("                # Close the client if possible\n")
 	builder.WriteString("                if client and hasattr(client, 'close'):\n")
@@ -207,12 +587,14 @@ func (c *Compiler) Compile() string {
 
 	// Aynchronous function for processing one record of the dataset
 	builder.WriteString("    # Function for asynchronous processing of one dataset record\n")
-	builder.WriteString("    async def process_item_async(item, source_field, target_field, model_name, temperature, max_tokens, prompt_template, semaphore, pbar=None):\n")
+	builder.WriteString("    async def process_item_async(item, source_field, target_field, model_name, temperature, max_tokens, prompt_template, semaphore, pbar=None, limiter=None):\n")
+	builder.WriteString("        # The target field is empty until the generation succeeds; returns the record and the error, if any\n")
+	builder.WriteString("        item_dict = dict(item)\n")
+	builder.WriteString("        item_dict[target_field] = None\n")
 	builder.WriteString("        try:\n")
 	builder.WriteString("            if shutdown:\n")
-	builder.WriteString("                return item\n")
+	builder.WriteString("                return item_dict, 'Interrupted before generation'\n")
 	builder.WriteString("            \n")
-	builder.WriteString("            item_dict = dict(item)\n")
 	builder.WriteString("            system_prompt = None\n")
 	builder.WriteString("            \n")
 	builder.WriteString("            # Check for system prompt presence\n")
@@ -238,21 +620,20 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("                    prompt = ''\n")
 	builder.WriteString("            \n")
 	builder.WriteString("            # Generate response\n")
-	builder.WriteString("            response = await call_openai_api_async(prompt, model_name, temperature, max_tokens, semaphore, system_prompt)\n")
-	builder.WriteString("            \n")
-	builder.WriteString("            # Add result\n")
-	builder.WriteString("            item_dict[target_field] = response\n")
-	builder.WriteString("            return item_dict\n")
+	builder.WriteString("            item_dict[target_field] = await call_openai_api_async(prompt, model_name, temperature, max_tokens, semaphore, system_prompt, limiter)\n")
+	builder.WriteString("            return item_dict, None\n")
 	builder.WriteString("        except Exception as e:\n")
-	builder.WriteString("            print(f'Error processing record: {e}')\n")
-	builder.WriteString("            return item\n")
+	builder.WriteString("            return item_dict, f'{type(e).__name__}: {e}'\n")
 	builder.WriteString("        finally:\n")
 	builder.WriteString("            if pbar:\n")
 	builder.WriteString("                pbar.update(1)\n\n")
 
 	// Aynchronous function for generating content
 	builder.WriteString("    # Function for asynchronous content generation for the entire dataset\n")
-	builder.WriteString("    async def generate_content_async(dataset, source_field, target_field, model_name=None, temperature=0.7, max_tokens=1024, prompt_template=None):\n")
+	builder.WriteString("    # on_error: 'keep' leaves failed records with an empty target field, 'skip' drops them, 'fail' stops the script;\n")
+	builder.WriteString("    # failed records are added to failures, and error_column adds the error of every record as __syn_error;\n")
+	builder.WriteString("    # checkpoint_step names the checkpoint of the step, None turns checkpoints off\n")
+	builder.WriteString("    async def generate_content_async(dataset, source_field, target_field, model_name=None, temperature=0.7, max_tokens=1024, prompt_template=None, on_error='keep', error_column=False, failures=None, checkpoint_step=None):\n")
 	builder.WriteString("        if model_name is None:\n")
 	builder.WriteString("            if model is None:\n")
 	builder.WriteString("                print('❌ Error: model not specified for generation')\n")
@@ -265,10 +646,14 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("        \n")
 	builder.WriteString("        print(f'🔄 Generating field {target_field} based on {source_field} using model {model_name}...')\n")
 	builder.WriteString("        \n")
+	builder.WriteString("        checkpoint = None\n")
 	builder.WriteString("        try:\n")
 	builder.WriteString("            # Create semaphore for controlling concurrency\n")
 	builder.WriteString("            semaphore = asyncio.Semaphore(concurrency)\n")
 	builder.WriteString("            \n")
+	builder.WriteString("            # Rate limiter shared with the other GENERATE statements using the same API URL\n")
+	builder.WriteString("            limiter = get_rate_limiter()\n")
+	builder.WriteString("            \n")
 	builder.WriteString("            # Demonstration mode - process a limited number of records\n")
 	builder.WriteString("            if debug:\n")
 	builder.WriteString("                sample_size = min(5, len(dataset))\n")
@@ -284,9 +669,23 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("            tasks = []\n")
 	builder.WriteString("            all_items = list(dataset_sample)\n")
 	builder.WriteString("            processed_items = []\n")
+	builder.WriteString("            failed_count = 0\n")
+	builder.WriteString("            \n")
+	builder.WriteString("            # Checkpoint of the step: responses are saved after every batch, and the ones restored by --resume are not generated again\n")
+	builder.WriteString("            restored = {}\n")
+	builder.WriteString("            if checkpoint_step:\n")
+	builder.WriteString("                fingerprint = checkpoint_fingerprint(all_items, source_field, target_field, model_name, temperature, max_tokens,\n")
+	builder.WriteString("                                                     prompt_templates.get(prompt_template), system_prompts.get(prompt_template))\n")
+	builder.WriteString("                checkpoint, restored = open_checkpoint(checkpoint_step, fingerprint)\n")
 	builder.WriteString("            \n")
 	builder.WriteString("            # Prepare progress bar\n")
 	builder.WriteString("            pbar = tqdm(total=sample_size, desc='Generation')\n")
+	builder.WriteString("            if restored:\n")
+	builder.WriteString("                pbar.update(len(restored))\n")
+	builder.WriteString("            if limiter:\n")
+	builder.WriteString("                limiter.pbar = pbar\n")
+	builder.WriteString("                throttled_before = limiter.throttled\n")
+	builder.WriteString("            hits_before, misses_before = cache_stats['hits'], cache_stats['misses']\n")
 	builder.WriteString("            \n")
 	builder.WriteString("            # Process records asynchronously\n")
 	builder.WriteString("            batch_size = min(100, sample_size)  # Process 100 records at a time\n")
@@ -299,18 +698,49 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("                # Define current batch\n")
 	builder.WriteString("                current_batch = all_items[i:min(i+batch_size, sample_size)]\n")
 	builder.WriteString("                batch_tasks = []\n")
+	builder.WriteString("                batch_indices = []\n")
 	builder.WriteString("                \n")
 	builder.WriteString("                # Create tasks for current batch\n")
-	builder.WriteString("                for item in current_batch:\n")
+	builder.WriteString("                for index, item in enumerate(current_batch, i):\n")
+	builder.WriteString("                    if index in restored:\n")
+	builder.WriteString("                        continue\n")
 	builder.WriteString("                    task = asyncio.create_task(process_item_async(\n")
 	builder.WriteString("                        item, source_field, target_field, model_name, \n")
-	builder.WriteString("                        temperature, max_tokens, prompt_template, semaphore, pbar\n")
+	builder.WriteString("                        temperature, max_tokens, prompt_template, semaphore, pbar, limiter\n")
 	builder.WriteString("                    ))\n")
 	builder.WriteString("                    batch_tasks.append(task)\n")
+	builder.WriteString("                    batch_indices.append(index)\n")
 	builder.WriteString("                \n")
 	builder.WriteString("                # Wait for current batch completion\n")
-	builder.WriteString("                batch_results = await asyncio.gather(*batch_tasks)\n")
-	builder.WriteString("                processed_items.extend(batch_results)\n")
+	builder.WriteString("                generated = dict(zip(batch_indices, await asyncio.gather(*batch_tasks)))\n")
+	builder.WriteString("                if checkpoint:\n")
+	builder.WriteString("                    save_checkpoint(checkpoint, generated, target_field)\n")
+	builder.WriteString("                \n")
+	builder.WriteString("                for index, item in enumerate(current_batch, i):\n")
+	builder.WriteString("                    if index in restored:\n")
+	builder.WriteString("                        item_dict, error = {**item, target_field: restored[index]}, None\n")
+	builder.WriteString("                    else:\n")
+	builder.WriteString("                        item_dict, error = generated[index]\n")
+	builder.WriteString("                    if error_column:\n")
+	builder.WriteString("                        item_dict['__syn_error'] = error\n")
+	builder.WriteString("                    if error is None:\n")
+	builder.WriteString("                        processed_items.append(item_dict)\n")
+	builder.WriteString("                        continue\n")
+	builder.WriteString("                    failed_count += 1\n")
+	builder.WriteString("                    if failures is not None:\n")
+	builder.WriteString("                        failed = {k: v for k, v in item_dict.items() if k not in (target_field, '__syn_error')}\n")
+	builder.WriteString("                        failures.append({**failed, '__syn_field': target_field, '__syn_error': error})\n")
+	builder.WriteString("                    if on_error == 'fail' and not shutdown:\n")
+	builder.WriteString("                        pbar.close()\n")
+	builder.WriteString("                        print(f'❌ Generation of field {target_field} failed: {error}')\n")
+	builder.WriteString("                        print('🛑 Stopping the script (ON_ERROR FAIL)')\n")
+	builder.WriteString("                        # The dataset is not saved, so the failed records go to output/ to be generated again later\n")
+	builder.WriteString("                        if failures:\n")
+	builder.WriteString("                            timestamp = time.strftime('%Y%m%d_%H%M%S')\n")
+	builder.WriteString("                            write_generation_errors(failures, os.path.join('output', f'failed_generations_{timestamp}.errors.jsonl'))\n")
+	builder.WriteString("                        sys.exit(1)\n")
+	builder.WriteString("                    if on_error == 'keep':\n")
+	builder.WriteString("                        processed_items.append(item_dict)\n")
 	builder.WriteString("                \n")
 	builder.WriteString("                # If stop signal received, stop processing but save what we processed\n")
 	builder.WriteString("                if shutdown:\n")
@@ -318,12 +748,24 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("                    break\n")
 	builder.WriteString("            \n")
 	builder.WriteString("            pbar.close()\n")
+	builder.WriteString("            if checkpoint and not shutdown:\n")
+	builder.WriteString("                checkpoints[checkpoint.name] = True\n")
+	builder.WriteString("            if limiter:\n")
+	builder.WriteString("                limiter.pbar = None\n")
+	builder.WriteString("                if limiter.throttled > throttled_before:\n")
+	builder.WriteString("                    print(f'⏳ {limiter.throttled - throttled_before} requests waited for the RPM/TPM limits')\n")
+	builder.WriteString("            hits, misses = cache_stats['hits'] - hits_before, cache_stats['misses'] - misses_before\n")
+	builder.WriteString("            if hits or misses:\n")
+	builder.WriteString("                print(f'💾 Response cache: {hits} hits, {misses} misses')\n")
 	builder.WriteString("            \n")
 	builder.WriteString("            # Create new dataset with results\n")
 	builder.WriteString("            print('✅ Generation completed!')\n")
 	builder.WriteString("            \n")
 	builder.WriteString("            # Check if all records were processed\n")
-	builder.WriteString("            if len(processed_items) < sample_size:\n")
+	builder.WriteString("            if failed_count:\n")
+	builder.WriteString("                kept = 'kept with an empty field' if on_error == 'keep' else 'skipped'\n")
+	builder.WriteString("                print(f'⚠️ Generation failed for {failed_count} of {sample_size} records, {kept}')\n")
+	builder.WriteString("            elif len(processed_items) < sample_size:\n")
 	builder.WriteString("                print(f'ℹ️ Processed {len(processed_items)} out of {sample_size} records (stopped by user)')\n")
 	builder.WriteString("            \n")
 	builder.WriteString("            # Create dataset from processed records\n")
@@ -335,11 +777,25 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("                print(f'💾 Saving {len(processed_items)} processed records...')\n")
 	builder.WriteString("                return Dataset.from_list(processed_items)\n")
 	builder.WriteString("            # Return original dataset in case of error\n")
-	builder.WriteString("            return dataset\n\n")
+	builder.WriteString("            return dataset\n")
+	builder.WriteString("        finally:\n")
+	builder.WriteString("            if checkpoint:\n")
+	builder.WriteString("                checkpoint.close()\n\n")
 
 	// Function for generating content (synchronous version)
 	builder.WriteString("    # Function for generating content (synchronous version)\n")
-	builder.WriteString("    def generate_content(dataset, source_field, target_field, model_name=None, temperature=0.7, max_tokens=1024, prompt_template=None):\n")
+	builder.WriteString("    def generate_content(dataset, source_field, target_field, model_name=None, temperature=0.7, max_tokens=1024, prompt_template=None, on_error='keep', error_column=False, dataset_name=None, checkpoint_step=None):\n")
+	builder.WriteString("        # DatasetDict: generate for every split and keep the splits, each with its own checkpoint\n")
+	builder.WriteString("        if isinstance(dataset, dict):\n")
+	builder.WriteString("            return type(dataset)({\n")
+	builder.WriteString("                split: generate_content(split_dataset, source_field, target_field, model_name, temperature, max_tokens, prompt_template, on_error, error_column, dataset_name,\n")
+	builder.WriteString("                                        f'{checkpoint_step}_{split}' if checkpoint_step else None)\n")
+	builder.WriteString("                for split, split_dataset in dataset.items()\n")
+	builder.WriteString("            })\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        # Failed generations are kept by dataset, to be written next to the file it is saved to\n")
+	builder.WriteString("        failures = generation_errors.setdefault(dataset_name or current_dataset, [])\n")
+	builder.WriteString("        \n")
 	builder.WriteString("        # Start asynchronous version through event loop\n")
 	builder.WriteString("        loop = asyncio.new_event_loop()\n")
 	builder.WriteString("        asyncio.set_event_loop(loop)\n")
@@ -355,7 +811,7 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("                loop.add_signal_handler(signal.SIGINT, handle_loop_signal)\n")
 	builder.WriteString("            \n")
 	builder.WriteString("            return loop.run_until_complete(generate_content_async(\n")
-	builder.WriteString("                dataset, source_field, target_field, model_name, temperature, max_tokens, prompt_template\n")
+	builder.WriteString("                dataset, source_field, target_field, model_name, temperature, max_tokens, prompt_template, on_error, error_column, failures, checkpoint_step\n")
 	builder.WriteString("            ))\n")
 	builder.WriteString("        except (KeyboardInterrupt, asyncio.CancelledError):\n")
 	builder.WriteString("            print('\\n🛑 Обработка прервана пользователем.')\n")
@@ -379,33 +835,267 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("            # Закрываем loop\n")
 	builder.WriteString("            loop.close()\n\n")
 
+	// Functions used by the compiled FILTER predicates
+	builder.WriteString("    # Token counter for the tokens attribute: tiktoken if it is installed, otherwise an estimate by words and punctuation\n")
+	builder.WriteString("    try:\n")
+	builder.WriteString("        import tiktoken\n")
+	builder.WriteString("        token_encoding = tiktoken.get_encoding('cl100k_base')\n")
+	builder.WriteString("        def count_tokens(text):\n")
+	builder.WriteString("            return len(token_encoding.encode(text))\n")
+	builder.WriteString("    except Exception:\n")
+	builder.WriteString("        def count_tokens(text):\n")
+	builder.WriteString("            return len(re.findall(r'\\w+|[^\\w\\s]', text))\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Computed attributes available as the last key of a field path, e.g. question.length\n")
+	builder.WriteString("    computed_attributes = {\n")
+	builder.WriteString("        'length': lambda value: len(value),\n")
+	builder.WriteString("        'words': lambda value: len(str(value).split()),\n")
+	builder.WriteString("        'tokens': lambda value: count_tokens(str(value)),\n")
+	builder.WriteString("        'lines': lambda value: len(str(value).splitlines()),\n")
+	builder.WriteString("    }\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function for reading a field of a record by a path of keys and list indexes.\n")
+	builder.WriteString("    # A key applied to a list is read from every element. Returns None if the path does not exist.\n")
+	builder.WriteString("    def get_field(record, path):\n")
+	builder.WriteString("        value = record\n")
+	builder.WriteString("        for i, part in enumerate(path):\n")
+	builder.WriteString("            if value is None:\n")
+	builder.WriteString("                return None\n")
+	builder.WriteString("            if isinstance(part, int):\n")
+	builder.WriteString("                if not isinstance(value, (list, tuple)) or not -len(value) <= part < len(value):\n")
+	builder.WriteString("                    return None\n")
+	builder.WriteString("                value = value[part]\n")
+	builder.WriteString("            elif isinstance(value, dict) and part in value:\n")
+	builder.WriteString("                value = value[part]\n")
+	builder.WriteString("            elif i > 0 and i == len(path) - 1 and part in computed_attributes:\n")
+	builder.WriteString("                try:\n")
+	builder.WriteString("                    return computed_attributes[part](value)\n")
+	builder.WriteString("                except TypeError:\n")
+	builder.WriteString("                    return None\n")
+	builder.WriteString("            elif isinstance(value, (list, tuple)):\n")
+	builder.WriteString("                value = [get_field(element, [part]) for element in value]\n")
+	builder.WriteString("            else:\n")
+	builder.WriteString("                return None\n")
+	builder.WriteString("        return value\n\n")
+
+	builder.WriteString("    # Operators of FILTER conditions\n")
+	builder.WriteString("    comparison_operators = {\n")
+	builder.WriteString("        '==': operator.eq, '!=': operator.ne, '>': operator.gt, '>=': operator.ge, '<': operator.lt, '<=': operator.le,\n")
+	builder.WriteString("        'contains': lambda left, right: right in left,\n")
+	builder.WriteString("        'startswith': lambda left, right: isinstance(left, str) and left.startswith(right),\n")
+	builder.WriteString("        'endswith': lambda left, right: isinstance(left, str) and left.endswith(right),\n")
+	builder.WriteString("        'in': lambda left, right: left in right,\n")
+	builder.WriteString("    }\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function for case-insensitive comparison of strings, also inside lists\n")
+	builder.WriteString("    def fold_case(value):\n")
+	builder.WriteString("        if isinstance(value, str):\n")
+	builder.WriteString("            return value.casefold()\n")
+	builder.WriteString("        if isinstance(value, (list, tuple)):\n")
+	builder.WriteString("            return [fold_case(item) for item in value]\n")
+	builder.WriteString("        return value\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function for comparing a field with a value in FILTER; missing values and values of incompatible types never match\n")
+	builder.WriteString("    def compare_values(left, op, right, ignore_case=False, negate=False):\n")
+	builder.WriteString("        if left is None:\n")
+	builder.WriteString("            return False\n")
+	builder.WriteString("        try:\n")
+	builder.WriteString("            if op == 'matches':\n")
+	builder.WriteString("                result = isinstance(left, str) and re.search(right, left, re.IGNORECASE if ignore_case else 0) is not None\n")
+	builder.WriteString("            elif ignore_case:\n")
+	builder.WriteString("                result = comparison_operators[op](fold_case(left), fold_case(right))\n")
+	builder.WriteString("            else:\n")
+	builder.WriteString("                result = comparison_operators[op](left, right)\n")
+	builder.WriteString("        except TypeError:\n")
+	builder.WriteString("            return False\n")
+	builder.WriteString("        return result != negate\n\n")
+
+	builder.WriteString("    # Function for converting a value to the type of CAST; values that cannot be converted become None\n")
+	builder.WriteString("    def cast_value(value, type_name):\n")
+	builder.WriteString("        if value is None:\n")
+	builder.WriteString("            return None\n")
+	builder.WriteString("        try:\n")
+	builder.WriteString("            if type_name == 'int':\n")
+	builder.WriteString("                if isinstance(value, str):\n")
+	builder.WriteString("                    value = value.strip()\n")
+	builder.WriteString("                    try:\n")
+	builder.WriteString("                        return int(value)\n")
+	builder.WriteString("                    except ValueError:\n")
+	builder.WriteString("                        value = float(value)\n")
+	builder.WriteString("                return int(value)\n")
+	builder.WriteString("            if type_name == 'float':\n")
+	builder.WriteString("                return float(value)\n")
+	builder.WriteString("            if type_name == 'bool':\n")
+	builder.WriteString("                if isinstance(value, str):\n")
+	builder.WriteString("                    return {'true': True, 'yes': True, '1': True, 'false': False, 'no': False, '0': False, '': False}.get(value.strip().lower())\n")
+	builder.WriteString("                return bool(value)\n")
+	builder.WriteString("            if isinstance(value, (dict, list)):\n")
+	builder.WriteString("                return json.dumps(value, ensure_ascii=False)\n")
+	builder.WriteString("            return str(value)\n")
+	builder.WriteString("        except (TypeError, ValueError, OverflowError):\n")
+	builder.WriteString("            return None\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Functions of SET expressions\n")
+	builder.WriteString("    value_functions = {\n")
+	builder.WriteString("        'length': computed_attributes['length'],\n")
+	builder.WriteString("        'words': computed_attributes['words'],\n")
+	builder.WriteString("        'tokens': computed_attributes['tokens'],\n")
+	builder.WriteString("        'lines': computed_attributes['lines'],\n")
+	builder.WriteString("        'lower': lambda value: value.lower(),\n")
+	builder.WriteString("        'upper': lambda value: value.upper(),\n")
+	builder.WriteString("        'strip': lambda value: value.strip(),\n")
+	builder.WriteString("        'replace': lambda value, old, new: value.replace(old, new),\n")
+	builder.WriteString("        'join': lambda values, separator=' ': separator.join(cast_value(v, 'string') for v in values if v is not None),\n")
+	builder.WriteString("        'round': round,\n")
+	builder.WriteString("        'abs': abs,\n")
+	builder.WriteString("        'int': lambda value: cast_value(value, 'int'),\n")
+	builder.WriteString("        'float': lambda value: cast_value(value, 'float'),\n")
+	builder.WriteString("        'string': lambda value: cast_value(value, 'string'),\n")
+	builder.WriteString("        'bool': lambda value: cast_value(value, 'bool'),\n")
+	builder.WriteString("        'coalesce': lambda *values: next((v for v in values if v is not None), None),\n")
+	builder.WriteString("    }\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function for calling a function of a SET expression. A missing argument or an argument of the wrong type\n")
+	builder.WriteString("    # gives None, except for coalesce, which returns its first argument that is not None\n")
+	builder.WriteString("    def call_function(name, *args):\n")
+	builder.WriteString("        if name != 'coalesce' and any(arg is None for arg in args):\n")
+	builder.WriteString("            return None\n")
+	builder.WriteString("        try:\n")
+	builder.WriteString("            return value_functions[name](*args)\n")
+	builder.WriteString("        except (TypeError, ValueError, AttributeError):\n")
+	builder.WriteString("            return None\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Function for +, -, * and / in SET expressions. Adding a string joins the values as text;\n")
+	builder.WriteString("    # a missing value, division by zero or values of incompatible types give None\n")
+	builder.WriteString("    def apply_operator(op, left, right):\n")
+	builder.WriteString("        if left is None or right is None:\n")
+	builder.WriteString("            return None\n")
+	builder.WriteString("        try:\n")
+	builder.WriteString("            if op == '+' and (isinstance(left, str) or isinstance(right, str)):\n")
+	builder.WriteString("                return cast_value(left, 'string') + cast_value(right, 'string')\n")
+	builder.WriteString("            if op == '+':\n")
+	builder.WriteString("                return left + right\n")
+	builder.WriteString("            if op == '-':\n")
+	builder.WriteString("                return left - right\n")
+	builder.WriteString("            if op == '*':\n")
+	builder.WriteString("                return left * right\n")
+	builder.WriteString("            return left / right\n")
+	builder.WriteString("        except (TypeError, ZeroDivisionError):\n")
+	builder.WriteString("            return None\n\n")
+
 	// Функции для работы с датасетами
-	builder.WriteString("    # Функция для загрузки датасета\n")
-	builder.WriteString("    def load_dataset_with_config(name, streaming=False, fields=None, filters=None):\n")
+	builder.WriteString("    # Форматы локальных файлов: загрузчик datasets и его параметры\n")
+	builder.WriteString("    file_formats = {\n")
+	builder.WriteString("        'json': ('json', {}), 'jsonl': ('json', {}), 'csv': ('csv', {}), 'tsv': ('csv', {'delimiter': '\\t'}),\n")
+	builder.WriteString("        'parquet': ('parquet', {}), 'arrow': ('arrow', {}), 'text': ('text', {}),\n")
+	builder.WriteString("    }\n")
+	builder.WriteString(fmt.Sprintf("    file_extensions = %s\n", pyStringMap(fileExtensions)))
+	builder.WriteString(fmt.Sprintf("    compression_extensions = %s\n", pyStringList(compressionExtensions)))
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для определения формата файла по расширению без учета сжатия\n")
+	builder.WriteString("    def detect_file_format(path):\n")
+	builder.WriteString("        path = path.lower()\n")
+	builder.WriteString("        for ext in compression_extensions:\n")
+	builder.WriteString("            if path.endswith(ext):\n")
+	builder.WriteString("                path = path[:-len(ext)]\n")
+	builder.WriteString("                break\n")
+	builder.WriteString("        return file_extensions.get(os.path.splitext(path)[1])\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для поиска файлов с данными: путь к файлу, шаблон вида data/*.jsonl или директория\n")
+	builder.WriteString("    def find_data_files(path, data_format=None):\n")
+	builder.WriteString("        path = os.path.expanduser(path)\n")
+	builder.WriteString("        if any(ch in path for ch in '*?['):\n")
+	builder.WriteString("            files = sorted(glob.glob(path))\n")
+	builder.WriteString("        elif os.path.isdir(path):\n")
+	builder.WriteString("            files = sorted(os.path.join(path, f) for f in os.listdir(path) if not f.startswith('.') and os.path.isfile(os.path.join(path, f)))\n")
+	builder.WriteString("            if data_format is None:\n")
+	builder.WriteString("                files = [f for f in files if detect_file_format(f)]\n")
+	builder.WriteString("        elif os.path.isfile(path):\n")
+	builder.WriteString("            files = [path]\n")
+	builder.WriteString("        else:\n")
+	builder.WriteString("            print(f'❌ Файл не найден: {path}')\n")
+	builder.WriteString("            sys.exit(1)\n")
+	builder.WriteString("        if not files:\n")
+	builder.WriteString("            print(f'❌ Нет файлов с данными: {path}')\n")
+	builder.WriteString("            sys.exit(1)\n")
+	builder.WriteString("        if data_format is None:\n")
+	builder.WriteString("            data_format = detect_file_format(files[0])\n")
+	builder.WriteString("            if data_format is None:\n")
+	builder.WriteString("                print(f'❌ Не удалось определить формат {path}; укажите его с помощью FORMAT')\n")
+	builder.WriteString("                sys.exit(1)\n")
+	builder.WriteString("            # Загрузчик читает файлы одного формата\n")
+	builder.WriteString("            files = [f for f in files if detect_file_format(f) == data_format]\n")
+	builder.WriteString("        return files, data_format\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для выбора сплитов из DatasetDict: один сплит дает Dataset, список сплитов - DatasetDict.\n")
+	builder.WriteString("    # Без SPLIT выбирается train или единственный сплит датасета\n")
+	builder.WriteString("    def select_splits(ds, split, name):\n")
+	builder.WriteString("        if split is None:\n")
+	builder.WriteString("            split = 'train' if 'train' in ds or len(ds) != 1 else next(iter(ds))\n")
+	builder.WriteString("        names = [split_key(s) for s in split] if isinstance(split, list) else [split]\n")
+	builder.WriteString("        missing = [s for s in names if s not in ds]\n")
+	builder.WriteString("        if missing:\n")
+	builder.WriteString("            print(f'❌ В датасете {name} нет сплита {\", \".join(missing)}; доступны: {\", \".join(ds)}')\n")
+	builder.WriteString("            sys.exit(1)\n")
+	builder.WriteString("        if debug:\n")
+	builder.WriteString("            print(f'Выбираем сплит {\", \".join(names)} для датасета')\n")
+	builder.WriteString("        if isinstance(split, list):\n")
+	builder.WriteString("            return type(ds)({s: ds[s] for s in names})\n")
+	builder.WriteString("        return ds[split]\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Имя сплита без среза: train[:10%] -> train\n")
+	builder.WriteString("    def split_key(split):\n")
+	builder.WriteString("        return split.split('[')[0]\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для загрузки датасета: с Hugging Face Hub (source='hub'), из локальных файлов (source='file')\n")
+	builder.WriteString("    # или из директории, сохраненной save_to_disk (source='disk')\n")
+	builder.WriteString("    def load_dataset_with_config(name, streaming=False, fields=None, filters=None, source='hub', data_format=None, config=None, split=None, revision=None):\n")
 	builder.WriteString("        if debug:\n")
 	builder.WriteString("            print(f'Загрузка датасета {name}...')\n")
 	builder.WriteString("        else:\n")
 	builder.WriteString("            print(f'Загрузка датасета {name}...')\n")
-	builder.WriteString("        ds = load_dataset(name, streaming=streaming)\n")
+	builder.WriteString("        if source == 'disk':\n")
+	builder.WriteString("            if not os.path.isdir(os.path.expanduser(name)):\n")
+	builder.WriteString("                print(f'❌ Директория не найдена: {name}')\n")
+	builder.WriteString("                sys.exit(1)\n")
+	builder.WriteString("            ds = load_from_disk(os.path.expanduser(name))\n")
+	builder.WriteString("            if split is not None and not isinstance(ds, dict):\n")
+	builder.WriteString("                print(f'⚠️ Датасет {name} сохранен без сплитов, SPLIT не применяется')\n")
+	builder.WriteString("        else:\n")
+	builder.WriteString("            if source == 'file':\n")
+	builder.WriteString("                data_files, data_format = find_data_files(name, data_format)\n")
+	builder.WriteString("                builder_name, options = file_formats[data_format]\n")
+	builder.WriteString("                load = lambda split_name: load_dataset(builder_name, data_files=data_files, split=split_name, streaming=streaming, **options)\n")
+	builder.WriteString("            else:\n")
+	builder.WriteString("                load = lambda split_name: load_dataset(name, config, split=split_name, revision=revision, streaming=streaming)\n")
+	builder.WriteString("            \n")
+	builder.WriteString("            # Несколько сплитов загружаются по отдельности (у каждого может быть свой срез) и собираются в DatasetDict\n")
+	builder.WriteString("            if isinstance(split, list):\n")
+	builder.WriteString("                splits = {split_key(s): load(s) for s in split}\n")
+	builder.WriteString("                ds = IterableDatasetDict(splits) if streaming else DatasetDict(splits)\n")
+	builder.WriteString("            else:\n")
+	builder.WriteString("                ds = load(split)\n")
 	builder.WriteString("        \n")
-	builder.WriteString("        # Выбираем сплит 'train', если это DatasetDict\n")
-	builder.WriteString("        if not streaming and isinstance(ds, dict):\n")
-	builder.WriteString("            if debug:\n")
-	builder.WriteString("                print(f'Выбираем сплит train для датасета')\n")
-	builder.WriteString("            ds = ds['train']\n")
+	builder.WriteString("        # Выбираем сплиты, если это DatasetDict или IterableDatasetDict\n")
+	builder.WriteString("        if isinstance(ds, dict):\n")
+	builder.WriteString("            ds = select_splits(ds, split, name)\n")
 	builder.WriteString("        \n")
-	builder.WriteString("        # Применение фильтров\n")
+	builder.WriteString("        # Датасет с диска загружается целиком; в потоковом режиме читаем его как IterableDataset\n")
+	builder.WriteString("        if source == 'disk' and streaming:\n")
+	builder.WriteString("            if isinstance(ds, dict):\n")
+	builder.WriteString("                ds = IterableDatasetDict({s: d.to_iterable_dataset() for s, d in ds.items()})\n")
+	builder.WriteString("            else:\n")
+	builder.WriteString("                ds = ds.to_iterable_dataset()\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        return select_records(ds, fields, filters)\n\n")
+
+	builder.WriteString("    # Функция для применения FILTER и FIELDS к датасету\n")
+	builder.WriteString("    def select_records(ds, fields=None, filters=None):\n")
+	builder.WriteString("        # Применение фильтров: запись остается, если выполнены все условия\n")
 	builder.WriteString("        if filters:\n")
 	builder.WriteString("            if debug:\n")
-	builder.WriteString("                print(f'Применение фильтров: {filters}')\n")
-	builder.WriteString("            if streaming:\n")
-	builder.WriteString("                ds = ds.filter(lambda x: all(x.get(k) is not None and eval(f\"x['{k}'] {v['op']} {v['value']}\") for k, v in filters.items()))\n")
-	builder.WriteString("            else:\n")
-	builder.WriteString("                for key, filter_info in filters.items():\n")
-	builder.WriteString("                    if '.' in key:\n")
-	builder.WriteString("                        print(f'Предупреждение: Вложенные фильтры пока не поддерживаются: {key}')\n")
-	builder.WriteString("                        continue\n")
-	builder.WriteString("                    ds = ds.filter(lambda x: key in x and eval(f\"x['{key}'] {filter_info['op']} {filter_info['value']}\"))\n")
+	builder.WriteString("                print(f'Применение фильтров: {len(filters)}')\n")
+	builder.WriteString("            ds = ds.filter(lambda x: all(predicate(x) for predicate in filters))\n")
 	builder.WriteString("        \n")
 	builder.WriteString("        # Выбор полей\n")
 	builder.WriteString("        if fields:\n")
@@ -415,11 +1105,413 @@ func (c *Compiler) Compile() string {
 	builder.WriteString("        \n")
 	builder.WriteString("        return ds\n\n")
 
+	builder.WriteString("    # Функция для объединения датасетов друг за другом. Столбцы сначала переименовываются по mapping, затем\n")
+	builder.WriteString("    # выравниваются: align='strict' требует одинаковых столбцов, 'intersection' оставляет общие столбцы,\n")
+	builder.WriteString("    # 'union' - все, пустые там, где их нет. source_column записывает имя датасета, из которого пришла запись\n")
+	builder.WriteString("    def merge_datasets(datasets_list, names, align='strict', mapping=None, source_column=None):\n")
+	builder.WriteString("        prepared, columns_by_name = [], {}\n")
+	builder.WriteString("        for ds, name in zip(datasets_list, names):\n")
+	builder.WriteString("            if isinstance(ds, dict):\n")
+	builder.WriteString("                print(f'❌ MERGE: датасет {name} из нескольких сплитов; выберите один с помощью SPLIT')\n")
+	builder.WriteString("                sys.exit(1)\n")
+	builder.WriteString("            columns = ds.column_names\n")
+	builder.WriteString("            if columns is None:\n")
+	builder.WriteString("                columns = list(next(iter(ds), {}))\n")
+	builder.WriteString("            \n")
+	builder.WriteString("            renames = {old: new for old, new in (mapping or {}).items() if old in columns}\n")
+	builder.WriteString("            renamed = [renames.get(column, column) for column in columns]\n")
+	builder.WriteString("            taken = sorted({column for column in renamed if renamed.count(column) > 1})\n")
+	builder.WriteString("            if taken:\n")
+	builder.WriteString("                print(f'❌ MERGE: после MAP в датасете {name} несколько столбцов {\", \".join(taken)}')\n")
+	builder.WriteString("                sys.exit(1)\n")
+	builder.WriteString("            if renames:\n")
+	builder.WriteString("                if debug:\n")
+	builder.WriteString("                    print(f'Переименование столбцов {name}: {renames}')\n")
+	builder.WriteString("                ds = ds.rename_columns(renames)\n")
+	builder.WriteString("                columns = renamed\n")
+	builder.WriteString("            \n")
+	builder.WriteString("            if source_column is not None and source_column in columns:\n")
+	builder.WriteString("                print(f'❌ MERGE: в датасете {name} уже есть столбец {source_column}; задайте другое имя в SOURCE')\n")
+	builder.WriteString("                sys.exit(1)\n")
+	builder.WriteString("            prepared.append(ds)\n")
+	builder.WriteString("            columns_by_name[name] = columns\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        all_columns = list(dict.fromkeys(c for columns in columns_by_name.values() for c in columns))\n")
+	builder.WriteString("        common = [c for c in all_columns if all(c in columns for columns in columns_by_name.values())]\n")
+	builder.WriteString("        if align == 'strict' and len(common) != len(all_columns):\n")
+	builder.WriteString("            print('❌ MERGE: у датасетов разные столбцы; выровняйте их с помощью ALIGN intersection или ALIGN union, либо MAP')\n")
+	builder.WriteString("            for name, columns in columns_by_name.items():\n")
+	builder.WriteString("                print(f'   {name}: нет {\", \".join(c for c in all_columns if c not in columns) or \"-\"}')\n")
+	builder.WriteString("            sys.exit(1)\n")
+	builder.WriteString("        if align == 'intersection' and not common:\n")
+	builder.WriteString("            print('❌ MERGE: у датасетов нет общих столбцов')\n")
+	builder.WriteString("            sys.exit(1)\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        target = common if align == 'intersection' else all_columns\n")
+	builder.WriteString("        for i, (ds, name) in enumerate(zip(prepared, names)):\n")
+	builder.WriteString("            missing = [c for c in target if c not in columns_by_name[name]]\n")
+	builder.WriteString("            if missing:\n")
+	builder.WriteString("                ds = ds.map(lambda x, missing=missing: {c: None for c in missing})\n")
+	builder.WriteString("            if source_column is not None:\n")
+	builder.WriteString("                ds = ds.map(lambda x, name=name: {source_column: name})\n")
+	builder.WriteString("            prepared[i] = ds.select_columns(target + ([source_column] if source_column is not None else []))\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        return concatenate_datasets(prepared)\n\n")
+
+	builder.WriteString("    # Функция для соединения двух датасетов по ключевым столбцам, как JOIN в SQL: how='inner' оставляет\n")
+	builder.WriteString("    # записи с парой в другом датасете, 'left' - все записи левого датасета, 'outer' - все записи обоих.\n")
+	builder.WriteString("    # Столбцы правого датасета, имена которых заняты левым, получают суффикс: question -> question_math\n")
+	builder.WriteString("    def join_datasets(left, right, keys, how='inner', left_name='left', right_name='right', suffix='right'):\n")
+	builder.WriteString("        if isinstance(left, dict) or isinstance(right, dict):\n")
+	builder.WriteString("            print(f'❌ JOIN {left_name}, {right_name}: датасет из нескольких сплитов; выберите один с помощью SPLIT')\n")
+	builder.WriteString("            sys.exit(1)\n")
+	builder.WriteString("        streaming = not isinstance(left, Dataset) or not isinstance(right, Dataset)\n")
+	builder.WriteString("        left_rows, right_rows = list(left), list(right)\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        # Столбцы датасета: из его описания и из самих записей, если описания нет\n")
+	builder.WriteString("        def columns_of(ds, rows):\n")
+	builder.WriteString("            columns = list(ds.column_names or [])\n")
+	builder.WriteString("            for row in rows:\n")
+	builder.WriteString("                columns.extend(k for k in row if k not in columns)\n")
+	builder.WriteString("            return columns\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        left_columns, right_columns = columns_of(left, left_rows), columns_of(right, right_rows)\n")
+	builder.WriteString("        for name, columns in ((left_name, left_columns), (right_name, right_columns)):\n")
+	builder.WriteString("            missing = [k for k in keys if k not in columns]\n")
+	builder.WriteString("            if missing:\n")
+	builder.WriteString("                print(f'❌ В датасете {name} нет столбца {\", \".join(missing)}; доступны: {\", \".join(columns)}')\n")
+	builder.WriteString("                sys.exit(1)\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        # Переименование столбцов правого датасета, совпадающих со столбцами левого;\n")
+	builder.WriteString("        # новое имя не должно совпадать ни с одним столбцом обоих датасетов, иначе значения затрут друг друга\n")
+	builder.WriteString("        renamed = {}\n")
+	builder.WriteString("        taken = set(left_columns) | set(right_columns)\n")
+	builder.WriteString("        for column in right_columns:\n")
+	builder.WriteString("            if column in keys:\n")
+	builder.WriteString("                continue\n")
+	builder.WriteString("            target = column\n")
+	builder.WriteString("            if column in left_columns:\n")
+	builder.WriteString("                target = f'{column}_{suffix}'\n")
+	builder.WriteString("                number = 2\n")
+	builder.WriteString("                while target in taken:\n")
+	builder.WriteString("                    target = f'{column}_{suffix}_{number}'\n")
+	builder.WriteString("                    number += 1\n")
+	builder.WriteString("                taken.add(target)\n")
+	builder.WriteString("            renamed[column] = target\n")
+	builder.WriteString("        conflicts = [f'{column} -> {target}' for column, target in renamed.items() if column != target]\n")
+	builder.WriteString("        if conflicts:\n")
+	builder.WriteString("            print(f'⚠️ Столбцы {right_name} переименованы, чтобы не совпадать со столбцами {left_name}: {\", \".join(conflicts)}')\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        # Ключ записи; записи с пустым значением ключа ни с чем не совпадают\n")
+	builder.WriteString("        def key_of(row):\n")
+	builder.WriteString("            values = [row.get(k) for k in keys]\n")
+	builder.WriteString("            if any(v is None for v in values):\n")
+	builder.WriteString("                return None\n")
+	builder.WriteString("            return json.dumps(values, sort_keys=True, ensure_ascii=False, default=str)\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        index = {}\n")
+	builder.WriteString("        for i, row in enumerate(right_rows):\n")
+	builder.WriteString("            key = key_of(row)\n")
+	builder.WriteString("            if key is not None:\n")
+	builder.WriteString("                index.setdefault(key, []).append(i)\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        columns = left_columns + list(renamed.values())\n")
+	builder.WriteString("        empty_right = {target: None for target in renamed.values()}\n")
+	builder.WriteString("        rows, matched = [], set()\n")
+	builder.WriteString("        for row in left_rows:\n")
+	builder.WriteString("            key = key_of(row)\n")
+	builder.WriteString("            matches = index.get(key, []) if key is not None else []\n")
+	builder.WriteString("            for i in matches:\n")
+	builder.WriteString("                joined = dict(row)\n")
+	builder.WriteString("                joined.update({renamed[c]: v for c, v in right_rows[i].items() if c in renamed})\n")
+	builder.WriteString("                rows.append(joined)\n")
+	builder.WriteString("                matched.add(i)\n")
+	builder.WriteString("            if not matches and how in ('left', 'outer'):\n")
+	builder.WriteString("                rows.append({**row, **empty_right})\n")
+	builder.WriteString("        if how == 'outer':\n")
+	builder.WriteString("            for i, row in enumerate(right_rows):\n")
+	builder.WriteString("                if i not in matched:\n")
+	builder.WriteString("                    joined = {column: None for column in left_columns}\n")
+	builder.WriteString("                    joined.update({k: row.get(k) for k in keys})\n")
+	builder.WriteString("                    joined.update({renamed[c]: v for c, v in row.items() if c in renamed})\n")
+	builder.WriteString("                    rows.append(joined)\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        print(f'Соединение {left_name} и {right_name} по {\", \".join(keys)} ({how}): {len(rows)} записей')\n")
+	builder.WriteString("        ds = Dataset.from_dict({column: [row.get(column) for row in rows] for column in columns})\n")
+	builder.WriteString("        # В потоковом режиме результат тоже читается как IterableDataset\n")
+	builder.WriteString("        return ds.to_iterable_dataset() if streaming else ds\n\n")
+
+	builder.WriteString("    # Функция для получения столбцов датасета; у DatasetDict берутся столбцы первого сплита\n")
+	builder.WriteString("    def dataset_columns(ds):\n")
+	builder.WriteString("        if isinstance(ds, dict):\n")
+	builder.WriteString("            ds = next(iter(ds.values()))\n")
+	builder.WriteString("        columns = ds.column_names\n")
+	builder.WriteString("        if columns is None:\n")
+	builder.WriteString("            columns = list(next(iter(ds), {}))\n")
+	builder.WriteString("        return columns\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для проверки, что в датасете есть столбцы, с которыми работает оператор\n")
+	builder.WriteString("    def require_columns(ds, columns, statement):\n")
+	builder.WriteString("        available = dataset_columns(ds)\n")
+	builder.WriteString("        missing = [c for c in columns if c not in available]\n")
+	builder.WriteString("        if missing:\n")
+	builder.WriteString("            print(f'❌ {statement}: в датасете нет столбца {\", \".join(missing)}; доступны: {\", \".join(available)}')\n")
+	builder.WriteString("            sys.exit(1)\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для переименования столбца (RENAME)\n")
+	builder.WriteString("    def rename_column(ds, old, new):\n")
+	builder.WriteString("        require_columns(ds, [old], 'RENAME')\n")
+	builder.WriteString("        if new in dataset_columns(ds):\n")
+	builder.WriteString("            print(f'❌ RENAME: в датасете уже есть столбец {new}')\n")
+	builder.WriteString("            sys.exit(1)\n")
+	builder.WriteString("        return ds.rename_column(old, new)\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для удаления столбцов (DROP); столбцы, которых нет в датасете, пропускаются\n")
+	builder.WriteString("    def drop_columns(ds, columns):\n")
+	builder.WriteString("        available = dataset_columns(ds)\n")
+	builder.WriteString("        missing = [c for c in columns if c not in available]\n")
+	builder.WriteString("        if missing:\n")
+	builder.WriteString("            print(f'⚠️ DROP: в датасете нет столбца {\", \".join(missing)}')\n")
+	builder.WriteString("        columns = [c for c in columns if c in available]\n")
+	builder.WriteString("        return ds.remove_columns(columns) if columns else ds\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для преобразования типа столбца (CAST); значения, которые не удалось преобразовать, становятся пустыми\n")
+	builder.WriteString("    def cast_column(ds, column, type_name, dtype):\n")
+	builder.WriteString("        require_columns(ds, [column], 'CAST')\n")
+	builder.WriteString("        ds = ds.map(lambda x: {column: cast_value(x[column], type_name)})\n")
+	builder.WriteString("        # Тип закрепляется, если он известен: столбец из одних пустых значений иначе не имел бы типа\n")
+	builder.WriteString("        features = (next(iter(ds.values())) if isinstance(ds, dict) else ds).features\n")
+	builder.WriteString("        if features is not None:\n")
+	builder.WriteString("            ds = ds.cast_column(column, datasets.Value(dtype))\n")
+	builder.WriteString("        return ds\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для вычисления столбца по каждой записи (SET); существующий столбец заменяется\n")
+	builder.WriteString("    def set_column(ds, column, compute):\n")
+	builder.WriteString("        return ds.map(lambda x: {column: compute(x)})\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для применения операции к каждому сплиту DatasetDict или IterableDatasetDict\n")
+	builder.WriteString("    def per_split(ds, apply):\n")
+	builder.WriteString("        if isinstance(ds, dict):\n")
+	builder.WriteString("            return type(ds)({split: apply(d) for split, d in ds.items()})\n")
+	builder.WriteString("        return apply(ds)\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для выбора первых записей (LIMIT)\n")
+	builder.WriteString("    def limit_records(ds, count):\n")
+	builder.WriteString("        def limit(d):\n")
+	builder.WriteString("            if isinstance(d, Dataset):\n")
+	builder.WriteString("                return d.select(range(min(count, len(d))))\n")
+	builder.WriteString("            return d.take(count)\n")
+	builder.WriteString("        return per_split(ds, limit)\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Размер буфера для перемешивания в потоковом режиме: записи перемешиваются в окне этого размера\n")
+	builder.WriteString("    shuffle_buffer_size = 10000\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для перемешивания записей (SHUFFLE)\n")
+	builder.WriteString("    def shuffle_records(ds, seed=None):\n")
+	builder.WriteString("        def shuffle(d):\n")
+	builder.WriteString("            if isinstance(d, Dataset):\n")
+	builder.WriteString("                return d.shuffle(seed=seed)\n")
+	builder.WriteString("            return d.shuffle(seed=seed, buffer_size=shuffle_buffer_size)\n")
+	builder.WriteString("        return per_split(ds, shuffle)\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для случайной выборки записей (SAMPLE): size - число записей или доля от 0 до 1\n")
+	builder.WriteString("    def sample_records(ds, size, seed=None):\n")
+	builder.WriteString("        def sample(d):\n")
+	builder.WriteString("            if isinstance(d, Dataset):\n")
+	builder.WriteString("                count = size if isinstance(size, int) else round(len(d) * size)\n")
+	builder.WriteString("                indices = random.Random(seed).sample(range(len(d)), min(count, len(d)))\n")
+	builder.WriteString("                # Записи выборки остаются в исходном порядке\n")
+	builder.WriteString("                return d.select(sorted(indices))\n")
+	builder.WriteString("            if isinstance(size, int):\n")
+	builder.WriteString("                # Размер потока неизвестен: берем первые записи после перемешивания в буфере\n")
+	builder.WriteString("                return d.shuffle(seed=seed, buffer_size=shuffle_buffer_size).take(size)\n")
+	builder.WriteString("            # Долю потока отбираем по каждой записи отдельно; решение зависит только от seed и номера записи\n")
+	builder.WriteString("            base = seed if seed is not None else random.randrange(2 ** 32)\n")
+	builder.WriteString("            return d.filter(lambda x, i: random.Random(f'{base}:{i}').random() < size, with_indices=True)\n")
+	builder.WriteString("        return per_split(ds, sample)\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для сортировки записей (SORT BY); keys - список (имя поля, путь к полю, по убыванию)\n")
+	builder.WriteString("    def sort_records(ds, keys):\n")
+	builder.WriteString("        def sort(d):\n")
+	builder.WriteString("            streaming = not isinstance(d, Dataset)\n")
+	builder.WriteString("            if streaming:\n")
+	builder.WriteString("                print('⚠️ SORT BY: потоковый датасет для сортировки читается в память целиком')\n")
+	builder.WriteString("                d = Dataset.from_list(list(d))\n")
+	builder.WriteString("            order = list(range(len(d)))\n")
+	builder.WriteString("            # Устойчивая сортировка с последнего ключа сохраняет порядок по предыдущим; пустые значения идут последними\n")
+	builder.WriteString("            for name, path, descending in reversed(keys):\n")
+	builder.WriteString("                values = [get_field({path[0]: v}, path) for v in d[path[0]]]\n")
+	builder.WriteString("                present = [i for i in order if values[i] is not None]\n")
+	builder.WriteString("                missing = [i for i in order if values[i] is None]\n")
+	builder.WriteString("                try:\n")
+	builder.WriteString("                    present.sort(key=lambda i: values[i], reverse=descending)\n")
+	builder.WriteString("                except TypeError as e:\n")
+	builder.WriteString("                    print(f'❌ SORT BY: значения поля {name} нельзя сравнить между собой: {e}')\n")
+	builder.WriteString("                    sys.exit(1)\n")
+	builder.WriteString("                order = present + missing\n")
+	builder.WriteString("            d = d.select(order)\n")
+	builder.WriteString("            return d.to_iterable_dataset() if streaming else d\n")
+	builder.WriteString("        require_columns(ds, [path[0] for _, path, _ in keys], 'SORT BY')\n")
+	builder.WriteString("        return per_split(ds, sort)\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для нормализации значения перед сравнением в DEDUP: регистр, пробелы, знаки препинания.\n")
+	builder.WriteString("    # Значения, которые не являются строками, сравниваются по их записи в JSON\n")
+	builder.WriteString("    def normalize_text(value, normalize=()):\n")
+	builder.WriteString("        if value is None:\n")
+	builder.WriteString("            return None\n")
+	builder.WriteString("        if not isinstance(value, str):\n")
+	builder.WriteString("            return json.dumps(value, ensure_ascii=False, sort_keys=True, default=str)\n")
+	builder.WriteString("        if 'case' in normalize:\n")
+	builder.WriteString("            value = value.casefold()\n")
+	builder.WriteString("        if 'punctuation' in normalize:\n")
+	builder.WriteString("            value = ''.join(ch for ch in value if not unicodedata.category(ch).startswith('P'))\n")
+	builder.WriteString("        if 'whitespace' in normalize:\n")
+	builder.WriteString("            value = ' '.join(value.split())\n")
+	builder.WriteString("        return value\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Число хеш-функций MinHash для поиска похожих записей (DEDUP ... FUZZY)\n")
+	builder.WriteString("    minhash_permutations = 128\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для выбора числа полос LSH: записи с похожестью выше порога (1/b)^(1/r) попадают в одну корзину\n")
+	builder.WriteString("    def lsh_bands(threshold):\n")
+	builder.WriteString("        options = [(b, minhash_permutations // b) for b in range(1, minhash_permutations + 1) if minhash_permutations % b == 0]\n")
+	builder.WriteString("        return min(options, key=lambda option: abs((1 / option[0]) ** (1 / option[1]) - threshold))\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для поиска похожих текстов по MinHash/LSH на 5-граммах символов.\n")
+	builder.WriteString("    # Возвращает номера текстов, похожих на один из предыдущих не меньше чем на threshold; None не сравнивается\n")
+	builder.WriteString("    def fuzzy_duplicates(texts, threshold):\n")
+	builder.WriteString("        prime = (1 << 31) - 1\n")
+	builder.WriteString("        rng = np.random.RandomState(1)\n")
+	builder.WriteString("        a = rng.randint(1, prime, minhash_permutations).astype(np.uint64)\n")
+	builder.WriteString("        b = rng.randint(0, prime, minhash_permutations).astype(np.uint64)\n")
+	builder.WriteString("        bands, rows = lsh_bands(threshold)\n")
+	builder.WriteString("        buckets = [{} for _ in range(bands)]\n")
+	builder.WriteString("        signatures, duplicates = {}, set()\n")
+	builder.WriteString("        for i, text in enumerate(texts):\n")
+	builder.WriteString("            if text is None:\n")
+	builder.WriteString("                continue\n")
+	builder.WriteString("            shingles = {text[j:j + 5] for j in range(max(1, len(text) - 4))}\n")
+	builder.WriteString("            hashes = np.array([zlib.crc32(s.encode('utf-8')) % prime for s in shingles], dtype=np.uint64)\n")
+	builder.WriteString("            signature = ((a[:, None] * hashes[None, :] + b[:, None]) % prime).min(axis=1)\n")
+	builder.WriteString("            keys = [signature[k * rows:(k + 1) * rows].tobytes() for k in range(bands)]\n")
+	builder.WriteString("            # Кандидаты из общих корзин проверяются по доле совпавших хешей, она оценивает сходство Жаккара\n")
+	builder.WriteString("            candidates = {j for k, key in enumerate(keys) for j in buckets[k].get(key, ())}\n")
+	builder.WriteString("            if any(np.mean(signatures[j] == signature) >= threshold for j in candidates):\n")
+	builder.WriteString("                duplicates.add(i)\n")
+	builder.WriteString("                continue\n")
+	builder.WriteString("            signatures[i] = signature\n")
+	builder.WriteString("            for k, key in enumerate(keys):\n")
+	builder.WriteString("                buckets[k].setdefault(key, []).append(i)\n")
+	builder.WriteString("        return duplicates\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для удаления дубликатов (DEDUP BY): остается первая запись, удаленные можно записать в removed_file.\n")
+	builder.WriteString("    # Записи, у которых все поля пустые, не считаются дубликатами\n")
+	builder.WriteString("    def dedup_records(ds, keys, normalize=(), threshold=None, removed_file=None, removed_options=None):\n")
+	builder.WriteString("        require_columns(ds, [path[0] for _, path in keys], 'DEDUP BY')\n")
+	builder.WriteString("        names = ', '.join(name for name, _ in keys)\n")
+	builder.WriteString("        splits = ds if isinstance(ds, dict) else {None: ds}\n")
+	builder.WriteString("        kept, removed = {}, {}\n")
+	builder.WriteString("        for split, d in splits.items():\n")
+	builder.WriteString("            streaming = not isinstance(d, Dataset)\n")
+	builder.WriteString("            if streaming:\n")
+	builder.WriteString("                print('⚠️ DEDUP: потоковый датасет для поиска дубликатов читается в память целиком')\n")
+	builder.WriteString("                d = Dataset.from_list(list(d))\n")
+	builder.WriteString("            records = d.select_columns(sorted({path[0] for _, path in keys}))\n")
+	builder.WriteString("            values = [[normalize_text(get_field(record, path), normalize) for _, path in keys] for record in records]\n")
+	builder.WriteString("            if threshold is None:\n")
+	builder.WriteString("                seen, duplicates = set(), set()\n")
+	builder.WriteString("                for i, key in enumerate(map(tuple, values)):\n")
+	builder.WriteString("                    if all(v is None for v in key):\n")
+	builder.WriteString("                        continue\n")
+	builder.WriteString("                    if key in seen:\n")
+	builder.WriteString("                        duplicates.add(i)\n")
+	builder.WriteString("                    seen.add(key)\n")
+	builder.WriteString("            else:\n")
+	builder.WriteString("                texts = [None if all(v is None for v in key) else '\\n'.join(v or '' for v in key) for key in values]\n")
+	builder.WriteString("                duplicates = fuzzy_duplicates(texts, threshold)\n")
+	builder.WriteString("            where = f' в сплите {split}' if split is not None else ''\n")
+	builder.WriteString("            print(f'🧹 DEDUP BY {names}{where}: удалено {len(duplicates)} из {len(d)} записей')\n")
+	builder.WriteString("            removed[split] = d.select(sorted(duplicates))\n")
+	builder.WriteString("            d = d.select([i for i in range(len(d)) if i not in duplicates])\n")
+	builder.WriteString("            kept[split] = d.to_iterable_dataset() if streaming else d\n")
+	builder.WriteString("        if removed_file is not None:\n")
+	builder.WriteString("            paths = write_dataset(DatasetDict(removed) if isinstance(ds, dict) else removed[None], removed_file, **removed_options)\n")
+	builder.WriteString("            print(f'💾 Удаленные дубликаты записаны в {\", \".join(paths)}')\n")
+	builder.WriteString("        return type(ds)(kept) if isinstance(ds, dict) else kept[None]\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для ключа группы AGGREGATE: списки и словари сравниваются по их записи в JSON\n")
+	builder.WriteString("    def group_key(value):\n")
+	builder.WriteString("        if isinstance(value, (list, dict)):\n")
+	builder.WriteString("            return json.dumps(value, ensure_ascii=False, sort_keys=True, default=str)\n")
+	builder.WriteString("        return value\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функции AGGREGATE над непустыми значениями столбца в группе; если значений нет, результат пустой\n")
+	builder.WriteString("    aggregate_functions = {\n")
+	builder.WriteString("        'count': len,\n")
+	builder.WriteString("        'sum': lambda values: sum(values) if values else None,\n")
+	builder.WriteString("        'avg': lambda values: sum(values) / len(values) if values else None,\n")
+	builder.WriteString("        'min': lambda values: min(values) if values else None,\n")
+	builder.WriteString("        'max': lambda values: max(values) if values else None,\n")
+	builder.WriteString("        'median': lambda values: statistics.median(values) if values else None,\n")
+	builder.WriteString("        'distinct': lambda values: len({group_key(v) for v in values}),\n")
+	builder.WriteString("    }\n")
+	builder.WriteString("    \n")
+	builder.WriteString("    # Функция для подсчета статистик по группам записей (AGGREGATE); aggregates - список (столбец результата, функция, столбец).\n")
+	builder.WriteString("    # У count() столбца нет. Сплиты DatasetDict считаются вместе; результат печатается и возвращается как Dataset\n")
+	builder.WriteString("    def aggregate_dataset(ds, aggregates, by=(), title='AGGREGATE'):\n")
+	builder.WriteString("        value_columns = list(dict.fromkeys(column for _, _, column in aggregates if column is not None))\n")
+	builder.WriteString("        columns = list(dict.fromkeys(list(by) + value_columns))\n")
+	builder.WriteString("        require_columns(ds, columns, 'AGGREGATE')\n")
+	builder.WriteString("        groups = {}\n")
+	builder.WriteString("        if not by:\n")
+	builder.WriteString("            # Без BY вся таблица - одна группа, даже если записей нет\n")
+	builder.WriteString("            groups[()] = {'by': [], 'count': 0, 'values': {column: [] for column in value_columns}}\n")
+	builder.WriteString("        for d in (ds.values() if isinstance(ds, dict) else [ds]):\n")
+	builder.WriteString("            records = d.select_columns(columns) if columns and isinstance(d, Dataset) else d\n")
+	builder.WriteString("            for record in records:\n")
+	builder.WriteString("                values = [record.get(column) for column in by]\n")
+	builder.WriteString("                key = tuple(group_key(v) for v in values)\n")
+	builder.WriteString("                if key not in groups:\n")
+	builder.WriteString("                    groups[key] = {'by': values, 'count': 0, 'values': {column: [] for column in value_columns}}\n")
+	builder.WriteString("                group = groups[key]\n")
+	builder.WriteString("                group['count'] += 1\n")
+	builder.WriteString("                for column in value_columns:\n")
+	builder.WriteString("                    if record.get(column) is not None:\n")
+	builder.WriteString("                        group['values'][column].append(record.get(column))\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        # Группы идут по возрастанию значений BY, пустые значения последними\n")
+	builder.WriteString("        try:\n")
+	builder.WriteString("            order = sorted(groups, key=lambda key: [(v is None, v) for v in key])\n")
+	builder.WriteString("        except TypeError:\n")
+	builder.WriteString("            order = list(groups)\n")
+	builder.WriteString("        rows = []\n")
+	builder.WriteString("        for key in order:\n")
+	builder.WriteString("            group = groups[key]\n")
+	builder.WriteString("            row = dict(zip(by, group['by']))\n")
+	builder.WriteString("            for name, function, column in aggregates:\n")
+	builder.WriteString("                if column is None:\n")
+	builder.WriteString("                    row[name] = group['count']\n")
+	builder.WriteString("                    continue\n")
+	builder.WriteString("                try:\n")
+	builder.WriteString("                    row[name] = aggregate_functions[function](group['values'][column])\n")
+	builder.WriteString("                except TypeError as e:\n")
+	builder.WriteString("                    print(f'❌ AGGREGATE: {function}({column}) нельзя посчитать по значениям столбца: {e}')\n")
+	builder.WriteString("                    sys.exit(1)\n")
+	builder.WriteString("            rows.append(row)\n")
+	builder.WriteString("        \n")
+	builder.WriteString("        print(f'📊 {title}: число групп {len(rows)}')\n")
+	builder.WriteString("        print(pd.DataFrame(rows).to_string(index=False, max_rows=50))\n")
+	builder.WriteString("        return Dataset.from_list(rows)\n\n")
+
 	// Компиляция утверждений
 	for _, stmt := range c.program.Statements {
 		c.compileStatement(&builder, stmt, 1)
 	}
 
+	// Скрипт выполнен до конца: контрольные точки завершенных генераций больше не нужны
+	builder.WriteString("    # Скрипт выполнен до конца: удаляем контрольные точки завершенных генераций\n")
+	builder.WriteString("    remove_checkpoints()\n")
+
 	// Сохранение результатов, если не был использован оператор SAVE и только при прерывании сигналом
 	builder.WriteString("    # Если явное сохранение не было произведено, сохранение будет выполнено только при прерывании сигналом\n")
 	builder.WriteString("    # Автоматическое сохранение при SIGINT реализовано через signal_handler\n\n")
@@ -438,32 +1530,41 @@ func (c *Compiler) compileStatement(builder *strings.Builder, node Node, indent
 	switch n := node.(type) {
 	case *FromStatement:
 		// Генерируем уникальное имя для датасета
-		datasetVar := fmt.Sprintf("ds_%s", sanitizeVarName(n.Dataset))
+		datasetVar := fromVarName(n)
+		sourceVar, reopened := reopenedDataset(n, c.bindings)
+		if reopened && n.Alias == "" {
+			datasetVar = sourceVar
+		}
 		c.datasets[datasetVar] = true
+		c.bindings[datasetVar] = datasetVar
+		if n.Alias != "" {
+			c.bindings[n.Alias] = datasetVar
+		}
 
 		if c.debug {
-			builder.WriteString(fmt.Sprintf("%s# Загрузка датасета %s\n", indentStr, n.Dataset))
+			builder.WriteString(fmt.Sprintf("%s# Загрузка датасета %s\n", indentStr, pyComment(n.Dataset)))
 		} else {
-			builder.WriteString(fmt.Sprintf("%s# Загрузка датасета %s\n", indentStr, n.Dataset))
+			builder.WriteString(fmt.Sprintf("%s# Загрузка датасета %s\n", indentStr, pyComment(n.Dataset)))
 		}
 
 		// Объявляем переменные для этого датасета
 		builder.WriteString(fmt.Sprintf("%sfields_%s = []\n", indentStr, datasetVar))
-		builder.WriteString(fmt.Sprintf("%sfilters_%s = {}\n", indentStr, datasetVar))
+		builder.WriteString(fmt.Sprintf("%sfilters_%s = []\n", indentStr, datasetVar))
 
-		// Создаем три слайса для разных типов инструкций
+		// Создаем два слайса для разных типов инструкций
 		var setupInstructions []Node
-		var generateStatements []Node
-		var saveStatements []Node
+		var orderedStatements []Node
 
 		// Если есть блок, распределяем его инструкции по типам
 		if n.Block != nil {
 			for _, stmt := range n.Block.Statements {
 				switch stmt.(type) {
-				case *GenerateStatement:
-					generateStatements = append(generateStatements, stmt)
-				case *SaveStatement:
-					saveStatements = append(saveStatements, stmt)
+				case *GenerateStatement, *RenameStatement, *DropStatement, *CastStatement, *SetStatement,
+					*LimitStatement, *SampleStatement, *ShuffleStatement, *SortStatement, *DedupStatement, *AggregateStatement,
+					*SaveStatement:
+					// Генерация, операции с датасетом и сохранение выполняются в порядке записи,
+					// так что SAVE записывает датасет таким, каким он был в этом месте блока
+					orderedStatements = append(orderedStatements, stmt)
 				default:
 					setupInstructions = append(setupInstructions, stmt)
 				}
@@ -476,32 +1577,50 @@ func (c *Compiler) compileStatement(builder *strings.Builder, node Node, indent
 		}
 
 		// 2. Затем загружаем датасет с настроенными параметрами
-		builder.WriteString(fmt.Sprintf("%s# Загружаем датасет с настроенными параметрами\n", indentStr))
-		builder.WriteString(fmt.Sprintf("%s%s = load_dataset_with_config('%s', streaming=stream, fields=fields_%s, filters=filters_%s)\n",
-			indentStr, datasetVar, n.Dataset, datasetVar, datasetVar))
+		if reopened {
+			// Датасет уже определен в скрипте: применяем к нему FILTER и FIELDS блока
+			builder.WriteString(fmt.Sprintf("%s# Продолжаем работу с датасетом %s\n", indentStr, sourceVar))
+			builder.WriteString(fmt.Sprintf("%s%s = select_records(%s, fields=fields_%s, filters=filters_%s)\n",
+				indentStr, datasetVar, sourceVar, datasetVar, datasetVar))
+			builder.WriteString(fmt.Sprintf("%scarry_generation_errors('%s', ['%s'])\n", indentStr, datasetVar, sourceVar))
+		} else {
+			builder.WriteString(fmt.Sprintf("%s# Загружаем датасет с настроенными параметрами\n", indentStr))
+			builder.WriteString(fmt.Sprintf("%s%s = load_dataset_with_config(%s, streaming=stream, fields=fields_%s, filters=filters_%s%s)\n",
+				indentStr, datasetVar, pyString(n.Dataset), datasetVar, datasetVar, loadOptions(n)))
+		}
 		builder.WriteString(fmt.Sprintf("%sloaded_datasets['%s'] = %s\n", indentStr, datasetVar, datasetVar))
+		builder.WriteString(fmt.Sprintf("%scurrent_dataset = '%s'\n", indentStr, datasetVar))
 
-		// 3. После загрузки датасета компилируем инструкции генерации
-		if len(generateStatements) > 0 {
-			builder.WriteString(fmt.Sprintf("%s# Генерация новых полей в датасете\n", indentStr))
-			for _, stmt := range generateStatements {
-				c.compileBlockStatement(builder, stmt, indent, datasetVar)
+		// Инструкции после блока работают с этим датасетом
+		c.current = datasetVar
+
+		// 3. После загрузки датасета компилируем генерацию, операции с датасетом и сохранение в порядке записи
+		heading := "Генерация новых полей в датасете"
+		for _, stmt := range orderedStatements {
+			if isDatasetOperation(stmt) {
+				heading = "Генерация новых полей и обработка датасета"
+				break
 			}
 		}
-
-		// 4. И в конце инструкции сохранения
-		if len(saveStatements) > 0 {
-			builder.WriteString(fmt.Sprintf("%s# Сохранение результатов\n", indentStr))
-			for _, stmt := range saveStatements {
-				c.compileBlockStatement(builder, stmt, indent, datasetVar)
+		section := ""
+		for _, stmt := range orderedStatements {
+			// Заголовок пишется в начале каждой группы генерации и обработки или сохранения
+			stmtSection := heading
+			if _, ok := stmt.(*SaveStatement); ok {
+				stmtSection = "Сохранение результатов"
+			}
+			if stmtSection != section {
+				builder.WriteString(fmt.Sprintf("%s# %s\n", indentStr, stmtSection))
+				section = stmtSection
 			}
+			c.compileBlockStatement(builder, stmt, indent, datasetVar)
 		}
 
 	case *WithStatement:
 		if n.Type == "CONCURRENCY" {
-			builder.WriteString(fmt.Sprintf("%sconcurrency = %v\n", indentStr, n.Value))
+			builder.WriteString(fmt.Sprintf("%sconcurrency = %s\n", indentStr, formatPythonValue(n.Value)))
 		} else if n.Type == "STREAM" {
-			builder.WriteString(fmt.Sprintf("%sstream = True\n", indentStr))
+			builder.WriteString(fmt.Sprintf("%sstream = %s\n", indentStr, formatPythonValue(n.Value)))
 		}
 
 		// Если это WithStatement вне блока FROM, обрабатываем его блок как обычные утверждения
@@ -512,7 +1631,9 @@ func (c *Compiler) compileStatement(builder *strings.Builder, node Node, indent
 		}
 
 	case *PragmaStatement:
-		if n.Type == "AUTOSAVE" {
+		if n.Type == "AUTOSAVE" && n.Value.Value == false {
+			builder.WriteString(fmt.Sprintf("%s# Директива PRAGMA AUTOSAVE false: автосохранение при SIGINT выключено\n", indentStr))
+		} else if n.Type == "AUTOSAVE" {
 			// Обработка PRAGMA AUTOSAVE
 			c.enableSigIntHandler = true
 			builder.WriteString(fmt.Sprintf("%s# Директива PRAGMA AUTOSAVE: включаем автосохранение при SIGINT\n", indentStr))
@@ -521,12 +1642,12 @@ func (c *Compiler) compileStatement(builder *strings.Builder, node Node, indent
 			builder.WriteString(fmt.Sprintf("%ssignal.signal(signal.SIGINT, signal_handler)\n", indentStr))
 		} else if n.Type == "CONCURRENCY" {
 			// Обработка PRAGMA CONCURRENCY
-			concurrencyValue, ok := n.Value.(int)
-			if !ok {
-				concurrencyValue = 4 // Значение по умолчанию, если что-то пошло не так
-			}
 			builder.WriteString(fmt.Sprintf("%s# Директива PRAGMA CONCURRENCY: устанавливаем глобальную конкурентность\n", indentStr))
-			builder.WriteString(fmt.Sprintf("%sconcurrency = %d\n", indentStr, concurrencyValue))
+			builder.WriteString(fmt.Sprintf("%sconcurrency = %s\n", indentStr, formatPythonValue(n.Value)))
+		} else if n.Type == "CACHE" {
+			// Обработка PRAGMA CACHE
+			builder.WriteString(fmt.Sprintf("%s# Директива PRAGMA CACHE: сохраняем ответы модели в кэш\n", indentStr))
+			builder.WriteString(fmt.Sprintf("%scache_path = %s\n", indentStr, formatPythonValue(n.Value)))
 		}
 
 	case *FieldsStatement:
@@ -534,38 +1655,15 @@ func (c *Compiler) compileStatement(builder *strings.Builder, node Node, indent
 		builder.WriteString(fmt.Sprintf("%sfields = %s\n", indentStr, formatPythonList(n.Fields)))
 
 	case *UsingStatement:
-		if n.Type == "MODEL" {
-			builder.WriteString(fmt.Sprintf("%smodel = '%s'\n", indentStr, n.Value))
-		} else if n.Type == "KEY" {
-			builder.WriteString(fmt.Sprintf("%sapi_key = '%s'\n", indentStr, n.Value))
-		} else if n.Type == "URL" {
-			builder.WriteString(fmt.Sprintf("%sapi_url = '%s'\n", indentStr, n.Value))
-		}
+		compileUsing(builder, n, indentStr)
 
 	case *UsingBlock:
-		for _, stmt := range n.Statements {
-			if stmt.Type == "MODEL" {
-				builder.WriteString(fmt.Sprintf("%smodel = '%s'\n", indentStr, stmt.Value))
-			} else if stmt.Type == "KEY" {
-				builder.WriteString(fmt.Sprintf("%sapi_key = '%s'\n", indentStr, stmt.Value))
-			} else if stmt.Type == "URL" {
-				builder.WriteString(fmt.Sprintf("%sapi_url = '%s'\n", indentStr, stmt.Value))
-			}
+		for i := range n.Statements {
+			compileUsing(builder, &n.Statements[i], indentStr)
 		}
 
-	case *FilterStatement:
-		pythonOp := convertOperatorToPython(n.Operator)
-		valueStr := formatPythonValue(n.Value)
-		builder.WriteString(fmt.Sprintf("%sfilters['%s'] = {'op': '%s', 'value': %s}\n",
-			indentStr, n.Field, pythonOp, valueStr))
-
-	case *FilterBlock:
-		for _, condition := range n.Conditions {
-			pythonOp := convertOperatorToPython(condition.Operator)
-			valueStr := formatPythonValue(condition.Value)
-			builder.WriteString(fmt.Sprintf("%sfilters['%s.%s'] = {'op': '%s', 'value': %s}\n",
-				indentStr, n.Field, condition.Field, pythonOp, valueStr))
-		}
+	case *FilterStatement, *FilterBlock:
+		c.compileFilter(builder, node, indentStr, "filters")
 
 	case *Block:
 		for _, stmt := range n.Statements {
@@ -574,92 +1672,127 @@ func (c *Compiler) compileStatement(builder *strings.Builder, node Node, indent
 
 	case *DatasetMergeStatement:
 		// Создаем новый объединенный датасет
-		mergedVar := fmt.Sprintf("merged_ds_%d", len(c.datasets)+1)
+		mergedVar := mergedVarName(n, len(c.datasets))
 		c.datasets[mergedVar] = true
 
 		builder.WriteString(fmt.Sprintf("%s# Объединение датасетов\n", indentStr))
-		builder.WriteString(fmt.Sprintf("%s%s = concatenate_datasets([", indentStr, mergedVar))
+		builder.WriteString(fmt.Sprintf("%s%s = merge_datasets([", indentStr, mergedVar))
 
 		for i, dsName := range n.Datasets {
-			dsVar := fmt.Sprintf("ds_%s", sanitizeVarName(dsName))
-			builder.WriteString(dsVar)
+			builder.WriteString(c.datasetVar(dsName))
 			if i < len(n.Datasets)-1 {
 				builder.WriteString(", ")
 			}
 		}
 
-		builder.WriteString("])\n")
+		builder.WriteString(fmt.Sprintf("], %s, %s)\n", pyStringList(n.Datasets), mergeOptions(n)))
+		sourceVars := make([]string, len(n.Datasets))
+		for i, dsName := range n.Datasets {
+			sourceVars[i] = c.datasetVar(dsName)
+		}
+		builder.WriteString(fmt.Sprintf("%scarry_generation_errors('%s', %s)\n", indentStr, mergedVar, pyStringList(sourceVars)))
 
 		// Сохраняем датасет в словарь
 		builder.WriteString(fmt.Sprintf("%sloaded_datasets['%s'] = %s\n", indentStr, mergedVar, mergedVar))
+		builder.WriteString(fmt.Sprintf("%scurrent_dataset = '%s'\n", indentStr, mergedVar))
+		c.bindings[mergedVar] = mergedVar
+		if n.Alias != "" {
+			c.bindings[n.Alias] = mergedVar
+		}
+		c.current = mergedVar
 
-	case *SaveStatement:
-		builder.WriteString(fmt.Sprintf("%s# Сохранение в файл\n", indentStr))
-		builder.WriteString(fmt.Sprintf("%soutput_file = '%s'\n", indentStr, n.Filename))
-		builder.WriteString(fmt.Sprintf("%swas_saved = True\n", indentStr))
+	case *DatasetJoinStatement:
+		// Создаем новый датасет из соединенных записей
+		joinedVar := joinedVarName(n, len(c.datasets))
+		c.datasets[joinedVar] = true
 
-		// Используем общую функцию для сохранения результатов
-		builder.WriteString(fmt.Sprintf("%s# Сохраняем датасет\n", indentStr))
-		builder.WriteString(fmt.Sprintf("%ssave_current_results()\n", indentStr))
+		builder.WriteString(fmt.Sprintf("%s# Соединение датасетов %s и %s по %s (%s)\n", indentStr,
+			pyComment(n.Left), pyComment(n.Right), pyComment(strings.Join(n.Keys, ", ")), n.Mode))
+		builder.WriteString(fmt.Sprintf("%s%s = join_datasets(%s, %s, %s, how=%s, left_name=%s, right_name=%s, suffix=%s)\n",
+			indentStr, joinedVar, c.datasetVar(n.Left), c.datasetVar(n.Right), pyStringList(n.Keys), pyString(n.Mode),
+			pyString(n.Left), pyString(n.Right), pyString(joinSuffix(n.Right))))
+		builder.WriteString(fmt.Sprintf("%scarry_generation_errors('%s', %s)\n", indentStr, joinedVar,
+			pyStringList([]string{c.datasetVar(n.Left), c.datasetVar(n.Right)})))
+
+		// Сохраняем датасет в словарь
+		builder.WriteString(fmt.Sprintf("%sloaded_datasets['%s'] = %s\n", indentStr, joinedVar, joinedVar))
+		builder.WriteString(fmt.Sprintf("%scurrent_dataset = '%s'\n", indentStr, joinedVar))
+		c.bindings[joinedVar] = joinedVar
+		if n.Alias != "" {
+			c.bindings[n.Alias] = joinedVar
+		}
+		c.current = joinedVar
+
+	case *RenameStatement, *DropStatement, *CastStatement, *SetStatement,
+		*LimitStatement, *SampleStatement, *ShuffleStatement, *SortStatement, *DedupStatement:
+		c.compileDatasetOperation(builder, node, indentStr, c.current)
+
+	case *AggregateStatement:
+		c.compileAggregate(builder, n, indentStr, c.current)
+
+	case *SaveStatement:
+		c.compileSave(builder, n, indentStr, c.current)
 
 	case *PromptStatement:
-		builder.WriteString(fmt.Sprintf("%s# Определение шаблона промпта %s\n", indentStr, n.Name))
+		builder.WriteString(fmt.Sprintf("%s# Определение шаблона промпта %s\n", indentStr, pyComment(n.Name)))
 
 		// Определяем список полей для замены в шаблоне
 		fieldsStr := "[]"
 		if len(n.Fields) > 0 {
-			fieldsStr = fmt.Sprintf("[%s]", strings.Join(formatPythonStringList(n.Fields), ", "))
+			fieldsStr = pyStringList(n.Fields)
 		}
 
 		// В зависимости от типа промпта сохраняем его в соответствующий словарь
 		if n.PromptType == "system" {
 			// Для системного промпта сохраняем только текст
-			builder.WriteString(fmt.Sprintf("%ssystem_prompts['%s'] = '%s'\n", indentStr, n.Name, n.Template))
+			builder.WriteString(fmt.Sprintf("%ssystem_prompts[%s] = %s\n", indentStr, pyString(n.Name), pyString(n.Template)))
 
 			if c.debug {
 				builder.WriteString(fmt.Sprintf("%sif debug:\n", indentStr))
-				builder.WriteString(fmt.Sprintf("%s    print(f'Определен системный промпт: %s')\n", indentStr, n.Name))
+				builder.WriteString(fmt.Sprintf("%s    print('Определен системный промпт:', %s)\n", indentStr, pyString(n.Name)))
 			}
 		} else {
 			// Для пользовательского промпта сохраняем шаблон в словарь
-			builder.WriteString(fmt.Sprintf("%sprompt_templates['%s'] = {\n", indentStr, n.Name))
-			builder.WriteString(fmt.Sprintf("%s    'template': '%s',\n", indentStr, n.Template))
+			builder.WriteString(fmt.Sprintf("%sprompt_templates[%s] = {\n", indentStr, pyString(n.Name)))
+			builder.WriteString(fmt.Sprintf("%s    'template': %s,\n", indentStr, pyString(n.Template)))
 			builder.WriteString(fmt.Sprintf("%s    'fields': %s\n", indentStr, fieldsStr))
 			builder.WriteString(fmt.Sprintf("%s}\n", indentStr))
 
 			if c.debug {
 				builder.WriteString(fmt.Sprintf("%sif debug:\n", indentStr))
-				builder.WriteString(fmt.Sprintf("%s    print(f'Определен шаблон промпта: %s')\n", indentStr, n.Name))
+				builder.WriteString(fmt.Sprintf("%s    print('Определен шаблон промпта:', %s)\n", indentStr, pyString(n.Name)))
 			}
 		}
 
 	case *GenerateStatement:
-		builder.WriteString(fmt.Sprintf("%s# Генерация поля %s на основе %s\n", indentStr, n.TargetField, n.SourceField))
+		builder.WriteString(fmt.Sprintf("%s# Генерация поля %s на основе %s\n", indentStr, pyComment(n.TargetField), pyComment(n.SourceField)))
 
 		// Если не указана модель явно, используем глобальную
 		modelStr := "None"
 		if n.Model != "" {
-			modelStr = fmt.Sprintf("'%s'", n.Model)
+			modelStr = pyString(n.Model)
 		}
 
 		// Определяем промпт, если он указан
 		promptStr := "None"
 		if len(n.PromptTemplates) > 0 {
-			promptStr = fmt.Sprintf("'%s'", n.PromptTemplates[0])
+			promptStr = pyString(n.PromptTemplates[0])
 		}
 
-		// Получаем последний добавленный датасет
-		builder.WriteString(fmt.Sprintf("%s# Выбираем последний загруженный датасет\n", indentStr))
-		builder.WriteString(fmt.Sprintf("%slast_dataset_name = list(loaded_datasets.keys())[-1]\n", indentStr))
-		builder.WriteString(fmt.Sprintf("%slast_dataset = loaded_datasets[last_dataset_name]\n", indentStr))
+		// Вне блока FROM генерация работает с текущим датасетом
+		datasetVar := c.current
+		if datasetVar == "" {
+			return
+		}
 
 		// Генерируем контент с асинхронной обработкой
 		builder.WriteString(fmt.Sprintf("%s# Запускаем асинхронную генерацию контента\n", indentStr))
-		builder.WriteString(fmt.Sprintf("%slast_dataset = generate_content(last_dataset, '%s', '%s', %s, %.1f, %d, %s)\n",
-			indentStr, n.SourceField, n.TargetField, modelStr, n.Temperature, n.Tokens, promptStr))
+		builder.WriteString(fmt.Sprintf("%s%s = generate_content(%s, %s, %s, %s, %s, %d, %s, %s)\n",
+			indentStr, datasetVar, datasetVar, pyString(n.SourceField), pyString(n.TargetField), modelStr, pyFloat(n.Temperature), n.Tokens, promptStr,
+			c.generateOptions(n, datasetVar)))
 
 		// Обновляем датасет в словаре
-		builder.WriteString(fmt.Sprintf("%sloaded_datasets[last_dataset_name] = last_dataset\n", indentStr))
+		builder.WriteString(fmt.Sprintf("%sloaded_datasets['%s'] = %s\n", indentStr, datasetVar, datasetVar))
 	}
 }
 
@@ -671,46 +1804,23 @@ func (c *Compiler) compileBlockStatement(builder *strings.Builder, node Node, in
 	case *FieldsStatement:
 		builder.WriteString(fmt.Sprintf("%sfields_%s = %s\n", indentStr, datasetVar, formatPythonList(n.Fields)))
 
-	case *FilterStatement:
-		pythonOp := convertOperatorToPython(n.Operator)
-		valueStr := formatPythonValue(n.Value)
-		builder.WriteString(fmt.Sprintf("%sfilters_%s['%s'] = {'op': '%s', 'value': %s}\n",
-			indentStr, datasetVar, n.Field, pythonOp, valueStr))
-
-	case *FilterBlock:
-		for _, condition := range n.Conditions {
-			pythonOp := convertOperatorToPython(condition.Operator)
-			valueStr := formatPythonValue(condition.Value)
-			builder.WriteString(fmt.Sprintf("%sfilters_%s['%s.%s'] = {'op': '%s', 'value': %s}\n",
-				indentStr, datasetVar, n.Field, condition.Field, pythonOp, valueStr))
-		}
+	case *FilterStatement, *FilterBlock:
+		c.compileFilter(builder, node, indentStr, "filters_"+datasetVar)
 
 	case *UsingStatement:
-		if n.Type == "MODEL" {
-			builder.WriteString(fmt.Sprintf("%smodel = '%s'\n", indentStr, n.Value))
-		} else if n.Type == "KEY" {
-			builder.WriteString(fmt.Sprintf("%sapi_key = '%s'\n", indentStr, n.Value))
-		} else if n.Type == "URL" {
-			builder.WriteString(fmt.Sprintf("%sapi_url = '%s'\n", indentStr, n.Value))
-		}
+		compileUsing(builder, n, indentStr)
 
 	case *UsingBlock:
-		for _, stmt := range n.Statements {
-			if stmt.Type == "MODEL" {
-				builder.WriteString(fmt.Sprintf("%smodel = '%s'\n", indentStr, stmt.Value))
-			} else if stmt.Type == "KEY" {
-				builder.WriteString(fmt.Sprintf("%sapi_key = '%s'\n", indentStr, stmt.Value))
-			} else if stmt.Type == "URL" {
-				builder.WriteString(fmt.Sprintf("%sapi_url = '%s'\n", indentStr, stmt.Value))
-			}
+		for i := range n.Statements {
+			compileUsing(builder, &n.Statements[i], indentStr)
 		}
 
 	case *WithStatement:
 		// Устанавливаем параметры WithStatement
 		if n.Type == "CONCURRENCY" {
-			builder.WriteString(fmt.Sprintf("%sconcurrency = %v\n", indentStr, n.Value))
+			builder.WriteString(fmt.Sprintf("%sconcurrency = %s\n", indentStr, formatPythonValue(n.Value)))
 		} else if n.Type == "STREAM" {
-			builder.WriteString(fmt.Sprintf("%sstream = True\n", indentStr))
+			builder.WriteString(fmt.Sprintf("%sstream = %s\n", indentStr, formatPythonValue(n.Value)))
 		}
 
 		// Если у WithStatement есть блок, обрабатываем его содержимое
@@ -742,72 +1852,435 @@ func (c *Compiler) compileBlockStatement(builder *strings.Builder, node Node, in
 		}
 
 	case *GenerateStatement:
-		builder.WriteString(fmt.Sprintf("%s# Генерация поля %s на основе %s\n", indentStr, n.TargetField, n.SourceField))
+		builder.WriteString(fmt.Sprintf("%s# Генерация поля %s на основе %s\n", indentStr, pyComment(n.TargetField), pyComment(n.SourceField)))
 
 		// Если не указана модель явно, используем глобальную
 		modelStr := "None"
 		if n.Model != "" {
-			modelStr = fmt.Sprintf("'%s'", n.Model)
+			modelStr = pyString(n.Model)
 		}
 
 		// Определяем промпт, если он указан
 		promptStr := "None"
 		if len(n.PromptTemplates) > 0 {
-			promptStr = fmt.Sprintf("'%s'", n.PromptTemplates[0])
+			promptStr = pyString(n.PromptTemplates[0])
 		}
 
 		// Генерируем контент с асинхронной обработкой
 		builder.WriteString(fmt.Sprintf("%s# Запускаем асинхронную генерацию контента\n", indentStr))
-		builder.WriteString(fmt.Sprintf("%s%s = generate_content(%s, '%s', '%s', %s, %.1f, %d, %s)\n",
-			indentStr, datasetVar, datasetVar, n.SourceField, n.TargetField, modelStr, n.Temperature, n.Tokens, promptStr))
+		builder.WriteString(fmt.Sprintf("%s%s = generate_content(%s, %s, %s, %s, %s, %d, %s, %s)\n",
+			indentStr, datasetVar, datasetVar, pyString(n.SourceField), pyString(n.TargetField), modelStr, pyFloat(n.Temperature), n.Tokens, promptStr,
+			c.generateOptions(n, datasetVar)))
 
 		// Обновляем датасет в словаре
 		builder.WriteString(fmt.Sprintf("%sloaded_datasets['%s'] = %s\n", indentStr, datasetVar, datasetVar))
 
+	case *RenameStatement, *DropStatement, *CastStatement, *SetStatement,
+		*LimitStatement, *SampleStatement, *ShuffleStatement, *SortStatement, *DedupStatement:
+		c.compileDatasetOperation(builder, node, indentStr, datasetVar)
+
+	case *AggregateStatement:
+		c.compileAggregate(builder, n, indentStr, datasetVar)
+
 	case *SaveStatement:
-		builder.WriteString(fmt.Sprintf("%s# Сохранение датасета в файл\n", indentStr))
-		builder.WriteString(fmt.Sprintf("%soutput_file = '%s'\n", indentStr, n.Filename))
-		builder.WriteString(fmt.Sprintf("%swas_saved = True\n", indentStr))
-		builder.WriteString(fmt.Sprintf("%ssave_current_results()\n", indentStr))
+		c.compileSave(builder, n, indentStr, datasetVar)
 
 	case *PromptStatement:
-		builder.WriteString(fmt.Sprintf("%s# Определение шаблона промпта %s\n", indentStr, n.Name))
+		builder.WriteString(fmt.Sprintf("%s# Определение шаблона промпта %s\n", indentStr, pyComment(n.Name)))
 
 		// Определяем список полей для замены в шаблоне
 		fieldsStr := "[]"
 		if len(n.Fields) > 0 {
-			fieldsStr = fmt.Sprintf("[%s]", strings.Join(formatPythonStringList(n.Fields), ", "))
+			fieldsStr = pyStringList(n.Fields)
 		}
 
 		// В зависимости от типа промпта сохраняем его в соответствующий словарь
 		if n.PromptType == "system" {
 			// Для системного промпта сохраняем только текст
-			builder.WriteString(fmt.Sprintf("%ssystem_prompts['%s'] = '%s'\n", indentStr, n.Name, n.Template))
+			builder.WriteString(fmt.Sprintf("%ssystem_prompts[%s] = %s\n", indentStr, pyString(n.Name), pyString(n.Template)))
 
 			if c.debug {
 				builder.WriteString(fmt.Sprintf("%sif debug:\n", indentStr))
-				builder.WriteString(fmt.Sprintf("%s    print(f'Определен системный промпт: %s')\n", indentStr, n.Name))
+				builder.WriteString(fmt.Sprintf("%s    print('Определен системный промпт:', %s)\n", indentStr, pyString(n.Name)))
 			}
 		} else {
 			// Для пользовательского промпта сохраняем шаблон в словарь
-			builder.WriteString(fmt.Sprintf("%sprompt_templates['%s'] = {\n", indentStr, n.Name))
-			builder.WriteString(fmt.Sprintf("%s    'template': '%s',\n", indentStr, n.Template))
+			builder.WriteString(fmt.Sprintf("%sprompt_templates[%s] = {\n", indentStr, pyString(n.Name)))
+			builder.WriteString(fmt.Sprintf("%s    'template': %s,\n", indentStr, pyString(n.Template)))
 			builder.WriteString(fmt.Sprintf("%s    'fields': %s\n", indentStr, fieldsStr))
 			builder.WriteString(fmt.Sprintf("%s}\n", indentStr))
 
 			if c.debug {
 				builder.WriteString(fmt.Sprintf("%sif debug:\n", indentStr))
-				builder.WriteString(fmt.Sprintf("%s    print(f'Определен шаблон промпта: %s')\n", indentStr, n.Name))
+				builder.WriteString(fmt.Sprintf("%s    print('Определен шаблон промпта:', %s)\n", indentStr, pyString(n.Name)))
 			}
 		}
 	}
 }
 
+// loadOptions returns the additional arguments of load_dataset_with_config for the source and options of a FROM statement
+func loadOptions(n *FromStatement) string {
+	var options strings.Builder
+	if n.Source != "" && n.Source != "hub" {
+		options.WriteString(", source=" + pyString(n.Source))
+	}
+	if n.Block == nil {
+		return options.String()
+	}
+	for _, stmt := range n.Block.Statements {
+		option, ok := stmt.(*LoadOptionStatement)
+		if !ok {
+			continue
+		}
+		switch option.Type {
+		case "FORMAT":
+			options.WriteString(", data_format=" + pyString(strings.ToLower(option.Values[0])))
+		case "CONFIG":
+			options.WriteString(", config=" + pyString(option.Values[0]))
+		case "REVISION":
+			options.WriteString(", revision=" + pyString(option.Values[0]))
+		case "SPLIT":
+			// Several splits are loaded as a DatasetDict, a single one as a Dataset
+			if len(option.Values) > 1 {
+				options.WriteString(", split=" + pyStringList(option.Values))
+			} else {
+				options.WriteString(", split=" + pyString(option.Values[0]))
+			}
+		}
+	}
+	return options.String()
+}
+
+// compileSave emits a SAVE statement. The dataset named with SAVE <dataset> TO is saved,
+// otherwise datasetVar, the dataset of the enclosing scope.
+func (c *Compiler) compileSave(builder *strings.Builder, n *SaveStatement, indentStr, datasetVar string) {
+	if n.Dataset != "" {
+		datasetVar = c.datasetVar(n.Dataset)
+	}
+
+	builder.WriteString(fmt.Sprintf("%s# Сохранение датасета %s в файл\n", indentStr, datasetVar))
+	builder.WriteString(fmt.Sprintf("%soutput_file = %s\n", indentStr, pyString(n.Filename)))
+	builder.WriteString(fmt.Sprintf("%soutput_options = %s\n", indentStr, saveOptions(n)))
+	builder.WriteString(fmt.Sprintf("%swas_saved = True\n", indentStr))
+	builder.WriteString(fmt.Sprintf("%ssave_current_results('%s')\n", indentStr, datasetVar))
+}
+
+// generateOptions returns the arguments of generate_content that handle failed generations and name the checkpoint of the step.
+// GENERATE statements are numbered in the order they are compiled, so a step keeps its checkpoint while the script is the same.
+func (c *Compiler) generateOptions(n *GenerateStatement, datasetVar string) string {
+	policy := n.OnError
+	if policy == "" {
+		policy = "keep"
+	}
+	c.generateSteps++
+	return fmt.Sprintf("on_error=%s, error_column=%s, dataset_name='%s', checkpoint_step='generate_%d'",
+		pyString(policy), pyBool(n.ErrorColumn), datasetVar, c.generateSteps)
+}
+
+// compileUsing emits a USING setting as the assignment of its global variable
+func compileUsing(builder *strings.Builder, n *UsingStatement, indentStr string) {
+	switch n.Type {
+	case "MODEL":
+		builder.WriteString(fmt.Sprintf("%smodel = %s\n", indentStr, pyString(n.Value)))
+	case "KEY":
+		builder.WriteString(fmt.Sprintf("%sapi_key = %s\n", indentStr, pyString(n.Value)))
+	case "URL":
+		builder.WriteString(fmt.Sprintf("%sapi_url = %s\n", indentStr, pyString(n.Value)))
+	case "RETRIES":
+		builder.WriteString(fmt.Sprintf("%smax_retries = %s\n", indentStr, formatPythonValue(n.Number)))
+	case "TIMEOUT":
+		builder.WriteString(fmt.Sprintf("%srequest_timeout = %s\n", indentStr, formatPythonValue(n.Number)))
+	case "RPM":
+		builder.WriteString(fmt.Sprintf("%srequests_per_minute = %s\n", indentStr, formatPythonValue(n.Number)))
+	case "TPM":
+		builder.WriteString(fmt.Sprintf("%stokens_per_minute = %s\n", indentStr, formatPythonValue(n.Number)))
+	}
+}
+
+// compileDatasetOperation emits a column or record operation applied to the dataset in datasetVar
+func (c *Compiler) compileDatasetOperation(builder *strings.Builder, node Node, indentStr, datasetVar string) {
+	switch n := node.(type) {
+	case *RenameStatement:
+		builder.WriteString(fmt.Sprintf("%s# Переименование столбца %s в %s\n", indentStr, pyComment(n.From), pyComment(n.To)))
+		builder.WriteString(fmt.Sprintf("%s%s = rename_column(%s, %s, %s)\n", indentStr, datasetVar, datasetVar, pyString(n.From), pyString(n.To)))
+	case *DropStatement:
+		builder.WriteString(fmt.Sprintf("%s# Удаление столбцов %s\n", indentStr, pyComment(strings.Join(n.Columns, ", "))))
+		builder.WriteString(fmt.Sprintf("%s%s = drop_columns(%s, %s)\n", indentStr, datasetVar, datasetVar, pyStringList(n.Columns)))
+	case *CastStatement:
+		builder.WriteString(fmt.Sprintf("%s# Преобразование столбца %s в %s\n", indentStr, pyComment(n.Column), pyComment(n.Type)))
+		builder.WriteString(fmt.Sprintf("%s%s = cast_column(%s, %s, %s, %s)\n", indentStr, datasetVar, datasetVar,
+			pyString(n.Column), pyString(n.Type), pyString(castTypes[n.Type])))
+	case *SetStatement:
+		builder.WriteString(fmt.Sprintf("%s# Столбец %s = %s\n", indentStr, pyComment(n.Column), pyComment(n.Value.String())))
+		builder.WriteString(fmt.Sprintf("%s%s = set_column(%s, %s, lambda x: %s)\n", indentStr, datasetVar, datasetVar,
+			pyString(n.Column), compileValueExpr(n.Value)))
+	case *LimitStatement:
+		builder.WriteString(fmt.Sprintf("%s# Первые %s записей\n", indentStr, n.Count))
+		builder.WriteString(fmt.Sprintf("%s%s = limit_records(%s, %s)\n", indentStr, datasetVar, datasetVar, formatPythonValue(n.Count)))
+	case *SampleStatement:
+		builder.WriteString(fmt.Sprintf("%s# Случайная выборка: %s\n", indentStr, sampleDescription(n.Size)))
+		builder.WriteString(fmt.Sprintf("%s%s = sample_records(%s, %s%s)\n", indentStr, datasetVar, datasetVar,
+			formatPythonValue(n.Size), seedArgument(n.Seed)))
+	case *ShuffleStatement:
+		builder.WriteString(fmt.Sprintf("%s# Перемешивание записей\n", indentStr))
+		builder.WriteString(fmt.Sprintf("%s%s = shuffle_records(%s%s)\n", indentStr, datasetVar, datasetVar, seedArgument(n.Seed)))
+	case *SortStatement:
+		keys := make([]string, len(n.Keys))
+		names := make([]string, len(n.Keys))
+		for i, key := range n.Keys {
+			keys[i] = fmt.Sprintf("(%s, %s, %s)", pyString(key.Field.String()), pyFieldPath(key.Field), pyBool(key.Descending))
+			names[i] = key.Field.String()
+			if key.Descending {
+				names[i] += " по убыванию"
+			}
+		}
+		builder.WriteString(fmt.Sprintf("%s# Сортировка по %s\n", indentStr, pyComment(strings.Join(names, ", "))))
+		builder.WriteString(fmt.Sprintf("%s%s = sort_records(%s, [%s])\n", indentStr, datasetVar, datasetVar, strings.Join(keys, ", ")))
+	case *DedupStatement:
+		keys := make([]string, len(n.Fields))
+		names := make([]string, len(n.Fields))
+		for i, field := range n.Fields {
+			keys[i] = fmt.Sprintf("(%s, %s)", pyString(field.String()), pyFieldPath(field))
+			names[i] = field.String()
+		}
+		args := []string{datasetVar, "[" + strings.Join(keys, ", ") + "]"}
+		if len(n.Normalize) > 0 {
+			args = append(args, "normalize="+pyStringList(n.Normalize))
+		}
+		if n.Threshold != nil {
+			args = append(args, "threshold="+formatPythonValue(n.Threshold))
+		}
+		if n.Removed != nil {
+			args = append(args, "removed_file="+pyString(n.Removed.Filename), "removed_options="+saveOptions(n.Removed))
+		}
+		builder.WriteString(fmt.Sprintf("%s# Удаление дубликатов по %s%s\n", indentStr, pyComment(strings.Join(names, ", ")), dedupDescription(n)))
+		builder.WriteString(fmt.Sprintf("%s%s = dedup_records(%s)\n", indentStr, datasetVar, strings.Join(args, ", ")))
+	}
+	builder.WriteString(fmt.Sprintf("%sloaded_datasets['%s'] = %s\n", indentStr, datasetVar, datasetVar))
+}
+
+// sampleDescription describes the size of a SAMPLE for a comment in the generated code
+func sampleDescription(size *Literal) string {
+	if size.Kind == LiteralFloat {
+		return fmt.Sprintf("доля %s записей", size)
+	}
+	return fmt.Sprintf("%s записей", size)
+}
+
+// compileAggregate emits AGGREGATE over the dataset in datasetVar; its results become a new dataset
+// if they have a name, while the aggregated dataset stays the current one
+func (c *Compiler) compileAggregate(builder *strings.Builder, n *AggregateStatement, indentStr, datasetVar string) {
+	aggregates := make([]string, len(n.Aggregates))
+	calls := make([]string, len(n.Aggregates))
+	for i, item := range n.Aggregates {
+		column := "None"
+		if len(item.Args) > 0 {
+			column = pyString(item.Args[0])
+		}
+		aggregates[i] = fmt.Sprintf("(%s, %s, %s)", pyString(item.Column()), pyString(item.Function), column)
+		calls[i] = item.String()
+	}
+	title := strings.Join(calls, ", ")
+	if len(n.By) > 0 {
+		title += " BY " + strings.Join(n.By, ", ")
+	}
+
+	builder.WriteString(fmt.Sprintf("%s# Статистика %s\n", indentStr, pyComment(title)))
+	call := fmt.Sprintf("aggregate_dataset(%s, [%s], by=%s, title=%s)", datasetVar, strings.Join(aggregates, ", "),
+		pyStringList(n.By), pyString(title))
+	if n.Into == "" {
+		builder.WriteString(indentStr + call + "\n")
+		return
+	}
+
+	aggregatedVar := datasetVarName(n.Into)
+	c.datasets[aggregatedVar] = true
+	c.bindings[aggregatedVar] = aggregatedVar
+	c.bindings[n.Into] = aggregatedVar
+	builder.WriteString(fmt.Sprintf("%s%s = %s\n", indentStr, aggregatedVar, call))
+	builder.WriteString(fmt.Sprintf("%sloaded_datasets['%s'] = %s\n", indentStr, aggregatedVar, aggregatedVar))
+}
+
+// dedupDescription describes how DEDUP compares records for a comment in the generated code
+func dedupDescription(n *DedupStatement) string {
+	var parts []string
+	if len(n.Normalize) > 0 {
+		parts = append(parts, "нормализация: "+strings.Join(n.Normalize, ", "))
+	}
+	if n.Threshold != nil {
+		parts = append(parts, "сходство не меньше "+n.Threshold.String())
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + pyComment(strings.Join(parts, "; ")) + ")"
+}
+
+// seedArgument returns the seed keyword argument of a random operation, if the seed is set
+func seedArgument(seed *Literal) string {
+	if seed == nil {
+		return ""
+	}
+	return ", seed=" + formatPythonValue(seed)
+}
+
+// compileValueExpr compiles a SET expression into a Python expression over the record x
+func compileValueExpr(expr ValueExpr) string {
+	switch e := expr.(type) {
+	case *Literal:
+		return formatPythonValue(e)
+	case *FieldRef:
+		return fmt.Sprintf("get_field(x, %s)", pyFieldPath(e.Field))
+	case *ArithmeticExpr:
+		return fmt.Sprintf("apply_operator(%s, %s, %s)", pyString(e.Operator), compileValueExpr(e.Left), compileValueExpr(e.Right))
+	case *CallExpr:
+		args := []string{pyString(e.Function)}
+		for _, arg := range e.Args {
+			args = append(args, compileValueExpr(arg))
+		}
+		return "call_function(" + strings.Join(args, ", ") + ")"
+	default:
+		return "None"
+	}
+}
+
+// datasetVar returns the Python variable of a dataset referred to by name in MERGE or SAVE
+func (c *Compiler) datasetVar(name string) string {
+	if variable, ok := c.bindings[name]; ok {
+		return variable
+	}
+	return sanitizeVarName(name)
+}
+
+// saveTarget returns the format and compression of the file written by SAVE, set in its block
+// or detected by the extensions of the file name. A name without an extension is an Arrow
+// directory written by save_to_disk.
+func saveTarget(n *SaveStatement) (format, compression string) {
+	name := strings.ToLower(n.Filename)
+	for codec, ext := range compressionCodecs {
+		if strings.HasSuffix(name, ext) {
+			compression = codec
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+
+	if ext := filepath.Ext(name); ext == "" {
+		format = "arrow"
+	} else {
+		format = fileExtensions[ext]
+	}
+
+	if n.Format != "" {
+		format = n.Format
+	}
+	if n.Compression != "" {
+		compression = n.Compression
+	}
+	return format, compression
+}
+
+// saveOptions returns the Python dict of options of the file written by SAVE
+func saveOptions(n *SaveStatement) string {
+	format, compression := saveTarget(n)
+	options := []string{"'data_format': " + pyString(format)}
+	if compression != "" {
+		options = append(options, "'compression': "+pyString(compression))
+	}
+	if n.ShardRows != nil {
+		options = append(options, "'shard_rows': "+formatPythonValue(n.ShardRows))
+	}
+	return "{" + strings.Join(options, ", ") + "}"
+}
+
+// compileFilter emits a FILTER statement or block as a predicate appended to the given list of filters
+func (c *Compiler) compileFilter(builder *strings.Builder, node Node, indentStr, filtersVar string) {
+	var source, predicate string
+
+	switch n := node.(type) {
+	case *FilterStatement:
+		source = n.Condition.String()
+		predicate = compileFilterExpr(n.Condition, nil)
+	case *FilterBlock:
+		if len(n.Conditions) == 0 {
+			return
+		}
+		conditions := make([]string, len(n.Conditions))
+		parts := make([]string, len(n.Conditions))
+		for i, condition := range n.Conditions {
+			conditions[i] = condition.String()
+			parts[i] = compileFilterExpr(condition, n.Field)
+		}
+		source = fmt.Sprintf("%s { %s }", n.Field, strings.Join(conditions, "; "))
+		predicate = strings.Join(parts, " and ")
+	}
+
+	builder.WriteString(fmt.Sprintf("%s# Фильтр: %s\n", indentStr, pyComment(source)))
+	builder.WriteString(fmt.Sprintf("%s%s.append(lambda x: %s)\n", indentStr, filtersVar, predicate))
+}
+
+// compileFilterExpr compiles a FILTER expression into a Python boolean expression over the record x.
+// Field paths are resolved relative to prefix, the field of a FILTER block.
+func compileFilterExpr(expr Expr, prefix FieldPath) string {
+	switch e := expr.(type) {
+	case *BinaryExpr:
+		operator := "and"
+		if e.Operator == "OR" {
+			operator = "or"
+		}
+		return fmt.Sprintf("(%s %s %s)", compileFilterExpr(e.Left, prefix), operator, compileFilterExpr(e.Right, prefix))
+	case *NotExpr:
+		return fmt.Sprintf("(not %s)", compileFilterExpr(e.Operand, prefix))
+	case *FieldExpr:
+		return fmt.Sprintf("bool(get_field(x, %s))", pyFieldPath(prefix.Join(e.Field)))
+	case *IsNullExpr:
+		if e.Negated {
+			return fmt.Sprintf("(get_field(x, %s) is not None)", pyFieldPath(prefix.Join(e.Field)))
+		}
+		return fmt.Sprintf("(get_field(x, %s) is None)", pyFieldPath(prefix.Join(e.Field)))
+	case *ComparisonExpr:
+		// Comparison with null checks for a missing value, like IS NULL
+		if e.Value.Kind == LiteralNull && (e.Operator == "=" || e.Operator == "==") {
+			return compileFilterExpr(&IsNullExpr{Field: e.Field}, prefix)
+		}
+		if e.Value.Kind == LiteralNull && e.Operator == "!=" {
+			return compileFilterExpr(&IsNullExpr{Field: e.Field, Negated: true}, prefix)
+		}
+
+		options := ""
+		if e.IgnoreCase {
+			options += ", ignore_case=True"
+		}
+		if e.Negated {
+			options += ", negate=True"
+		}
+		return fmt.Sprintf("compare_values(get_field(x, %s), %s, %s%s)",
+			pyFieldPath(prefix.Join(e.Field)), pyString(convertOperatorToPython(e.Operator)), formatPythonValue(e.Value), options)
+	default:
+		return "True"
+	}
+}
+
+// pyFieldPath encodes a field path as a Python list of keys and indexes
+func pyFieldPath(path FieldPath) string {
+	elements := make([]string, len(path))
+	for i, element := range path {
+		if element.Key == "" {
+			elements[i] = fmt.Sprintf("%d", element.Index)
+		} else {
+			elements[i] = pyString(element.Key)
+		}
+	}
+	return "[" + strings.Join(elements, ", ") + "]"
+}
+
 // convertOperatorToPython преобразует оператор из DSL в Python-оператор
 func convertOperatorToPython(op string) string {
 	switch op {
 	case "=":
 		return "=="
+	case "CONTAINS", "STARTSWITH", "ENDSWITH", "MATCHES", "IN":
+		return strings.ToLower(op)
 	default:
 		return op
 	}
@@ -815,18 +2288,33 @@ func convertOperatorToPython(op string) string {
 
 // formatPythonList форматирует список строк в Python-список
 func formatPythonList(items []string) string {
-	quotedItems := make([]string, len(items))
-	for i, item := range items {
-		quotedItems[i] = fmt.Sprintf("'%s'", item)
-	}
-	return fmt.Sprintf("[%s]", strings.Join(quotedItems, ", "))
+	return pyStringList(items)
 }
 
 // formatPythonValue форматирует значение для Python
 func formatPythonValue(value interface{}) string {
 	switch v := value.(type) {
 	case string:
-		return fmt.Sprintf("'%s'", v)
+		return pyString(v)
+	case bool:
+		return pyBool(v)
+	case float64:
+		return pyFloat(v)
+	case *Literal:
+		if v.Kind == LiteralNull {
+			return "None"
+		}
+		if v.Kind == LiteralList {
+			items := v.Value.([]*Literal)
+			values := make([]string, len(items))
+			for i, item := range items {
+				values[i] = formatPythonValue(item)
+			}
+			return "[" + strings.Join(values, ", ") + "]"
+		}
+		return formatPythonValue(v.Value)
+	case nil:
+		return "None"
 	default:
 		return fmt.Sprintf("%v", v)
 	}
@@ -834,16 +2322,84 @@ func formatPythonValue(value interface{}) string {
 
 // sanitizeVarName преобразует строку в допустимое имя переменной Python
 func sanitizeVarName(name string) string {
-	// Заменяем недопустимые символы на подчеркивание
-	re := strings.NewReplacer("/", "_", "-", "_", ".", "_")
-	return re.Replace(name)
+	// Заменяем все символы, кроме латинских букв, цифр и подчеркивания, на подчеркивание
+	sanitized := strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	// Имя не может начинаться с цифры или совпадать с ключевым словом Python
+	if !isPythonIdentifier(sanitized) {
+		sanitized = "_" + sanitized
+	}
+	return sanitized
+}
+
+// datasetVarName returns the name of the Python variable holding a dataset loaded by FROM
+func datasetVarName(dataset string) string {
+	return sanitizeVarName("ds_" + dataset)
+}
+
+// mergedVarName returns the name of the Python variable holding the result of a MERGE,
+// named after its alias or numbered after the count of datasets created before it
+func mergedVarName(n *DatasetMergeStatement, count int) string {
+	if n.Alias != "" {
+		return datasetVarName(n.Alias)
+	}
+	return fmt.Sprintf("merged_ds_%d", count+1)
+}
+
+// mergeOptions formats the ALIGN, MAP and SOURCE settings of a MERGE as keyword arguments of merge_datasets
+func mergeOptions(n *DatasetMergeStatement) string {
+	align := n.Align
+	if align == "" {
+		align = "strict"
+	}
+
+	mapping := make(map[string]string, len(n.Mappings))
+	for _, m := range n.Mappings {
+		mapping[m.From] = m.To
+	}
+
+	source := "None"
+	if n.SourceColumn != "" {
+		source = pyString(n.SourceColumn)
+	}
+
+	return fmt.Sprintf("align=%s, mapping=%s, source_column=%s", pyString(align), pyStringMap(mapping), source)
+}
+
+// joinedVarName returns the name of the Python variable holding the result of a JOIN,
+// named after its alias or numbered after the count of datasets created before it
+func joinedVarName(n *DatasetJoinStatement, count int) string {
+	if n.Alias != "" {
+		return datasetVarName(n.Alias)
+	}
+	return fmt.Sprintf("joined_ds_%d", count+1)
+}
+
+// joinSuffix returns the suffix added to the columns of the right dataset of a JOIN
+// whose names are taken by the left one: question -> question_math
+func joinSuffix(right string) string {
+	return strings.TrimPrefix(sanitizeVarName(right), "_")
+}
+
+// reopenedDataset reports whether a FROM statement refers to a dataset defined earlier in the script
+// by its name rather than loading a new one, and returns the variable of that dataset
+func reopenedDataset(n *FromStatement, bindings map[string]string) (string, bool) {
+	if n.Source != "hub" {
+		return "", false
+	}
+	variable, ok := bindings[n.Dataset]
+	return variable, ok
 }
 
-// formatPythonStringList форматирует список строк для Python
-func formatPythonStringList(items []string) []string {
-	quotedItems := make([]string, len(items))
-	for i, item := range items {
-		quotedItems[i] = fmt.Sprintf("'%s'", item)
+// fromVarName returns the name of the Python variable holding the dataset of a FROM statement,
+// named after its alias if it has one
+func fromVarName(n *FromStatement) string {
+	if n.Alias != "" {
+		return datasetVarName(n.Alias)
 	}
-	return quotedItems
+	return datasetVarName(n.Dataset)
 }
@@ -0,0 +1,469 @@
+package dsl
+
+import (
+	"encoding/json"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Most tests check the code emitted for a statement. The fixture tests also run the helper
+// functions of the generated script on small JSONL datasets; they need python3 with the
+// datasets and pandas modules and are skipped where these are not installed.
+
+// compile compiles the input and fails the test on errors
+func compile(t *testing.T, input string) string {
+	t.Helper()
+	script, err := NewDSL("", "").ParseAndCompile(input)
+	if err != nil {
+		t.Fatalf("ParseAndCompile: %v", err)
+	}
+	return script
+}
+
+// assertLines checks that the script contains the lines in this order, each one as a whole line
+func assertLines(t *testing.T, script string, want ...string) {
+	t.Helper()
+	lines := strings.Split(script, "\n")
+	next := 0
+	for _, line := range want {
+		found := false
+		for next < len(lines) {
+			next++
+			if lines[next-1] == line {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("script does not contain, in order, the line\n%s", line)
+			return
+		}
+	}
+}
+
+// requirePythonModules skips the test unless python3 can import the modules
+func requirePythonModules(t *testing.T, modules ...string) {
+	t.Helper()
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not installed")
+	}
+	for _, module := range modules {
+		if exec.Command(python, "-c", "import "+module).Run() != nil {
+			t.Skipf("Python module %s is not installed", module)
+		}
+	}
+}
+
+// pythonHelpers returns the definitions of the named functions and tables, which the script
+// defines inside main, moved to the top level
+func pythonHelpers(t *testing.T, script string, names ...string) string {
+	t.Helper()
+	lines := strings.Split(script, "\n")
+	var builder strings.Builder
+	for _, name := range names {
+		start := -1
+		for i, line := range lines {
+			if strings.HasPrefix(line, "    def "+name+"(") || strings.HasPrefix(line, "    "+name+" = ") {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			t.Fatalf("script does not define %s", name)
+		}
+		builder.WriteString(lines[start][4:] + "\n")
+		for _, line := range lines[start+1:] {
+			// The definition ends at the next line at the level of main's body; a table keeps its closing brace
+			body := strings.TrimPrefix(line, "    ")
+			if strings.TrimSpace(body) != "" && !strings.HasPrefix(body, " ") {
+				if body == "}" {
+					builder.WriteString(body + "\n")
+				}
+				break
+			}
+			builder.WriteString(body + "\n")
+		}
+	}
+	return builder.String()
+}
+
+// helperCall returns the call of the function made by the script, without the assignment
+func helperCall(t *testing.T, script, function string) string {
+	t.Helper()
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if _, call, ok := strings.Cut(line, " = "); ok && strings.HasPrefix(call, function+"(") {
+			return call
+		}
+		if strings.HasPrefix(line, function+"(") {
+			return line
+		}
+	}
+	t.Fatalf("script does not call %s", function)
+	return ""
+}
+
+// records parses JSONL records
+func records(t *testing.T, jsonl string) []map[string]any {
+	t.Helper()
+	var result []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(jsonl), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("record %s: %v", line, err)
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+// runHelpers evaluates a call of the script's helpers on datasets made from JSONL records,
+// given by the names of their variables, and returns the columns and the records of the result
+func runHelpers(t *testing.T, helpers, call string, datasets map[string]string) ([]string, []map[string]any) {
+	t.Helper()
+	requirePythonModules(t, "datasets", "pandas")
+	input, err := json.Marshal(map[string]any{"call": call, "datasets": datasets})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := runPython(t, `
+import contextlib, json, statistics, sys
+import pandas as pd
+from datasets import Dataset
+`+helpers+`
+fixture = json.load(sys.stdin)
+scope = {name: Dataset.from_list([json.loads(line) for line in text.splitlines() if line.strip()])
+         for name, text in fixture['datasets'].items()}
+# Messages of the helpers go to stderr, so that stdout holds only the result
+with contextlib.redirect_stdout(sys.stderr):
+    result = eval(fixture['call'], globals(), scope)
+print(json.dumps({'columns': result.column_names, 'records': list(result)}))
+`, input)
+
+	var result struct {
+		Columns []string
+		Records []map[string]any
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		t.Fatalf("python3 output %q: %v", output, err)
+	}
+	return result.Columns, result.Records
+}
+
+func TestCompileJoin(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name: "left join with alias",
+			input: `FROM ./questions.jsonl AS questions
+FROM ./labels.jsonl AS labels
+JOIN questions, labels ON [id, lang] LEFT AS qa
+SAVE qa TO "out.jsonl"`,
+			want: []string{
+				"    # Соединение датасетов questions и labels по id, lang (left)",
+				"    ds_qa = join_datasets(ds_questions, ds_labels, ['id', 'lang'], how='left', left_name='questions', right_name='labels', suffix='labels')",
+				"    carry_generation_errors('ds_qa', ['ds_questions', 'ds_labels'])",
+				"    loaded_datasets['ds_qa'] = ds_qa",
+				"    current_dataset = 'ds_qa'",
+				"    # Сохранение датасета ds_qa в файл",
+			},
+		},
+		{
+			name: "inner join without alias",
+			input: `FROM ./questions.jsonl AS questions
+FROM zwhe99/DeepMath-103K
+JOIN questions, ds_zwhe99_DeepMath_103K ON question OUTER
+SAVE "out.jsonl"`,
+			want: []string{
+				"    joined_ds_3 = join_datasets(ds_questions, ds_zwhe99_DeepMath_103K, ['question'], how='outer', left_name='questions', right_name='ds_zwhe99_DeepMath_103K', suffix='ds_zwhe99_DeepMath_103K')",
+				"    carry_generation_errors('joined_ds_3', ['ds_questions', 'ds_zwhe99_DeepMath_103K'])",
+				"    current_dataset = 'joined_ds_3'",
+				"    # Сохранение датасета joined_ds_3 в файл",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertLines(t, compile(t, tt.input), tt.want...)
+		})
+	}
+}
+
+// TestJoinFixtures runs the join_datasets call compiled for JOIN on small datasets
+func TestJoinFixtures(t *testing.T) {
+	const questions = `{"id": 1, "q": "a"}
+{"id": 2, "q": "b"}
+{"id": null, "q": "c"}
+{"id": 4, "q": "d"}`
+	const labels = `{"id": 1, "label": "x"}
+{"id": 1, "label": "y"}
+{"id": null, "label": "z"}
+{"id": 3, "label": "w"}`
+
+	tests := []struct {
+		name      string
+		join      string
+		questions string
+		labels    string
+		columns   []string
+		want      string
+	}{
+		{
+			name:      "inner join repeats a record for every match",
+			join:      "ON id",
+			questions: questions,
+			labels:    labels,
+			columns:   []string{"id", "q", "label"},
+			want: `{"id": 1, "q": "a", "label": "x"}
+{"id": 1, "q": "a", "label": "y"}`,
+		},
+		{
+			name:      "left join keeps records without a match",
+			join:      "ON id LEFT",
+			questions: questions,
+			labels:    labels,
+			columns:   []string{"id", "q", "label"},
+			want: `{"id": 1, "q": "a", "label": "x"}
+{"id": 1, "q": "a", "label": "y"}
+{"id": 2, "q": "b", "label": null}
+{"id": null, "q": "c", "label": null}
+{"id": 4, "q": "d", "label": null}`,
+		},
+		{
+			name:      "outer join adds records of the second dataset without a match",
+			join:      "ON id OUTER",
+			questions: questions,
+			labels:    labels,
+			columns:   []string{"id", "q", "label"},
+			want: `{"id": 1, "q": "a", "label": "x"}
+{"id": 1, "q": "a", "label": "y"}
+{"id": 2, "q": "b", "label": null}
+{"id": null, "q": "c", "label": null}
+{"id": 4, "q": "d", "label": null}
+{"id": null, "q": null, "label": "z"}
+{"id": 3, "q": null, "label": "w"}`,
+		},
+		{
+			name: "several key columns",
+			join: "ON [id, lang]",
+			questions: `{"id": 1, "lang": "en", "q": "a"}
+{"id": 1, "lang": "fr", "q": "b"}
+{"id": 2, "lang": null, "q": "c"}`,
+			labels: `{"id": 1, "lang": "fr", "label": "x"}
+{"id": 2, "lang": null, "label": "y"}
+{"id": 1, "lang": "de", "label": "z"}`,
+			columns: []string{"id", "lang", "q", "label"},
+			want:    `{"id": 1, "lang": "fr", "q": "b", "label": "x"}`,
+		},
+		{
+			name:      "columns of both datasets are renamed",
+			join:      "ON id",
+			questions: `{"id": 1, "text": "question"}`,
+			labels:    `{"id": 1, "text": "label"}`,
+			columns:   []string{"id", "text", "text_labels"},
+			want:      `{"id": 1, "text": "question", "text_labels": "label"}`,
+		},
+		{
+			name:      "renamed column does not overwrite a column of the second dataset",
+			join:      "ON id",
+			questions: `{"id": 1, "x": "question"}`,
+			labels:    `{"id": 1, "x": "label", "x_labels": "own"}`,
+			columns:   []string{"id", "x", "x_labels_2", "x_labels"},
+			want:      `{"id": 1, "x": "question", "x_labels_2": "label", "x_labels": "own"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := compile(t, `FROM ./questions.jsonl AS questions
+FROM ./labels.jsonl AS labels
+JOIN questions, labels `+tt.join)
+			columns, got := runHelpers(t, pythonHelpers(t, script, "join_datasets"), helperCall(t, script, "join_datasets"),
+				map[string]string{"ds_questions": tt.questions, "ds_labels": tt.labels})
+			if !reflect.DeepEqual(columns, tt.columns) {
+				t.Errorf("columns = %v, want %v", columns, tt.columns)
+			}
+			if want := records(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("records\n got: %v\nwant: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCompileAggregate(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name: "printed statistics",
+			input: `FROM ./math.jsonl {
+    AGGREGATE count(), avg(difficulty), median(difficulty)
+}`,
+			want: []string{
+				"    # Статистика count(), avg(difficulty), median(difficulty)",
+				"    aggregate_dataset(ds___math_jsonl, [('count', 'count', None), ('avg_difficulty', 'avg', 'difficulty'), ('median_difficulty', 'median', 'difficulty')], by=[], title='count(), avg(difficulty), median(difficulty)')",
+			},
+		},
+		{
+			name: "grouped statistics saved INTO a dataset",
+			input: `FROM ./math.jsonl {
+    AGGREGATE count(level), max(difficulty) AS hardest BY topic, level INTO stats
+    LIMIT 10
+}
+SAVE stats TO "stats.jsonl"`,
+			want: []string{
+				"    # Статистика count(level), max(difficulty) BY topic, level",
+				"    ds_stats = aggregate_dataset(ds___math_jsonl, [('count_level', 'count', 'level'), ('hardest', 'max', 'difficulty')], by=['topic', 'level'], title='count(level), max(difficulty) BY topic, level')",
+				"    loaded_datasets['ds_stats'] = ds_stats",
+				// The aggregated dataset stays the current one
+				"    ds___math_jsonl = limit_records(ds___math_jsonl, 10)",
+				"    # Сохранение датасета ds_stats в файл",
+				"    save_current_results('ds_stats')",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertLines(t, compile(t, tt.input), tt.want...)
+		})
+	}
+}
+
+// TestAggregateFixtures runs the aggregate_dataset call compiled for AGGREGATE ... INTO on a small dataset
+func TestAggregateFixtures(t *testing.T) {
+	const math = `{"topic": "b", "level": 1, "difficulty": 3}
+{"topic": "a", "level": null, "difficulty": null}
+{"topic": "b", "level": 2, "difficulty": 5}
+{"topic": null, "level": 3, "difficulty": 4}
+{"topic": "a", "level": 1, "difficulty": 2}
+{"topic": "b", "level": 2, "difficulty": null}
+{"topic": "b", "level": 1, "difficulty": 10}
+{"topic": "c", "level": null, "difficulty": null}`
+
+	tests := []struct {
+		name      string
+		aggregate string
+		columns   []string
+		want      string
+	}{
+		{
+			name:      "count() counts records and count(column) values",
+			aggregate: "count(), count(level) BY topic",
+			columns:   []string{"topic", "count", "count_level"},
+			// Groups go in the order of the BY values, the empty one last
+			want: `{"topic": "a", "count": 2, "count_level": 1}
+{"topic": "b", "count": 4, "count_level": 4}
+{"topic": "c", "count": 1, "count_level": 0}
+{"topic": null, "count": 1, "count_level": 1}`,
+		},
+		{
+			name:      "avg and median skip missing values",
+			aggregate: "avg(difficulty), median(difficulty) BY topic",
+			columns:   []string{"topic", "avg_difficulty", "median_difficulty"},
+			want: `{"topic": "a", "avg_difficulty": 2, "median_difficulty": 2}
+{"topic": "b", "avg_difficulty": 6, "median_difficulty": 5}
+{"topic": "c", "avg_difficulty": null, "median_difficulty": null}
+{"topic": null, "avg_difficulty": 4, "median_difficulty": 4}`,
+		},
+		{
+			name:      "distinct without BY",
+			aggregate: "distinct(level), distinct(topic), count()",
+			columns:   []string{"distinct_level", "distinct_topic", "count"},
+			want:      `{"distinct_level": 3, "distinct_topic": 3, "count": 8}`,
+		},
+		{
+			name:      "names and several BY columns",
+			aggregate: "max(difficulty) AS hardest, count() BY topic, level",
+			columns:   []string{"topic", "level", "hardest", "count"},
+			want: `{"topic": "a", "level": 1, "hardest": 2, "count": 1}
+{"topic": "a", "level": null, "hardest": null, "count": 1}
+{"topic": "b", "level": 1, "hardest": 10, "count": 2}
+{"topic": "b", "level": 2, "hardest": 5, "count": 2}
+{"topic": "c", "level": null, "hardest": null, "count": 1}
+{"topic": null, "level": 3, "hardest": 4, "count": 1}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := compile(t, `FROM ./math.jsonl AS math {
+    AGGREGATE `+tt.aggregate+` INTO stats
+}`)
+			helpers := pythonHelpers(t, script, "dataset_columns", "require_columns", "group_key", "aggregate_functions", "aggregate_dataset")
+			columns, got := runHelpers(t, helpers, helperCall(t, script, "aggregate_dataset"), map[string]string{"ds_math": math})
+			if !reflect.DeepEqual(columns, tt.columns) {
+				t.Errorf("columns = %v, want %v", columns, tt.columns)
+			}
+			if want := records(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("records\n got: %v\nwant: %v", got, want)
+			}
+		})
+	}
+}
+
+// TestCheckpointFixtures runs the checkpoint functions of the script for two DSL files with the same name
+func TestCheckpointFixtures(t *testing.T) {
+	script := compile(t, `FROM squad`)
+	helpers := pythonHelpers(t, script, "checkpoint_source", "checkpoint_dir", "read_checkpoint", "open_checkpoint")
+
+	first, second := strings.Repeat("1", 64), strings.Repeat("2", 64)
+	type step struct {
+		Source      string            `json:"source"`
+		Fingerprint string            `json:"fingerprint"`
+		Resume      bool              `json:"resume"`
+		Responses   map[string]string `json:"responses"` // Written to the checkpoint after it is opened
+	}
+	steps := []step{
+		{Source: "a/task.syn", Fingerprint: first, Responses: map[string]string{"0": "a0", "1": "a1"}},
+		// A script with the same name in another directory
+		{Source: "b/task.syn", Fingerprint: first, Responses: map[string]string{"0": "b0"}},
+		{Source: "a/task.syn", Fingerprint: first, Resume: true},
+		// Changed generation settings start over without overwriting the checkpoint
+		{Source: "a/task.syn", Fingerprint: second, Resume: true, Responses: map[string]string{"0": "c0"}},
+		{Source: "a/task.syn", Fingerprint: first, Resume: true},
+		{Source: "b/task.syn", Fingerprint: first, Resume: true},
+	}
+	want := []map[string]string{{}, {}, {"0": "a0", "1": "a1"}, {}, {"0": "a0", "1": "a1"}, {"0": "b0"}}
+
+	input, err := json.Marshal(map[string]any{"helpers": helpers, "dir": t.TempDir(), "steps": steps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := runPython(t, `
+import contextlib, glob, hashlib, json, os, sys
+fixture = json.load(sys.stdin)
+os.chdir(fixture['dir'])
+restored = []
+for step in fixture['steps']:
+    # Every step is a run of its own script
+    os.environ['SYN_SOURCE'] = step['source']
+    scope = {'glob': glob, 'hashlib': hashlib, 'json': json, 'os': os, 'sys': sys, 'resume': step['resume'], 'checkpoints': {}}
+    with contextlib.redirect_stdout(sys.stderr):
+        exec(fixture['helpers'], scope)
+        checkpoint, responses = scope['open_checkpoint']('generate_1', step['fingerprint'])
+    for index, response in (step['responses'] or {}).items():
+        checkpoint.write(json.dumps({'index': int(index), 'response': response}) + '\n')
+    checkpoint.close()
+    restored.append(responses)
+print(json.dumps(restored))
+`, input)
+
+	var got []map[string]string
+	if err := json.Unmarshal(output, &got); err != nil {
+		t.Fatalf("python3 output %q: %v", output, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("restored responses\n got: %v\nwant: %v", got, want)
+	}
+}
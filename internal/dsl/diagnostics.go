@@ -0,0 +1,193 @@
+package dsl
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+)
+
+// Severity is the importance level of a diagnostic
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityNote
+)
+
+// String returns the name of the severity as shown to the user
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+// Span is a range of source text
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// Diagnostic is a message about a location in the source code
+type Diagnostic struct {
+	Severity Severity
+	Message  string
+	Span     Span
+	Hint     string // Optional suggestion on how to fix the problem
+}
+
+// Error implements the error interface
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("%s: %s: %s", d.Span.Start, d.Severity, d.Message)
+}
+
+// Diagnostics is a list of diagnostics
+type Diagnostics []Diagnostic
+
+// Error implements the error interface
+func (ds Diagnostics) Error() string {
+	messages := make([]string, len(ds))
+	for i, d := range ds {
+		messages[i] = d.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// HasErrors checks if there is at least one diagnostic with error severity
+func (ds Diagnostics) HasErrors() bool {
+	return ds.ErrorCount() > 0
+}
+
+// ErrorCount returns the number of diagnostics with error severity
+func (ds Diagnostics) ErrorCount() int {
+	count := 0
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			count++
+		}
+	}
+	return count
+}
+
+// tokenSpan returns the span covered by a token
+func tokenSpan(token Token) Span {
+	return Span{Start: token.Pos, End: token.End}
+}
+
+// DiagnosticFormatter renders diagnostics with source snippets
+type DiagnosticFormatter struct {
+	filename string
+	lines    []string
+	colored  bool
+}
+
+// NewDiagnosticFormatter creates a formatter for diagnostics of the given file
+func NewDiagnosticFormatter(filename, source string, colored bool) *DiagnosticFormatter {
+	return &DiagnosticFormatter{
+		filename: filename,
+		lines:    strings.Split(source, "\n"),
+		colored:  colored,
+	}
+}
+
+// Format renders a diagnostic as
+//
+//	file.syn:12:5: error: message
+//	   12 |     FILTER x >
+//	      |              ^
+//	      = hint: ...
+func (f *DiagnosticFormatter) Format(d Diagnostic) string {
+	bold := f.style(color.Bold)
+	blue := f.style(color.FgBlue, color.Bold)
+	severity := f.style(color.FgRed, color.Bold)
+	switch d.Severity {
+	case SeverityWarning:
+		severity = f.style(color.FgYellow, color.Bold)
+	case SeverityNote:
+		severity = f.style(color.FgCyan, color.Bold)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s %s %s\n",
+		bold(fmt.Sprintf("%s:%s:", f.filename, d.Span.Start)),
+		severity(d.Severity.String()+":"),
+		bold(d.Message)))
+
+	line := d.Span.Start.Line
+	if line >= 1 && line <= len(f.lines) {
+		text := strings.TrimRight(f.lines[line-1], "\r")
+		gutter := strings.Repeat(" ", len(fmt.Sprint(line)))
+
+		sb.WriteString(fmt.Sprintf(" %s %s %s\n", blue(fmt.Sprint(line)), blue("|"), text))
+		sb.WriteString(fmt.Sprintf(" %s %s %s%s\n", gutter, blue("|"),
+			caretPadding(text, d.Span.Start.Column), severity(strings.Repeat("^", caretWidth(text, d.Span)))))
+
+		if d.Hint != "" {
+			sb.WriteString(fmt.Sprintf(" %s %s %s\n", gutter, blue("="), bold("hint:")+" "+d.Hint))
+		}
+	} else if d.Hint != "" {
+		sb.WriteString(fmt.Sprintf("  %s %s\n", blue("="), bold("hint:")+" "+d.Hint))
+	}
+
+	return sb.String()
+}
+
+// FormatAll renders all diagnostics one after another
+func (f *DiagnosticFormatter) FormatAll(ds Diagnostics) string {
+	var sb strings.Builder
+	for _, d := range ds {
+		sb.WriteString(f.Format(d))
+	}
+	return sb.String()
+}
+
+// style returns a coloring function honoring the formatter color setting
+func (f *DiagnosticFormatter) style(attrs ...color.Attribute) func(a ...interface{}) string {
+	c := color.New(attrs...)
+	if f.colored {
+		c.EnableColor()
+	} else {
+		c.DisableColor()
+	}
+	return c.SprintFunc()
+}
+
+// caretPadding returns the whitespace placed before the caret, keeping tabs so that it lines up
+func caretPadding(text string, column int) string {
+	var sb strings.Builder
+	i := 1
+	for _, r := range text {
+		if i >= column {
+			break
+		}
+		if r == '\t' {
+			sb.WriteRune('\t')
+		} else {
+			sb.WriteRune(' ')
+		}
+		i++
+	}
+	return sb.String()
+}
+
+// caretWidth returns the number of carets underlining the span on its first line
+func caretWidth(text string, span Span) int {
+	width := 1
+	if span.End.Line == span.Start.Line && span.End.Column > span.Start.Column {
+		width = span.End.Column - span.Start.Column
+	} else if span.End.Line > span.Start.Line {
+		// Multi-line span: underline up to the end of the first line
+		width = utf8.RuneCountInString(text) - span.Start.Column + 1
+	}
+	if width < 1 {
+		width = 1
+	}
+	return width
+}
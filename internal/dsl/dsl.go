@@ -8,11 +8,13 @@ import (
 
 // DSL is a facade for working with our SYNC compiler
 type DSL struct {
-	parser    *Parser
-	compiler  *Compiler
-	executor  *Executor
-	scriptDir string
-	debug     bool
+	parser      *Parser
+	checker     *Checker
+	compiler    *Compiler
+	executor    *Executor
+	scriptDir   string
+	debug       bool
+	diagnostics Diagnostics // Warnings of the last compilation
 }
 
 // NewDSL creates a new compiler object
@@ -29,6 +31,16 @@ func (d *DSL) SetDebug(debug bool) {
 	d.debug = debug
 }
 
+// SetCache sets the cache file of model responses used by the executed script, or disables the cache
+func (d *DSL) SetCache(cachePath string, noCache bool) {
+	d.executor.SetCache(cachePath, noCache)
+}
+
+// SetResume sets whether the executed script continues the generation from the checkpoints of an interrupted run
+func (d *DSL) SetResume(resume bool) {
+	d.executor.SetResume(resume)
+}
+
 // ParseAndCompile parses the code and compiles it to Python
 func (d *DSL) ParseAndCompile(input string) (string, error) {
 	// Create a parser
@@ -36,9 +48,16 @@ func (d *DSL) ParseAndCompile(input string) (string, error) {
 	d.parser.SetDebug(d.debug)
 
 	// Parse the code
-	program, err := d.parser.Parse()
-	if err != nil {
-		return "", fmt.Errorf("parsing error: %w", err)
+	program, diags := d.parser.Parse()
+	if diags.HasErrors() {
+		return "", fmt.Errorf("parsing error: %w", diags)
+	}
+
+	// Check references, settings and statement placement
+	d.checker = NewChecker(program)
+	d.diagnostics = d.checker.Check()
+	if d.diagnostics.HasErrors() {
+		return "", fmt.Errorf("semantic error: %w", d.diagnostics)
 	}
 
 	// Create a compiler
@@ -51,6 +70,11 @@ func (d *DSL) ParseAndCompile(input string) (string, error) {
 	return pythonCode, nil
 }
 
+// Diagnostics returns the warnings reported by the last successful compilation
+func (d *DSL) Diagnostics() Diagnostics {
+	return d.diagnostics
+}
+
 // ExecuteFromFile reads code from a file, compiles and executes it
 func (d *DSL) ExecuteFromFile(filePath string, saveScript bool) error {
 	// Read the file
@@ -65,6 +89,11 @@ func (d *DSL) ExecuteFromFile(filePath string, saveScript bool) error {
 		return err
 	}
 
+	// Checkpoints of the script are kept per DSL file, not per name of the generated script
+	if sourcePath, err := filepath.Abs(filePath); err == nil {
+		d.executor.SetSourcePath(sourcePath)
+	}
+
 	// Generate output file name
 	baseName := filepath.Base(filePath)
 	ext := filepath.Ext(baseName)
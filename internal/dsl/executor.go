@@ -18,6 +18,10 @@ type Executor struct {
 	pythonPath string
 	tempDir    string
 	debug      bool
+	cachePath  string // Cache file of model responses, overrides PRAGMA CACHE
+	noCache    bool   // Disables the cache of model responses
+	resume     bool   // Continues the generation from the checkpoints of an interrupted run
+	sourcePath string // Absolute path of the DSL file, names the directory of its checkpoints
 }
 
 // NewExecutor creates a new executor
@@ -38,6 +42,22 @@ func (e *Executor) SetDebug(debug bool) {
 	e.debug = debug
 }
 
+// SetCache sets the cache file of model responses, or disables the cache
+func (e *Executor) SetCache(cachePath string, noCache bool) {
+	e.cachePath = cachePath
+	e.noCache = noCache
+}
+
+// SetResume sets whether the generation continues from the checkpoints of an interrupted run
+func (e *Executor) SetResume(resume bool) {
+	e.resume = resume
+}
+
+// SetSourcePath sets the absolute path of the DSL file the code is compiled from
+func (e *Executor) SetSourcePath(sourcePath string) {
+	e.sourcePath = sourcePath
+}
+
 // Execute executes the generated Python code
 func (e *Executor) Execute(pythonCode string, saveScript bool, scriptPath string, debug bool) error {
 	// Set debug mode
@@ -84,6 +104,22 @@ func (e *Executor) Execute(pythonCode string, saveScript bool, scriptPath string
 	} else {
 		env = append(env, "SYN_DEBUG=0")
 	}
+
+	// Add environment variables for the cache of model responses
+	if e.cachePath != "" {
+		env = append(env, "SYN_CACHE="+e.cachePath)
+	}
+	if e.noCache {
+		env = append(env, "SYN_NO_CACHE=1")
+	}
+
+	// Add environment variables for the checkpoints: resuming from them and the DSL file they belong to
+	if e.resume {
+		env = append(env, "SYN_RESUME=1")
+	}
+	if e.sourcePath != "" {
+		env = append(env, "SYN_SOURCE="+e.sourcePath)
+	}
 	cmd.Env = env
 
 	// Set up signal handling
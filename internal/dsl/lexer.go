@@ -0,0 +1,498 @@
+package dsl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TokenType classifies a lexical token
+type TokenType int
+
+const (
+	TokenEOF TokenType = iota
+	TokenKeyword
+	TokenIdent
+	TokenString
+	TokenNumber
+	TokenOperator
+	TokenPunct
+	TokenRegex
+)
+
+// String returns a human-readable name of the token type
+func (t TokenType) String() string {
+	switch t {
+	case TokenEOF:
+		return "end of file"
+	case TokenKeyword:
+		return "keyword"
+	case TokenIdent:
+		return "identifier"
+	case TokenString:
+		return "string"
+	case TokenNumber:
+		return "number"
+	case TokenOperator:
+		return "operator"
+	case TokenPunct:
+		return "punctuation"
+	case TokenRegex:
+		return "regular expression"
+	default:
+		return "unknown"
+	}
+}
+
+// Position is a location in the source text
+type Position struct {
+	Offset int // Byte offset, starting at 0
+	Line   int // Line number, starting at 1
+	Column int // Column number in characters, starting at 1
+}
+
+// String formats the position as line:column
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Token is a single lexical token
+type Token struct {
+	Type  TokenType
+	Value string   // Token text; for strings and regular expressions - the content without delimiters
+	Pos   Position // Position of the first character
+	End   Position // Position right after the last character
+}
+
+// String returns a representation of the token for messages
+func (t Token) String() string {
+	switch t.Type {
+	case TokenEOF:
+		return "end of file"
+	case TokenString:
+		return fmt.Sprintf("%q", t.Value)
+	case TokenRegex:
+		return "/" + strings.ReplaceAll(t.Value, "/", `\/`) + "/"
+	default:
+		return t.Value
+	}
+}
+
+// Is reports whether the token has the given type and value
+func (t Token) Is(typ TokenType, value string) bool {
+	return t.Type == typ && t.Value == value
+}
+
+// keywords is the set of reserved words of the DSL
+var keywords = map[string]bool{
+	"FROM":        true,
+	"WITH":        true,
+	"FIELDS":      true,
+	"USING":       true,
+	"FILTER":      true,
+	"MODEL":       true,
+	"KEY":         true,
+	"URL":         true,
+	"MERGE":       true,
+	"SAVE":        true,
+	"GENERATE":    true,
+	"PROMPT":      true,
+	"SYSTEM":      true,
+	"USER":        true,
+	"TOKENS":      true,
+	"TEMPERATURE": true,
+	"PRAGMA":      true,
+	"AUTOSAVE":    true,
+	"CONCURRENCY": true,
+	"STREAM":      true,
+	"AS":          true,
+	"TO":          true,
+	"AND":         true,
+	"OR":          true,
+	"NOT":         true,
+	"IN":          true,
+	"IS":          true,
+	"NULL":        true,
+	"CONTAINS":    true,
+	"STARTSWITH":  true,
+	"ENDSWITH":    true,
+	"MATCHES":     true,
+	"IIN":         true,
+	"ICONTAINS":   true,
+	"ISTARTSWITH": true,
+	"IENDSWITH":   true,
+	"IMATCHES":    true,
+	"FORMAT":      true,
+	"CONFIG":      true,
+	"SPLIT":       true,
+	"REVISION":    true,
+	"COMPRESSION": true,
+	"SHARD":       true,
+	"JOIN":        true,
+	"ON":          true,
+	"INNER":       true,
+	"LEFT":        true,
+	"OUTER":       true,
+	"ALIGN":       true,
+	"MAP":         true,
+	"SOURCE":      true,
+	"RENAME":      true,
+	"DROP":        true,
+	"CAST":        true,
+	"SET":         true,
+	"LIMIT":       true,
+	"SAMPLE":      true,
+	"SEED":        true,
+	"SHUFFLE":     true,
+	"SORT":        true,
+	"BY":          true,
+	"ASC":         true,
+	"DESC":        true,
+	"DEDUP":       true,
+	"NORMALIZE":   true,
+	"FUZZY":       true,
+	"REMOVED":     true,
+	"AGGREGATE":   true,
+	"INTO":        true,
+	"RETRIES":     true,
+	"TIMEOUT":     true,
+	"RPM":         true,
+	"TPM":         true,
+	"CACHE":       true,
+
+	// Handling of failed generations in GENERATE
+	"ON_ERROR":     true,
+	"ERROR_COLUMN": true,
+}
+
+// operators lists the operators, longest first so that the lexer is greedy.
+// A slash is a division only after a value; elsewhere it starts a regular expression.
+var operators = []string{"==", "!=", ">=", "<=", "->", "=", ">", "<", "+", "-", "*", "/"}
+
+// punctuation is the set of single-character punctuation tokens.
+// A dot is a token of its own only outside a word, as in answers.text[0].start
+const punctuation = "{}[]();,:."
+
+// Lexer splits the source text into tokens
+type Lexer struct {
+	input  string
+	offset int
+	line   int
+	column int
+	prev   Token // Last scanned token
+}
+
+// NewLexer creates a new Lexer
+func NewLexer(input string) *Lexer {
+	return &Lexer{
+		input:  input,
+		offset: 0,
+		line:   1,
+		column: 1,
+	}
+}
+
+// Tokenize returns all tokens of the input, terminated by an EOF token.
+// Invalid characters are skipped and reported, so that all lexical errors are found in one pass.
+func (l *Lexer) Tokenize() ([]Token, Diagnostics) {
+	tokens := []Token{}
+	var diags Diagnostics
+	for {
+		token, err := l.Next()
+		if err != nil {
+			diags = append(diags, asDiagnostic(err))
+			continue
+		}
+		tokens = append(tokens, token)
+		if token.Type == TokenEOF {
+			return tokens, diags
+		}
+	}
+}
+
+// Next scans the next token
+func (l *Lexer) Next() (Token, error) {
+	token, err := l.scan()
+	if err == nil {
+		l.prev = token
+	}
+	return token, err
+}
+
+// scan scans the next token without remembering it
+func (l *Lexer) scan() (Token, error) {
+	l.skipSpaceAndComments()
+
+	start := l.pos()
+	if l.offset >= len(l.input) {
+		return Token{Type: TokenEOF, Pos: start, End: start}, nil
+	}
+
+	r := l.peekRune()
+
+	switch {
+	case r == '"' || r == '\'':
+		return l.scanString(r)
+	case r == '/' && !l.afterValue():
+		return l.scanRegex()
+	case isWordStart(r) || (r == '-' && isDigit(l.peekRuneAt(1)) && !l.afterValue()):
+		return l.scanWord(), nil
+	case r == '.' && (l.peekRuneAt(1) == '/' || (l.peekRuneAt(1) == '.' && l.peekRuneAt(2) == '/')):
+		return l.scanWord(), nil // Relative path: ./data/train.jsonl
+	case strings.ContainsRune(punctuation, r):
+		l.advance()
+		return Token{Type: TokenPunct, Value: string(r), Pos: start, End: l.pos()}, nil
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(l.input[l.offset:], op) {
+			for range op {
+				l.advance()
+			}
+			return Token{Type: TokenOperator, Value: op, Pos: start, End: l.pos()}, nil
+		}
+	}
+
+	l.advance()
+	return Token{}, Diagnostic{
+		Severity: SeverityError,
+		Message:  fmt.Sprintf("unexpected character %q", r),
+		Span:     Span{Start: start, End: l.pos()},
+	}
+}
+
+// afterValue reports whether the last token ends a value, so that a slash or a minus after it
+// is an operator: words / 2, length -1
+func (l *Lexer) afterValue() bool {
+	switch l.prev.Type {
+	case TokenIdent, TokenNumber, TokenString:
+		return true
+	case TokenPunct:
+		return l.prev.Value == ")" || l.prev.Value == "]"
+	}
+	return false
+}
+
+// skipSpaceAndComments skips whitespace and # comments up to the end of line
+func (l *Lexer) skipSpaceAndComments() {
+	for l.offset < len(l.input) {
+		r := l.peekRune()
+		if r == '#' {
+			for l.offset < len(l.input) && l.peekRune() != '\n' {
+				l.advance()
+			}
+			continue
+		}
+		if !unicode.IsSpace(r) {
+			return
+		}
+		l.advance()
+	}
+}
+
+// scanString scans a quoted string and decodes its escape sequences:
+// \n, \t, \r, \\, \", \' and \uXXXX. Unknown escapes are kept as written.
+func (l *Lexer) scanString(quote rune) (Token, error) {
+	start := l.pos()
+	l.advance() // Skip opening quote
+
+	var sb strings.Builder
+	for {
+		if l.offset >= len(l.input) {
+			return Token{}, Diagnostic{
+				Severity: SeverityError,
+				Message:  "unterminated string",
+				Span:     Span{Start: start, End: start},
+				Hint:     fmt.Sprintf("add a closing %c", quote),
+			}
+		}
+		r := l.advance()
+		if r == quote {
+			break
+		}
+		if r != '\\' || l.offset >= len(l.input) {
+			sb.WriteRune(r)
+			continue
+		}
+
+		escape := l.advance()
+		switch escape {
+		case 'n':
+			sb.WriteRune('\n')
+		case 't':
+			sb.WriteRune('\t')
+		case 'r':
+			sb.WriteRune('\r')
+		case '\\', '"', '\'':
+			sb.WriteRune(escape)
+		case 'u':
+			if code, ok := l.scanHex(4); ok {
+				sb.WriteRune(rune(code))
+			} else {
+				sb.WriteString("\\u")
+			}
+		default:
+			sb.WriteRune('\\')
+			sb.WriteRune(escape)
+		}
+	}
+
+	return Token{Type: TokenString, Value: sb.String(), Pos: start, End: l.pos()}, nil
+}
+
+// scanRegex scans a regular expression in slashes. The pattern is kept as written,
+// except for \/ which stands for a slash; it must fit on one line.
+func (l *Lexer) scanRegex() (Token, error) {
+	start := l.pos()
+	l.advance() // Skip opening slash
+
+	var sb strings.Builder
+	for {
+		if l.offset >= len(l.input) || l.peekRune() == '\n' {
+			return Token{}, Diagnostic{
+				Severity: SeverityError,
+				Message:  "unterminated regular expression",
+				Span:     Span{Start: start, End: start},
+				Hint:     "add a closing / on the same line; write \\/ for a slash inside the pattern",
+			}
+		}
+		r := l.advance()
+		if r == '/' {
+			break
+		}
+		if r == '\\' && l.offset < len(l.input) && l.peekRune() == '/' {
+			r = l.advance()
+		} else if r == '\\' && l.offset < len(l.input) && l.peekRune() != '\n' {
+			sb.WriteRune(r)
+			r = l.advance() // An escaped character never closes the pattern
+		}
+		sb.WriteRune(r)
+	}
+
+	return Token{Type: TokenRegex, Value: sb.String(), Pos: start, End: l.pos()}, nil
+}
+
+// scanHex consumes exactly n hexadecimal digits; nothing is consumed if they are not there
+func (l *Lexer) scanHex(n int) (int, bool) {
+	if l.offset+n > len(l.input) {
+		return 0, false
+	}
+	code, err := strconv.ParseUint(l.input[l.offset:l.offset+n], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	for i := 0; i < n; i++ {
+		l.advance()
+	}
+	return int(code), true
+}
+
+// scanWord scans an identifier, keyword or number.
+// Words may contain '/', '-' and '.', so that dataset names like
+// zwhe99/DeepMath-103K and dotted paths like final_answer.length are single tokens.
+func (l *Lexer) scanWord() Token {
+	start := l.pos()
+	begin := l.offset
+
+	l.advance()
+	for l.offset < len(l.input) {
+		r := l.peekRune()
+		if r == '-' && l.peekRuneAt(1) == '>' {
+			break // Arrow operator
+		}
+		if !isWordChar(r) {
+			break
+		}
+		l.advance()
+	}
+
+	word := l.input[begin:l.offset]
+	typ := TokenIdent
+	if isNumber(word) {
+		typ = TokenNumber
+	} else if keywords[word] {
+		typ = TokenKeyword
+	}
+
+	return Token{Type: typ, Value: word, Pos: start, End: l.pos()}
+}
+
+// pos returns the current position
+func (l *Lexer) pos() Position {
+	return Position{Offset: l.offset, Line: l.line, Column: l.column}
+}
+
+// peekRune returns the current rune without consuming it
+func (l *Lexer) peekRune() rune {
+	r, _ := utf8.DecodeRuneInString(l.input[l.offset:])
+	return r
+}
+
+// peekRuneAt returns the rune n runes after the current one
+func (l *Lexer) peekRuneAt(n int) rune {
+	offset := l.offset
+	for i := 0; i < n && offset < len(l.input); i++ {
+		_, size := utf8.DecodeRuneInString(l.input[offset:])
+		offset += size
+	}
+	if offset >= len(l.input) {
+		return 0
+	}
+	r, _ := utf8.DecodeRuneInString(l.input[offset:])
+	return r
+}
+
+// advance consumes the current rune and updates line and column
+func (l *Lexer) advance() rune {
+	r, size := utf8.DecodeRuneInString(l.input[l.offset:])
+	l.offset += size
+	if r == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+	return r
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isWordStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isWordChar(r rune) bool {
+	return isWordStart(r) || r == '-' || r == '/' || r == '.'
+}
+
+// isNumber checks whether a word is an integer or a decimal number, optionally with an exponent: 42, -0.5, 1e-3
+func isNumber(word string) bool {
+	s := strings.TrimPrefix(word, "-")
+	if mantissa, exponent, ok := strings.Cut(strings.ToLower(s), "e"); ok {
+		exponent = strings.TrimPrefix(strings.TrimPrefix(exponent, "-"), "+")
+		return isDecimal(mantissa) && exponent != "" && strings.Trim(exponent, "0123456789") == ""
+	}
+	return isDecimal(s)
+}
+
+// isDecimal checks whether a string is an unsigned integer or decimal number
+func isDecimal(s string) bool {
+	if s == "" || !isDigit(rune(s[0])) {
+		return false
+	}
+	dot := false
+	for _, r := range s {
+		switch {
+		case isDigit(r):
+		case r == '.' && !dot:
+			dot = true
+		default:
+			return false
+		}
+	}
+	return !strings.HasSuffix(s, ".")
+}
@@ -0,0 +1,235 @@
+package dsl
+
+import (
+	"strings"
+	"testing"
+)
+
+// tokenize scans the input and fails the test on lexical errors
+func tokenize(t *testing.T, input string) []Token {
+	t.Helper()
+	tokens, diags := NewLexer(input).Tokenize()
+	if len(diags) > 0 {
+		t.Fatalf("Tokenize(%q): unexpected diagnostics:\n%v", input, diags)
+	}
+	return tokens
+}
+
+// describe formats tokens as type:value pairs, dropping the final EOF
+func describe(tokens []Token) string {
+	parts := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if token.Type == TokenEOF {
+			break
+		}
+		parts = append(parts, token.Type.String()+":"+token.Value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestLexerTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "comment after statement",
+			input: "FROM squad # the dataset",
+			want:  "keyword:FROM identifier:squad",
+		},
+		{
+			name:  "hash inside double quotes",
+			input: `PROMPT p "Problem #3: {question}" # comment`,
+			want:  "keyword:PROMPT identifier:p string:Problem #3: {question}",
+		},
+		{
+			name:  "hash inside single quotes",
+			input: `SAVE 'out#1.json'`,
+			want:  "keyword:SAVE string:out#1.json",
+		},
+		{
+			name:  "escapes",
+			input: `"a\"b\n\t\\ \u00e9 \q"`,
+			want:  "string:a\"b\n\t\\ é \\q",
+		},
+		{
+			name:  "dataset name with slash and dash",
+			input: "FROM zwhe99/DeepMath-103K",
+			want:  "keyword:FROM identifier:zwhe99/DeepMath-103K",
+		},
+		{
+			name:  "dotted path",
+			input: "FILTER final_answer.length > 3",
+			want:  "keyword:FILTER identifier:final_answer.length operator:> number:3",
+		},
+		{
+			name:  "dotted path and index",
+			input: "answers.text[0].start",
+			want:  "identifier:answers.text punctuation:[ number:0 punctuation:] punctuation:. identifier:start",
+		},
+		{
+			name:  "relative path",
+			input: "FROM ./data/train.jsonl",
+			want:  "keyword:FROM identifier:./data/train.jsonl",
+		},
+		{
+			name:  "arrow",
+			input: "MAP a->b",
+			want:  "keyword:MAP identifier:a operator:-> identifier:b",
+		},
+		{
+			name:  "comparison operators",
+			input: "a >= 1 AND b != 2",
+			want:  "identifier:a operator:>= number:1 keyword:AND identifier:b operator:!= number:2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describe(tokenize(t, tt.input)); got != tt.want {
+				t.Errorf("Tokenize(%q)\n got: %s\nwant: %s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexerPositions(t *testing.T) {
+	input := "FROM squad {\n  SAVE \"вывод.json\" x\n}"
+	want := []struct {
+		value      string
+		start, end Position
+	}{
+		{"FROM", Position{0, 1, 1}, Position{4, 1, 5}},
+		{"squad", Position{5, 1, 6}, Position{10, 1, 11}},
+		{"{", Position{11, 1, 12}, Position{12, 1, 13}},
+		{"SAVE", Position{15, 2, 3}, Position{19, 2, 7}},
+		// Columns count characters, offsets count bytes
+		{"вывод.json", Position{20, 2, 8}, Position{37, 2, 20}},
+		{"x", Position{38, 2, 21}, Position{39, 2, 22}},
+		{"}", Position{40, 3, 1}, Position{41, 3, 2}},
+		{"", Position{41, 3, 2}, Position{41, 3, 2}},
+	}
+
+	tokens := tokenize(t, input)
+	if len(tokens) != len(want) {
+		t.Fatalf("got %d tokens, want %d: %s", len(tokens), len(want), describe(tokens))
+	}
+	for i, w := range want {
+		token := tokens[i]
+		if token.Value != w.value || token.Pos != w.start || token.End != w.end {
+			t.Errorf("token %d = %q %+v-%+v, want %q %+v-%+v",
+				i, token.Value, token.Pos, token.End, w.value, w.start, w.end)
+		}
+	}
+	if tokens[len(tokens)-1].Type != TokenEOF {
+		t.Errorf("last token is %s, want end of file", tokens[len(tokens)-1].Type)
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		tokens   string
+		messages []string
+		starts   []Position
+	}{
+		{
+			name:     "unknown characters are skipped and all reported",
+			input:    "FROM @ squad\nSAVE $",
+			tokens:   "keyword:FROM identifier:squad keyword:SAVE",
+			messages: []string{`unexpected character '@'`, `unexpected character '$'`},
+			starts:   []Position{{5, 1, 6}, {18, 2, 6}},
+		},
+		{
+			name:     "unterminated string",
+			input:    `SAVE "out.json`,
+			tokens:   "keyword:SAVE",
+			messages: []string{"unterminated string"},
+			starts:   []Position{{5, 1, 6}},
+		},
+		{
+			name:     "unterminated regular expression",
+			input:    "FILTER q MATCHES /abc\nLIMIT 1",
+			tokens:   "keyword:FILTER identifier:q keyword:MATCHES keyword:LIMIT number:1",
+			messages: []string{"unterminated regular expression"},
+			starts:   []Position{{17, 1, 18}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, diags := NewLexer(tt.input).Tokenize()
+			if got := describe(tokens); got != tt.tokens {
+				t.Errorf("tokens\n got: %s\nwant: %s", got, tt.tokens)
+			}
+			if len(diags) != len(tt.messages) {
+				t.Fatalf("got %d diagnostics, want %d:\n%v", len(diags), len(tt.messages), diags)
+			}
+			for i, d := range diags {
+				if d.Severity != SeverityError || d.Message != tt.messages[i] || d.Span.Start != tt.starts[i] {
+					t.Errorf("diagnostic %d = %s %q at %+v, want error %q at %+v",
+						i, d.Severity, d.Message, d.Span.Start, tt.messages[i], tt.starts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLexerSlash(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"regex after MATCHES", `FILTER q MATCHES /^\d+$/`, `keyword:FILTER identifier:q keyword:MATCHES regular expression:^\d+$`},
+		{"escaped slash in regex", `MATCHES /a\/b/`, "keyword:MATCHES regular expression:a/b"},
+		{"escaped character in regex", `MATCHES /a\\/`, `keyword:MATCHES regular expression:a\\`},
+		{"regex after operator", "q = /x/", "identifier:q operator:= regular expression:x"},
+		{"regex after opening bracket", "[/a/]", "punctuation:[ regular expression:a punctuation:]"},
+		{"division after identifier", "words / 2", "identifier:words operator:/ number:2"},
+		{"division after number", "10 / 4", "number:10 operator:/ number:4"},
+		{"division after string", `"a" / 2`, "string:a operator:/ number:2"},
+		{"division after closing parenthesis", "(a) / 2", "punctuation:( identifier:a punctuation:) operator:/ number:2"},
+		{"division after closing bracket", "x[0] / 2", "identifier:x punctuation:[ number:0 punctuation:] operator:/ number:2"},
+		{"slash inside a word", "words/2", "identifier:words/2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describe(tokenize(t, tt.input)); got != tt.want {
+				t.Errorf("Tokenize(%q)\n got: %s\nwant: %s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexerNumbers(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"integer", "LIMIT 10", "keyword:LIMIT number:10"},
+		{"negative integer", "LIMIT -5", "keyword:LIMIT number:-5"},
+		{"negative float", "TEMPERATURE -0.5", "keyword:TEMPERATURE number:-0.5"},
+		{"exponent", "1e-3 2E5", "number:1e-3 number:2E5"},
+		{"negative after operator", "x = -2", "identifier:x operator:= number:-2"},
+		{"negative in list", "[-1, 2]", "punctuation:[ number:-1 punctuation:, number:2 punctuation:]"},
+		{"minus after identifier", "length -1", "identifier:length operator:- number:1"},
+		{"minus after number", "3 -1", "number:3 operator:- number:1"},
+		{"minus before identifier", "-foo", "operator:- identifier:foo"},
+		{"dash inside a word", "n-1", "identifier:n-1"},
+		{"version-like word", "1.2.3", "identifier:1.2.3"},
+		{"trailing dot", "1.", "identifier:1."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describe(tokenize(t, tt.input)); got != tt.want {
+				t.Errorf("Tokenize(%q)\n got: %s\nwant: %s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,55 +3,213 @@ package dsl
 import (
 	"errors"
 	"fmt"
-	"regexp"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 // Parser represents a DSL parser
 type Parser struct {
-	input     string
-	tokens    []string
-	position  int
-	keywords  map[string]bool
-	operators map[string]bool
-	debug     bool
+	input       string
+	tokens      []Token
+	position    int
+	diagnostics Diagnostics // Syntax errors collected during parsing
+	debug       bool
+}
+
+// statementKeywords are the keywords that can start a statement; the parser resynchronizes on them after an error
+var statementKeywords = map[string]bool{
+	"FROM":      true,
+	"WITH":      true,
+	"FIELDS":    true,
+	"USING":     true,
+	"FILTER":    true,
+	"MERGE":     true,
+	"JOIN":      true,
+	"SAVE":      true,
+	"GENERATE":  true,
+	"PROMPT":    true,
+	"PRAGMA":    true,
+	"SYSTEM":    true,
+	"USER":      true,
+	"FORMAT":    true,
+	"CONFIG":    true,
+	"SPLIT":     true,
+	"REVISION":  true,
+	"RENAME":    true,
+	"DROP":      true,
+	"CAST":      true,
+	"SET":       true,
+	"LIMIT":     true,
+	"SAMPLE":    true,
+	"SHUFFLE":   true,
+	"SORT":      true,
+	"DEDUP":     true,
+	"AGGREGATE": true,
+}
+
+// usingParameters are the parameters allowed in a USING block
+var usingParameters = map[string]bool{
+	"MODEL":   true,
+	"KEY":     true,
+	"URL":     true,
+	"RETRIES": true,
+	"TIMEOUT": true,
+	"RPM":     true,
+	"TPM":     true,
+}
+
+// generateParameters are the parameters allowed in a GENERATE block
+var generateParameters = map[string]bool{
+	"MODEL":        true,
+	"TEMPERATURE":  true,
+	"TOKENS":       true,
+	"PROMPT":       true,
+	"ON_ERROR":     true,
+	"ERROR_COLUMN": true,
+}
+
+// errorPolicies are the ways GENERATE can handle records whose generation failed
+var errorPolicies = map[string]bool{
+	"keep": true, // The record is kept with an empty target field
+	"skip": true, // The record is dropped
+	"fail": true, // The script stops
+}
+
+// joinModes are the kinds of JOIN by their keywords
+var joinModes = map[string]string{
+	"INNER": "inner",
+	"LEFT":  "left",
+	"OUTER": "outer",
+}
+
+// mergeParameters are the parameters allowed in a MERGE block
+var mergeParameters = map[string]bool{
+	"ALIGN":  true,
+	"MAP":    true,
+	"SOURCE": true,
+}
+
+// alignModes are the ways MERGE can align the columns of the datasets
+var alignModes = map[string]bool{
+	"strict":       true, // All datasets must have the same columns
+	"intersection": true, // Only the columns all datasets have are kept
+	"union":        true, // All columns are kept, empty where a dataset does not have them
+}
+
+// castTypes maps the types of CAST to the types of dataset columns
+var castTypes = map[string]string{
+	"int":    "int64",
+	"float":  "float64",
+	"string": "string",
+	"bool":   "bool",
+}
+
+// normalizations are the ways DEDUP can normalize text before comparing it
+var normalizations = map[string]bool{
+	"case":        true,
+	"whitespace":  true,
+	"punctuation": true,
+}
+
+// aggregateFunctions are the functions of AGGREGATE with their minimum and maximum number of arguments
+var aggregateFunctions = map[string][2]int{
+	"count":    {0, 1},
+	"sum":      {1, 1},
+	"avg":      {1, 1},
+	"min":      {1, 1},
+	"max":      {1, 1},
+	"median":   {1, 1},
+	"distinct": {1, 1},
+}
+
+// valueFunctions are the functions of SET expressions with their minimum and maximum number of arguments;
+// -1 means any number
+var valueFunctions = map[string][2]int{
+	"length":   {1, 1},
+	"words":    {1, 1},
+	"tokens":   {1, 1},
+	"lines":    {1, 1},
+	"lower":    {1, 1},
+	"upper":    {1, 1},
+	"strip":    {1, 1},
+	"replace":  {3, 3},
+	"join":     {1, 2},
+	"round":    {1, 2},
+	"abs":      {1, 1},
+	"int":      {1, 1},
+	"float":    {1, 1},
+	"string":   {1, 1},
+	"bool":     {1, 1},
+	"coalesce": {1, -1},
+}
+
+// saveParameters are the parameters allowed in a SAVE block
+var saveParameters = map[string]bool{
+	"FORMAT":      true,
+	"COMPRESSION": true,
+	"SHARD":       true,
+}
+
+// matchOperators are the keyword operators of FILTER conditions.
+// Each of them has a case-insensitive variant with the I prefix, such as ICONTAINS.
+var matchOperators = map[string]bool{
+	"CONTAINS":   true,
+	"STARTSWITH": true,
+	"ENDSWITH":   true,
+	"MATCHES":    true,
+	"IN":         true,
+}
+
+// fileFormats are the formats of local data files accepted by FORMAT
+var fileFormats = map[string]bool{
+	"json":    true,
+	"jsonl":   true,
+	"csv":     true,
+	"tsv":     true,
+	"parquet": true,
+	"arrow":   true,
+	"text":    true,
+}
+
+// fileExtensions maps extensions of local data files to their formats
+var fileExtensions = map[string]string{
+	".json":    "json",
+	".jsonl":   "jsonl",
+	".ndjson":  "jsonl",
+	".csv":     "csv",
+	".tsv":     "tsv",
+	".parquet": "parquet",
+	".arrow":   "arrow",
+	".txt":     "text",
+}
+
+// compressionExtensions are the extensions of compressed files, which are removed before detecting the format
+var compressionExtensions = []string{".gz", ".bz2", ".xz", ".zst", ".zip"}
+
+// saveFormats are the formats SAVE can write
+var saveFormats = map[string]bool{
+	"json":    true,
+	"jsonl":   true,
+	"csv":     true,
+	"tsv":     true,
+	"parquet": true,
+	"arrow":   true,
+}
+
+// compressionCodecs maps the compressions SAVE can write to the extensions of compressed files
+var compressionCodecs = map[string]string{
+	"gzip": ".gz",
+	"bz2":  ".bz2",
+	"xz":   ".xz",
+	"zstd": ".zst",
 }
 
 // NewParser creates a new Parser
 func NewParser(input string) *Parser {
 	return &Parser{
 		input: input,
-		keywords: map[string]bool{
-			"FROM":        true,
-			"WITH":        true,
-			"FIELDS":      true,
-			"USING":       true,
-			"FILTER":      true,
-			"MODEL":       true,
-			"KEY":         true,
-			"URL":         true,
-			"MERGE":       true,
-			"SAVE":        true,
-			"GENERATE":    true,
-			"PROMPT":      true,
-			"SYSTEM":      true,
-			"USER":        true,
-			"TOKENS":      true,
-			"TEMPERATURE": true,
-			"PRAGMA":      true,
-			"AUTOSAVE":    true,
-			"CONCURRENCY": true,
-			"STREAM":      true,
-		},
-		operators: map[string]bool{
-			"=":  true,
-			">":  true,
-			"<":  true,
-			">=": true,
-			"<=": true,
-			"!=": true,
-		},
 		debug: false,
 	}
 }
@@ -63,55 +221,37 @@ func (p *Parser) SetDebug(debug bool) {
 
 // Tokenize splits the input string into tokens
 func (p *Parser) Tokenize() error {
-	// Remove comments
-	reComment := regexp.MustCompile(`#.*`)
-	input := reComment.ReplaceAllString(p.input, "")
-
-	// First extract strings in quotes so as not to break their tokenization
-	var stringTokens []string
-	reStrings := regexp.MustCompile(`"[^"]*"`)
-	input = reStrings.ReplaceAllStringFunc(input, func(match string) string {
-		stringTokens = append(stringTokens, match)
-		return fmt.Sprintf("__STR_%d__", len(stringTokens)-1)
-	})
-
-	// Regular expression for tokenization
-	re := regexp.MustCompile(`(?:\s*)(TOKENS|SYSTEM|USER|AS|TO|FROM|WITH|FIELDS|USING|FILTER|MODEL|KEY|URL|CONCURRENCY|STREAM|MERGE|SAVE|GENERATE|PROMPT|TEMPERATURE|\{|\}|=|>=|<=|!=|>|<|;|,|\[|\]|__STR_\d+__|[\w\d\.\/-]+)(?:\s*)`)
-	matches := re.FindAllStringSubmatch(input, -1)
-
-	if matches == nil {
-		return errors.New("tokenization error: no recognizable tokens found")
-	}
-
-	tokens := []string{}
-	for _, match := range matches {
-		token := strings.TrimSpace(match[1])
-		if token != "" {
-			// Restore quoted strings
-			if strings.HasPrefix(token, "__STR_") {
-				index, err := strconv.Atoi(token[6 : len(token)-2])
-				if err == nil && index < len(stringTokens) {
-					token = stringTokens[index]
-				}
-			}
-			tokens = append(tokens, token)
-		}
-	}
+	tokens, diags := NewLexer(p.input).Tokenize()
 
 	// Debug information - output the resulting tokens only in debug mode
 	if p.debug {
-		fmt.Println("Tokens:", strings.Join(tokens, ", "))
+		values := make([]string, 0, len(tokens))
+		for _, token := range tokens {
+			values = append(values, token.String())
+		}
+		fmt.Println("Tokens:", strings.Join(values, ", "))
 	}
 
 	p.tokens = tokens
 	p.position = 0
+
+	if len(diags) > 0 {
+		return diags
+	}
 	return nil
 }
 
-// Parse starts parsing and returns an AST
-func (p *Parser) Parse() (*Program, error) {
+// Parse starts parsing and returns an AST.
+// The parser does not stop at the first syntax error: it resynchronizes at the next
+// statement and returns all diagnostics together with the statements that could be parsed.
+func (p *Parser) Parse() (*Program, Diagnostics) {
+	p.diagnostics = nil
+
 	if err := p.Tokenize(); err != nil {
-		return nil, err
+		var lexical Diagnostics
+		if errors.As(err, &lexical) {
+			p.diagnostics = append(p.diagnostics, lexical...)
+		}
 	}
 
 	program := &Program{
@@ -119,21 +259,94 @@ func (p *Parser) Parse() (*Program, error) {
 	}
 
 	for !p.isEOF() {
-		stmt, err := p.parseStatement()
-		if err != nil {
-			return nil, err
+		// A closing brace without an opening one; after an error this is usually
+		// the end of a block whose beginning could not be parsed
+		if p.atPunct("}") {
+			if len(p.diagnostics) == 0 {
+				p.report(p.errorf(p.peekToken(), "unexpected token: }"))
+			}
+			p.nextToken()
+			continue
+		}
+
+		if p.atPunct(";") {
+			p.nextToken() // Statement separator
+			continue
+		}
+
+		if stmt := p.parseStatementOrRecover(); stmt != nil {
+			program.Statements = append(program.Statements, stmt)
+		}
+	}
+
+	// Lexical and syntax errors are collected separately, report them in source order
+	sort.SliceStable(p.diagnostics, func(i, j int) bool {
+		return p.diagnostics[i].Span.Start.Offset < p.diagnostics[j].Span.Start.Offset
+	})
+
+	return program, p.diagnostics
+}
+
+// parseStatementOrRecover parses a statement; on a syntax error it records the diagnostic,
+// skips to the next statement and returns nil
+func (p *Parser) parseStatementOrRecover() Node {
+	start := p.position
+
+	stmt, err := p.parseStatement()
+	if err != nil {
+		p.report(err)
+		if p.position == start {
+			p.nextToken() // Always make progress
+		}
+		p.synchronize(statementKeywords)
+		return nil
+	}
+
+	return stmt
+}
+
+// synchronize skips tokens until a keyword from stop, a ';' or a '}' of the current nesting level.
+// Nested blocks are skipped entirely.
+func (p *Parser) synchronize(stop map[string]bool) {
+	depth := 0
+	for !p.isEOF() {
+		token := p.peekToken()
+		switch {
+		case token.Is(TokenPunct, "{"):
+			depth++
+		case token.Is(TokenPunct, "}"):
+			if depth == 0 {
+				return
+			}
+			depth--
+		case depth == 0 && token.Is(TokenPunct, ";"):
+			p.nextToken()
+			return
+		case depth == 0 && token.Type == TokenKeyword && stop[token.Value]:
+			return
 		}
-		program.Statements = append(program.Statements, stmt)
+		p.nextToken()
 	}
+}
 
-	return program, nil
+// report records a syntax error, ignoring repeated errors at the same location
+func (p *Parser) report(err error) {
+	d := asDiagnostic(err)
+	if n := len(p.diagnostics); n > 0 && p.diagnostics[n-1].Span.Start == d.Span.Start {
+		return
+	}
+	p.diagnostics = append(p.diagnostics, d)
 }
 
 // parseStatement parses a single statement
 func (p *Parser) parseStatement() (Node, error) {
 	token := p.peekToken()
 
-	switch token {
+	if token.Type != TokenKeyword {
+		return nil, p.errorf(token, "unexpected token: %s", token)
+	}
+
+	switch token.Value {
 	case "FROM":
 		return p.parseFromStatement()
 	case "WITH":
@@ -146,48 +359,104 @@ func (p *Parser) parseStatement() (Node, error) {
 		return p.parseFilterStatement()
 	case "MERGE":
 		return p.parseMergeStatement()
+	case "JOIN":
+		return p.parseJoinStatement()
 	case "SAVE":
 		return p.parseSaveStatement()
 	case "GENERATE":
 		return p.parseGenerateStatement()
 	case "PROMPT":
-		return p.parsePromptStatement("user") // For backward compatibility, PROMPT = USER PROMPT
+		return p.parsePromptStatement("user", token) // For backward compatibility, PROMPT = USER PROMPT
 	case "PRAGMA":
 		return p.parsePragmaStatement()
+	case "FORMAT", "CONFIG", "SPLIT", "REVISION":
+		return p.parseLoadOption()
+	case "RENAME":
+		return p.parseRenameStatement()
+	case "DROP":
+		return p.parseDropStatement()
+	case "CAST":
+		return p.parseCastStatement()
+	case "SET":
+		return p.parseSetStatement()
+	case "LIMIT":
+		return p.parseLimitStatement()
+	case "SAMPLE":
+		return p.parseSampleStatement()
+	case "SHUFFLE":
+		return p.parseShuffleStatement()
+	case "SORT":
+		return p.parseSortStatement()
+	case "DEDUP":
+		return p.parseDedupStatement()
+	case "AGGREGATE":
+		return p.parseAggregateStatement()
 	case "SYSTEM":
 		// Check if this is the beginning of SYSTEM PROMPT
 		p.nextToken() // Skip SYSTEM
-		if p.peekToken() == "PROMPT" {
+		if p.atKeyword("PROMPT") {
 			p.nextToken() // Skip PROMPT
-			return p.parsePromptStatement("system")
+			return p.parsePromptStatement("system", token)
 		}
-		return nil, fmt.Errorf("expected PROMPT after SYSTEM, got: %s", p.peekToken())
+		return nil, p.errorWithHint(p.peekToken(), "write SYSTEM PROMPT <name> { \"...\" }",
+			"expected PROMPT after SYSTEM, got: %s", p.peekToken())
 	case "USER":
 		// Check if this is the beginning of USER PROMPT
 		p.nextToken() // Skip USER
-		if p.peekToken() == "PROMPT" {
+		if p.atKeyword("PROMPT") {
 			p.nextToken() // Skip PROMPT
-			return p.parsePromptStatement("user")
+			return p.parsePromptStatement("user", token)
 		}
-		return nil, fmt.Errorf("expected PROMPT after USER, got: %s", p.peekToken())
+		return nil, p.errorWithHint(p.peekToken(), "write USER PROMPT <name> { \"...\" }",
+			"expected PROMPT after USER, got: %s", p.peekToken())
 	default:
-		return nil, fmt.Errorf("unexpected token: %s", token)
+		return nil, p.errorf(token, "unexpected token: %s", token)
 	}
 }
 
 // parseFromStatement parses FROM statement
 func (p *Parser) parseFromStatement() (Node, error) {
-	p.nextToken() // Skip FROM
+	start := p.nextToken() // Skip FROM
+
+	// file("path") and disk("path") select the source explicitly
+	source := ""
+	if call := p.peekToken(); call.Type == TokenIdent && p.peekTokenAt(1).Is(TokenPunct, "(") {
+		source = strings.ToLower(call.Value)
+		if source != "file" && source != "disk" {
+			return nil, p.errorWithHint(call, "use file(\"path\") for a data file or disk(\"path\") for a dataset saved with SAVE",
+				"unknown dataset source: %s", call.Value)
+		}
+		p.nextToken() // Skip file or disk
+		p.nextToken() // Skip (
+	}
 
-	if p.isEOF() {
-		return nil, errors.New("expected dataset name after FROM")
+	dataset, err := p.parseName("dataset name after FROM")
+	if err != nil {
+		return nil, err
+	}
+
+	if source != "" {
+		if !p.atPunct(")") {
+			return nil, p.errorf(p.peekToken(), "expected ) after the path, got: %s", p.peekToken())
+		}
+		p.nextToken() // Skip )
+	} else if isLocalPath(dataset) {
+		source = "file"
+	} else {
+		source = "hub"
 	}
 
-	dataset := p.nextToken()
+	alias := ""
+	if p.atKeyword("AS") {
+		p.nextToken() // Skip AS
+		alias, err = p.parseName("dataset name after AS")
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	var block *Block
-	if p.peekToken() == "{" {
-		var err error
+	if p.atPunct("{") {
 		block, err = p.parseBlock()
 		if err != nil {
 			return nil, err
@@ -196,40 +465,66 @@ func (p *Parser) parseFromStatement() (Node, error) {
 
 	return &FromStatement{
 		Dataset: dataset,
+		Source:  source,
+		Alias:   alias,
 		Block:   block,
+		Span:    p.spanFrom(start),
+	}, nil
+}
+
+// parseLoadOption parses an option of loading the dataset:
+// FORMAT <format>, CONFIG <name>, REVISION <commit> or SPLIT <split> | [<split>, ...]
+func (p *Parser) parseLoadOption() (Node, error) {
+	start := p.nextToken() // Skip the option name
+
+	var values []string
+	var err error
+	if start.Value == "SPLIT" {
+		values, err = p.parseNameList("split name")
+	} else {
+		var value string
+		value, err = p.parseName("value after " + start.Value)
+		values = []string{value}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoadOptionStatement{
+		Type:   start.Value,
+		Values: values,
+		Span:   p.spanFrom(start),
 	}, nil
 }
 
 // parseWithStatement parses WITH statement
 func (p *Parser) parseWithStatement() (Node, error) {
-	p.nextToken() // Skip WITH
+	start := p.nextToken() // Skip WITH
 
 	if p.isEOF() {
-		return nil, errors.New("expected setting type after WITH")
+		return nil, p.errorf(p.peekToken(), "expected setting type after WITH")
 	}
 
-	withType := p.nextToken()
+	withToken := p.nextToken()
+	withType := withToken.Value
 
-	var value interface{}
+	var value *Literal
 	var block *Block
 
-	if withType == "CONCURRENCY" {
-		if p.isEOF() {
-			return nil, errors.New("expected value after WITH CONCURRENCY")
-		}
-
-		concurrency, err := strconv.Atoi(p.nextToken())
+	if withToken.Is(TokenKeyword, "CONCURRENCY") {
+		concurrency, err := p.parseInt("WITH CONCURRENCY")
 		if err != nil {
-			return nil, fmt.Errorf("incorrect concurrency value: %v", err)
+			return nil, err
 		}
 		value = concurrency
-	} else if withType == "STREAM" {
-		value = true
+	} else if withToken.Is(TokenKeyword, "STREAM") {
+		value = p.parseFlag(withToken)
 	} else {
-		return nil, fmt.Errorf("unknown WITH type: %s", withType)
+		return nil, p.errorWithHint(withToken, "supported settings are CONCURRENCY <number> and STREAM",
+			"unknown WITH type: %s", withToken)
 	}
 
-	if p.peekToken() == "{" {
+	if p.atPunct("{") {
 		var err error
 		block, err = p.parseBlock()
 		if err != nil {
@@ -241,545 +536,1738 @@ func (p *Parser) parseWithStatement() (Node, error) {
 		Type:  withType,
 		Value: value,
 		Block: block,
+		Span:  p.spanFrom(start),
 	}, nil
 }
 
 // parseFieldsStatement parses FIELDS statement
 func (p *Parser) parseFieldsStatement() (Node, error) {
-	p.nextToken() // Skip FIELDS
-
-	fields := []string{}
-
-	// If the next token is an opening brace, then it's a field list
-	if p.peekToken() == "[" {
-		p.nextToken() // Skip [
-
-		for p.peekToken() != "]" {
-			if p.isEOF() {
-				return nil, errors.New("expected closing brace ]")
-			}
+	start := p.nextToken() // Skip FIELDS
 
-			field := p.nextToken()
-			fields = append(fields, stripQuotes(field))
-
-			if p.peekToken() == "," {
-				p.nextToken() // Skip comma
-			}
-		}
-
-		p.nextToken() // Skip ]
-	} else {
-		// Otherwise it's a single field
-		field := p.nextToken()
-		fields = append(fields, stripQuotes(field))
+	fields, err := p.parseNameList("field name")
+	if err != nil {
+		return nil, err
 	}
 
 	return &FieldsStatement{
 		Fields: fields,
+		Span:   p.spanFrom(start),
 	}, nil
 }
 
 // parseUsingStatement parses USING statement
 func (p *Parser) parseUsingStatement() (Node, error) {
-	p.nextToken() // Skip USING
+	start := p.nextToken() // Skip USING
 
-	if p.peekToken() == "{" {
+	if p.atPunct("{") {
 		// USING block
-		p.nextToken() // Skip {
+		open := p.nextToken() // Skip {
 
 		block := &UsingBlock{
 			Statements: []UsingStatement{},
 		}
 
-		for p.peekToken() != "}" {
-			if p.isEOF() {
-				return nil, errors.New("expected closing brace }")
-			}
-
-			usingType := p.nextToken()
-			if usingType != "MODEL" && usingType != "KEY" && usingType != "URL" {
-				return nil, fmt.Errorf("expected USING type (MODEL, KEY, URL), got: %s", usingType)
+		p.parseParameterBlock(open, usingParameters, func() error {
+			stmt, err := p.parseUsingParameter()
+			if err != nil {
+				return err
 			}
+			block.Statements = append(block.Statements, *stmt)
+			return nil
+		})
 
-			value := p.nextToken()
-
-			block.Statements = append(block.Statements, UsingStatement{
-				Type:  usingType,
-				Value: stripQuotes(value),
-			})
-		}
-
-		p.nextToken() // Skip }
-
+		block.Span = p.spanFrom(start)
 		return block, nil
 	} else {
 		// Single USING
-		usingType := p.nextToken()
+		stmt, err := p.parseUsingParameter()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Span = p.spanFrom(start)
+		return stmt, nil
+	}
+}
 
-		if p.isEOF() {
-			return nil, errors.New("expected value after USING type")
+// parseUsingParameter parses a single USING parameter: MODEL, KEY, URL, RETRIES, TIMEOUT, RPM or TPM with its value
+func (p *Parser) parseUsingParameter() (*UsingStatement, error) {
+	usingToken := p.peekToken()
+	if !p.isUsingType(usingToken) {
+		return nil, p.errorf(usingToken, "expected USING type (MODEL, KEY, URL, RETRIES, TIMEOUT, RPM, TPM), got: %s", usingToken)
+	}
+	p.nextToken()
+
+	stmt := &UsingStatement{Type: usingToken.Value}
+	switch usingToken.Value {
+	case "RETRIES", "RPM", "TPM":
+		number, err := p.parseInt("USING " + usingToken.Value)
+		if err != nil {
+			return nil, err
 		}
+		stmt.Number = number
 
-		value := p.nextToken()
+	case "TIMEOUT":
+		token := p.peekToken()
+		number, err := p.parseLiteral("value for TIMEOUT")
+		if err != nil {
+			return nil, err
+		}
+		switch number.Kind {
+		case LiteralInt:
+			number = &Literal{Kind: LiteralFloat, Value: float64(number.Value.(int)), Span: number.Span}
+		case LiteralFloat:
+		default:
+			return nil, p.errorf(token, "expected number of seconds for TIMEOUT, got %s %s", number.Kind, number)
+		}
+		stmt.Number = number
 
-		return &UsingStatement{
-			Type:  usingType,
-			Value: stripQuotes(value),
-		}, nil
+	default:
+		value, err := p.parseName("value after " + usingToken.Value)
+		if err != nil {
+			return nil, err
+		}
+		stmt.Value = value
 	}
+
+	stmt.Span = p.spanFrom(usingToken)
+	return stmt, nil
 }
 
 // parseFilterStatement parses FILTER statement
 func (p *Parser) parseFilterStatement() (Node, error) {
-	p.nextToken() // Skip FILTER
-
-	if p.isEOF() {
-		return nil, errors.New("expected field after FILTER")
-	}
+	start := p.nextToken() // Skip FILTER
 
-	field := p.nextToken()
-
-	if p.peekToken() == "{" {
-		// FILTER block
-		p.nextToken() // Skip {
+	// FILTER field { conditions } - conditions on the attributes of a field
+	mark := p.position
+	if field, err := p.parseFieldPath("field after FILTER"); err == nil && p.atPunct("{") {
+		open := p.nextToken() // Skip {
 
 		block := &FilterBlock{
 			Field:      field,
-			Conditions: []FilterStatement{},
+			Conditions: []Expr{},
 		}
 
-		for p.peekToken() != "}" {
-			if p.isEOF() {
-				return nil, errors.New("expected closing brace }")
+		p.parseParameterBlock(open, nil, func() error {
+			condition, err := p.parseExpr()
+			if err != nil {
+				return err
 			}
+			block.Conditions = append(block.Conditions, condition)
+			return nil
+		})
 
-			subField := p.nextToken()
+		block.Span = p.spanFrom(start)
+		return block, nil
+	}
+	p.position = mark // Not a block, parse the field again as part of the expression
 
-			if p.isEOF() {
-				return nil, fmt.Errorf("expected operator after %s", subField)
-			}
+	// Single FILTER with a boolean expression
+	condition, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
 
-			operator := p.nextToken()
-			if !p.isOperator(operator) {
-				return nil, fmt.Errorf("expected operator (=, >, <, >=, <=, !=), got: %s", operator)
-			}
+	return &FilterStatement{
+		Condition: condition,
+		Span:      p.spanFrom(start),
+	}, nil
+}
 
-			if p.isEOF() {
-				return nil, fmt.Errorf("expected value after %s", operator)
-			}
+// parseExpr parses a boolean filter expression:
+//
+//	expr       = and { OR and }
+//	and        = unary { AND unary }
+//	unary      = NOT unary | primary
+//	primary    = "(" expr ")" | comparison
+//	comparison = path [ operator value | [ NOT ] match value | IS [ NOT ] NULL ]
+//	path       = name { "." name | "[" index "]" }
+func (p *Parser) parseExpr() (Expr, error) {
+	left, err := p.parseAndExpr()
+	if err != nil {
+		return nil, err
+	}
 
-			valueStr := p.nextToken()
-			var value interface{} = stripQuotes(valueStr)
+	for p.atKeyword("OR") {
+		p.nextToken() // Skip OR
+		right, err := p.parseAndExpr()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{
+			Operator: "OR",
+			Left:     left,
+			Right:    right,
+			Span:     Span{Start: left.GetSpan().Start, End: right.GetSpan().End},
+		}
+	}
 
-			// Try to convert to number
-			if num, err := strconv.Atoi(valueStr); err == nil {
-				value = num
-			}
+	return left, nil
+}
 
-			block.Conditions = append(block.Conditions, FilterStatement{
-				Field:    subField,
-				Operator: operator,
-				Value:    value,
-			})
+// parseAndExpr parses operands joined by AND
+func (p *Parser) parseAndExpr() (Expr, error) {
+	left, err := p.parseUnaryExpr()
+	if err != nil {
+		return nil, err
+	}
 
-			if p.peekToken() == ";" {
-				p.nextToken() // Skip ;
-			}
+	for p.atKeyword("AND") {
+		p.nextToken() // Skip AND
+		right, err := p.parseUnaryExpr()
+		if err != nil {
+			return nil, err
 		}
+		left = &BinaryExpr{
+			Operator: "AND",
+			Left:     left,
+			Right:    right,
+			Span:     Span{Start: left.GetSpan().Start, End: right.GetSpan().End},
+		}
+	}
 
-		p.nextToken() // Skip }
+	return left, nil
+}
 
-		return block, nil
-	} else {
-		// Single FILTER
-		operator := p.nextToken()
-		if !p.isOperator(operator) {
-			return nil, fmt.Errorf("expected operator (=, >, <, >=, <=, !=), got: %s", operator)
+// parseUnaryExpr parses a negation, an expression in parentheses or a comparison
+func (p *Parser) parseUnaryExpr() (Expr, error) {
+	if p.atKeyword("NOT") {
+		start := p.nextToken() // Skip NOT
+		operand, err := p.parseUnaryExpr()
+		if err != nil {
+			return nil, err
 		}
+		return &NotExpr{
+			Operand: operand,
+			Span:    p.spanFrom(start),
+		}, nil
+	}
 
-		if p.isEOF() {
-			return nil, fmt.Errorf("expected value after %s", operator)
+	if p.atPunct("(") {
+		open := p.nextToken() // Skip (
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
 		}
+		if !p.atPunct(")") {
+			return nil, p.unclosedError(open, ")")
+		}
+		p.nextToken() // Skip )
+		return expr, nil
+	}
 
-		valueStr := p.nextToken()
-		var value interface{} = stripQuotes(valueStr)
+	start := p.peekToken()
+	field, err := p.parseFieldPath("field in FILTER condition")
+	if err != nil {
+		return nil, err
+	}
 
-		// Try to convert to number
-		if num, err := strconv.Atoi(valueStr); err == nil {
-			value = num
+	// Check for a missing value
+	if p.atKeyword("IS") {
+		p.nextToken() // Skip IS
+		negated := false
+		if p.atKeyword("NOT") {
+			p.nextToken() // Skip NOT
+			negated = true
 		}
-
-		return &FilterStatement{
-			Field:    field,
-			Operator: operator,
-			Value:    value,
+		if !p.atKeyword("NULL") {
+			return nil, p.errorWithHint(p.peekToken(), "write IS NULL or IS NOT NULL",
+				"expected NULL after IS, got: %s", p.peekToken())
+		}
+		p.nextToken() // Skip NULL
+		return &IsNullExpr{
+			Field:   field,
+			Negated: negated,
+			Span:    p.spanFrom(start),
 		}, nil
 	}
-}
-
-// parseMergeStatement parses MERGE statement
-func (p *Parser) parseMergeStatement() (Node, error) {
-	p.nextToken() // Skip MERGE
-
-	datasets := []string{}
-
-	// If the next token is an opening brace, then it's a dataset list
-	if p.peekToken() == "[" {
-		p.nextToken() // Skip [
 
-		for p.peekToken() != "]" {
-			if p.isEOF() {
-				return nil, errors.New("expected closing brace ]")
-			}
-
-			dataset := p.nextToken()
-			datasets = append(datasets, stripQuotes(dataset))
+	// Keyword operators, optionally negated: CONTAINS, NOT IN, IMATCHES, ...
+	negated := false
+	if p.atKeyword("NOT") && p.isMatchOperator(p.peekTokenAt(1)) {
+		p.nextToken() // Skip NOT
+		negated = true
+	}
+	if p.isMatchOperator(p.peekToken()) {
+		operatorToken := p.nextToken()
+		operator, ignoreCase := operatorToken.Value, false
+		if !matchOperators[operator] {
+			operator, ignoreCase = operator[1:], true
+		}
 
-			if p.peekToken() == "," {
-				p.nextToken() // Skip comma
-			}
+		value, err := p.parseMatchValue(operator, operatorToken)
+		if err != nil {
+			return nil, err
 		}
 
-		p.nextToken() // Skip ]
-	} else {
-		// Otherwise it's two datasets separated by a comma
-		dataset1 := p.nextToken()
-		datasets = append(datasets, stripQuotes(dataset1))
+		return &ComparisonExpr{
+			Field:      field,
+			Operator:   operator,
+			Value:      value,
+			IgnoreCase: ignoreCase,
+			Negated:    negated,
+			Span:       p.spanFrom(start),
+		}, nil
+	}
 
-		if p.peekToken() == "," {
-			p.nextToken() // Skip comma
-			dataset2 := p.nextToken()
-			datasets = append(datasets, stripQuotes(dataset2))
-		} else {
-			return nil, errors.New("expected comma between datasets in MERGE")
+	// A field without an operator checks that its value is truthy
+	if !p.isOperator(p.peekToken()) {
+		if next := p.peekToken(); next.Type == TokenNumber || next.Type == TokenString || next.Type == TokenIdent || next.Type == TokenRegex {
+			return nil, p.errorf(next, "expected operator (=, >, <, >=, <=, !=, CONTAINS, IN, ...) after %s, got: %s", field, next)
 		}
+		return &FieldExpr{
+			Field: field,
+			Span:  p.spanFrom(start),
+		}, nil
 	}
 
-	if len(datasets) < 2 {
-		return nil, errors.New("at least two datasets are required for MERGE")
+	operator, value, err := p.parseComparison(field)
+	if err != nil {
+		return nil, err
 	}
 
-	return &DatasetMergeStatement{
-		Datasets: datasets,
+	return &ComparisonExpr{
+		Field:    field,
+		Operator: operator,
+		Value:    value,
+		Span:     p.spanFrom(start),
 	}, nil
 }
 
-// parseSaveStatement parses SAVE statement
-func (p *Parser) parseSaveStatement() (Node, error) {
-	p.nextToken() // Skip SAVE
-
-	if p.isEOF() {
-		return nil, errors.New("expected filename after SAVE")
+// parseFieldPath parses a path to a field, such as answers.text[0].
+// Dots in a bare word separate keys, while a quoted name is always a single key.
+func (p *Parser) parseFieldPath(what string) (FieldPath, error) {
+	path, err := p.parsePathKeys(what)
+	if err != nil {
+		return nil, err
 	}
 
-	filename := p.nextToken()
+	for {
+		switch {
+		case p.atPunct("["):
+			open := p.nextToken() // Skip [
+			indexToken := p.peekToken()
+			index, err := strconv.Atoi(indexToken.Value)
+			if indexToken.Type != TokenNumber || err != nil {
+				return nil, p.errorf(indexToken, "expected integer list index, got: %s", indexToken)
+			}
+			p.nextToken()
+			if !p.atPunct("]") {
+				return nil, p.unclosedError(open, "]")
+			}
+			p.nextToken() // Skip ]
+			path = append(path, PathElement{Index: index})
+
+		case p.atPunct("."):
+			p.nextToken() // Skip .
+			keys, err := p.parsePathKeys("key after '.'")
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, keys...)
 
-	return &SaveStatement{
-		Filename: stripQuotes(filename),
-	}, nil
+		default:
+			return path, nil
+		}
+	}
 }
 
-// parseBlock parses a block of code in curly braces
-func (p *Parser) parseBlock() (*Block, error) {
-	p.nextToken() // Skip {
-
-	block := &Block{
-		Statements: []Node{},
+// parsePathKeys parses a name of a field path, splitting a bare word like final_answer.length into keys
+func (p *Parser) parsePathKeys(what string) (FieldPath, error) {
+	token := p.peekToken()
+	name, err := p.parseName(what)
+	if err != nil {
+		return nil, err
 	}
 
-	for p.peekToken() != "}" {
-		if p.isEOF() {
-			return nil, errors.New("expected closing brace }")
-		}
+	if token.Type != TokenIdent {
+		return FieldPath{{Key: name}}, nil
+	}
 
-		stmt, err := p.parseStatement()
-		if err != nil {
-			return nil, err
+	path := FieldPath{}
+	for _, key := range strings.Split(name, ".") {
+		if key == "" {
+			return nil, p.errorWithHint(token, "put a name with dots in quotes to use it as a single key",
+				"empty key in field path %s", name)
 		}
-
-		block.Statements = append(block.Statements, stmt)
+		path = append(path, PathElement{Key: key})
 	}
-
-	p.nextToken() // Skip }
-
-	return block, nil
+	return path, nil
 }
 
-// parseGenerateStatement parses GENERATE statement
-func (p *Parser) parseGenerateStatement() (Node, error) {
-	p.nextToken() // Skip GENERATE
-
-	// Check GENERATE format sourceField AS targetField
+// parseComparison parses the operator and value of a filter condition
+func (p *Parser) parseComparison(field FieldPath) (string, *Literal, error) {
 	if p.isEOF() {
-		return nil, errors.New("expected source field after GENERATE")
+		return "", nil, p.errorf(p.peekToken(), "expected operator after %s", field)
 	}
 
-	sourceField := p.nextToken()
-
-	// Expect keyword AS or TO
-	if p.isEOF() || (p.peekToken() != "AS" && p.peekToken() != "TO") {
-		return nil, fmt.Errorf("expected 'AS' or 'TO' after source field, got: %s", p.peekToken())
+	operatorToken := p.peekToken()
+	if !p.isOperator(operatorToken) {
+		return "", nil, p.errorf(operatorToken, "expected operator (=, >, <, >=, <=, !=), got: %s", operatorToken)
 	}
+	p.nextToken()
 
-	p.nextToken() // Skip AS or TO
-
-	if p.isEOF() {
-		return nil, errors.New("expected target field after AS/TO")
+	value, err := p.parseLiteral("value after " + operatorToken.Value)
+	if err != nil {
+		return "", nil, err
 	}
 
-	targetField := p.nextToken()
+	return operatorToken.Value, value, nil
+}
 
-	// Create base instance with mandatory fields
-	generateStmt := &GenerateStatement{
-		SourceField: stripQuotes(sourceField),
-		TargetField: stripQuotes(targetField),
-		Temperature: 0.7,  // Default value
-		Tokens:      1024, // Default value
-	}
+// parseMatchValue parses the value of a keyword operator of a filter condition
+func (p *Parser) parseMatchValue(operator string, operatorToken Token) (*Literal, error) {
+	token := p.peekToken()
 
-	// If the next token is a block with parameters
-	if p.peekToken() == "{" {
-		p.nextToken() // Skip {
+	switch operator {
+	case "IN":
+		if !p.atPunct("[") {
+			return nil, p.errorWithHint(token, "write the values in square brackets: [\"a\", \"b\"]",
+				"expected list of values after %s, got: %s", operatorToken.Value, token)
+		}
+		return p.parseLiteral("list of values after " + operatorToken.Value)
 
-		// Parse block parameters
-		for p.peekToken() != "}" {
-			if p.isEOF() {
-				return nil, errors.New("expected closing brace }")
+	case "MATCHES":
+		if token.Type != TokenRegex && token.Type != TokenString {
+			return nil, p.errorWithHint(token, "write the pattern in slashes: /^[0-9]+$/",
+				"expected regular expression after %s, got: %s", operatorToken.Value, token)
+		}
+		p.nextToken()
+		return &Literal{Kind: LiteralString, Value: token.Value, Span: tokenSpan(token)}, nil
+
+	case "STARTSWITH", "ENDSWITH":
+		value, err := p.parseLiteral("value after " + operatorToken.Value)
+		if err != nil {
+			return nil, err
+		}
+		if value.Kind != LiteralString {
+			return nil, p.errorWithHint(token, fmt.Sprintf("put the value in quotes: \"%s\"", token.Value),
+				"expected string after %s, got %s %s", operatorToken.Value, value.Kind, value)
+		}
+		return value, nil
+
+	default:
+		return p.parseLiteral("value after " + operatorToken.Value)
+	}
+}
+
+// parseLiteral parses a constant value: a string, an integer, a float, true, false, null
+// or a list of values in square brackets. A bare word is a string.
+func (p *Parser) parseLiteral(what string) (*Literal, error) {
+	token := p.peekToken()
+
+	switch {
+	case token.Is(TokenPunct, "["):
+		return p.parseListLiteral(what)
+
+	case token.Type == TokenString:
+		p.nextToken()
+		return &Literal{Kind: LiteralString, Value: token.Value, Span: tokenSpan(token)}, nil
+
+	case token.Type == TokenNumber:
+		p.nextToken()
+		if value, err := strconv.Atoi(token.Value); err == nil {
+			return &Literal{Kind: LiteralInt, Value: value, Span: tokenSpan(token)}, nil
+		}
+		value, err := strconv.ParseFloat(token.Value, 64)
+		if err != nil {
+			return nil, p.errorf(token, "invalid number: %s", token)
+		}
+		return &Literal{Kind: LiteralFloat, Value: value, Span: tokenSpan(token)}, nil
+
+	case token.Is(TokenKeyword, "NULL"):
+		p.nextToken()
+		return &Literal{Kind: LiteralNull, Span: tokenSpan(token)}, nil
+
+	case token.Type == TokenIdent:
+		p.nextToken()
+		switch strings.ToLower(token.Value) {
+		case "true", "false":
+			return &Literal{Kind: LiteralBool, Value: strings.ToLower(token.Value) == "true", Span: tokenSpan(token)}, nil
+		case "null":
+			return &Literal{Kind: LiteralNull, Span: tokenSpan(token)}, nil
+		default:
+			return &Literal{Kind: LiteralString, Value: token.Value, Span: tokenSpan(token)}, nil
+		}
+
+	default:
+		return nil, p.errorf(token, "expected %s, got: %s", what, token)
+	}
+}
+
+// parseListLiteral parses a list of values in square brackets
+func (p *Parser) parseListLiteral(what string) (*Literal, error) {
+	open := p.nextToken() // Skip [
+
+	items := []*Literal{}
+	for !p.atPunct("]") {
+		if p.isEOF() {
+			return nil, p.unclosedError(open, "]")
+		}
+
+		item, err := p.parseLiteral("value in list")
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+
+		if p.atPunct(",") {
+			p.nextToken() // Skip comma
+		} else if !p.atPunct("]") {
+			return nil, p.errorf(p.peekToken(), "expected comma or ], got: %s", p.peekToken())
+		}
+	}
+
+	p.nextToken() // Skip ]
+
+	return &Literal{Kind: LiteralList, Value: items, Span: p.spanFrom(open)}, nil
+}
+
+// parseFlag parses the optional true or false after a flag setting such as WITH STREAM.
+// A flag without a value is enabled.
+func (p *Parser) parseFlag(flag Token) *Literal {
+	token := p.peekToken()
+	if token.Type == TokenIdent {
+		switch strings.ToLower(token.Value) {
+		case "true", "false":
+			p.nextToken()
+			return &Literal{Kind: LiteralBool, Value: strings.ToLower(token.Value) == "true", Span: tokenSpan(token)}
+		}
+	}
+	return &Literal{Kind: LiteralBool, Value: true, Span: tokenSpan(flag)}
+}
+
+// parseMergeStatement parses MERGE statement
+func (p *Parser) parseMergeStatement() (Node, error) {
+	start := p.nextToken() // Skip MERGE
+
+	datasets := []string{}
+
+	// If the next token is an opening brace, then it's a dataset list
+	if p.atPunct("[") {
+		var err error
+		datasets, err = p.parseNameList("dataset name")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Otherwise it's two datasets separated by a comma
+		dataset1, err := p.parseName("dataset name after MERGE")
+		if err != nil {
+			return nil, err
+		}
+		datasets = append(datasets, dataset1)
+
+		if !p.atPunct(",") {
+			return nil, p.errorf(p.peekToken(), "expected comma between datasets in MERGE")
+		}
+		p.nextToken() // Skip comma
+
+		dataset2, err := p.parseName("dataset name after comma")
+		if err != nil {
+			return nil, err
+		}
+		datasets = append(datasets, dataset2)
+	}
+
+	if len(datasets) < 2 {
+		return nil, p.errorf(start, "at least two datasets are required for MERGE")
+	}
+
+	mergeStmt := &DatasetMergeStatement{
+		Datasets: datasets,
+	}
+
+	if p.atKeyword("AS") {
+		p.nextToken() // Skip AS
+		var err error
+		mergeStmt.Alias, err = p.parseName("dataset name after AS")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// If the next token is a block with parameters
+	if p.atPunct("{") {
+		open := p.nextToken() // Skip {
+
+		p.parseParameterBlock(open, mergeParameters, func() error {
+			return p.parseMergeParameter(mergeStmt)
+		})
+	}
+
+	mergeStmt.Span = p.spanFrom(start)
+	return mergeStmt, nil
+}
+
+// parseMergeParameter parses a single parameter of a MERGE block
+func (p *Parser) parseMergeParameter(mergeStmt *DatasetMergeStatement) error {
+	paramToken := p.nextToken()
+	if paramToken.Type != TokenKeyword || !mergeParameters[paramToken.Value] {
+		return p.errorWithHint(paramToken, "supported parameters are ALIGN, MAP and SOURCE",
+			"unknown MERGE parameter: %s", paramToken)
+	}
+
+	switch paramToken.Value {
+	case "ALIGN":
+		mode, err := p.parseName("mode after ALIGN")
+		if err != nil {
+			return err
+		}
+		mergeStmt.Align = strings.ToLower(mode)
+
+	case "MAP":
+		from, err := p.parseName("column name after MAP")
+		if err != nil {
+			return err
+		}
+		if arrow := p.peekToken(); !arrow.Is(TokenOperator, "->") {
+			return p.errorWithHint(arrow, "write MAP <column> -> <new name>",
+				"expected -> after column name in MAP, got: %s", arrow)
+		}
+		p.nextToken() // Skip ->
+		to, err := p.parseName("new column name after ->")
+		if err != nil {
+			return err
+		}
+		mergeStmt.Mappings = append(mergeStmt.Mappings, ColumnMapping{From: from, To: to, Span: p.spanFrom(paramToken)})
+
+	case "SOURCE":
+		// The column name is optional: SOURCE alone records the dataset in the source column
+		mergeStmt.SourceColumn = "source"
+		if p.isNameToken(p.peekToken()) {
+			mergeStmt.SourceColumn = p.nextToken().Value
+		}
+	}
+
+	return nil
+}
+
+// parseJoinStatement parses JOIN statement: JOIN a, b ON key [INNER|LEFT|OUTER] [AS name]
+func (p *Parser) parseJoinStatement() (Node, error) {
+	start := p.nextToken() // Skip JOIN
+
+	left, err := p.parseName("dataset name after JOIN")
+	if err != nil {
+		return nil, err
+	}
+	if !p.atPunct(",") {
+		return nil, p.errorWithHint(p.peekToken(), "write JOIN <dataset>, <dataset> ON <column>",
+			"expected comma between datasets in JOIN, got: %s", p.peekToken())
+	}
+	p.nextToken() // Skip comma
+
+	right, err := p.parseName("dataset name after comma")
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.atKeyword("ON") {
+		return nil, p.errorWithHint(p.peekToken(), "name the columns to match records on: JOIN a, b ON id",
+			"expected ON after datasets in JOIN, got: %s", p.peekToken())
+	}
+	p.nextToken() // Skip ON
+
+	keys, err := p.parseNameList("column name after ON")
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, p.errorf(start, "at least one column is required after ON")
+	}
+
+	mode := "inner"
+	if token := p.peekToken(); token.Type == TokenKeyword && joinModes[token.Value] != "" {
+		p.nextToken()
+		mode = joinModes[token.Value]
+	}
+
+	alias := ""
+	if p.atKeyword("AS") {
+		p.nextToken() // Skip AS
+		alias, err = p.parseName("dataset name after AS")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &DatasetJoinStatement{
+		Left:  left,
+		Right: right,
+		Keys:  keys,
+		Mode:  mode,
+		Alias: alias,
+		Span:  p.spanFrom(start),
+	}, nil
+}
+
+// parseSaveStatement parses SAVE statement
+func (p *Parser) parseSaveStatement() (Node, error) {
+	start := p.nextToken() // Skip SAVE
+
+	filename, err := p.parseName("filename after SAVE")
+	if err != nil {
+		return nil, err
+	}
+
+	saveStmt := &SaveStatement{
+		Filename: filename,
+	}
+
+	// SAVE <dataset> TO <filename>
+	if p.atKeyword("TO") {
+		p.nextToken() // Skip TO
+		saveStmt.Dataset = filename
+		saveStmt.Filename, err = p.parseName("filename after TO")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// If the next token is a block with parameters
+	if p.atPunct("{") {
+		open := p.nextToken() // Skip {
+
+		p.parseParameterBlock(open, saveParameters, func() error {
+			return p.parseSaveParameter(saveStmt)
+		})
+	}
+
+	saveStmt.Span = p.spanFrom(start)
+	return saveStmt, nil
+}
+
+// parseSaveParameter parses a single parameter of a SAVE block
+func (p *Parser) parseSaveParameter(saveStmt *SaveStatement) error {
+	paramToken := p.nextToken()
+	if paramToken.Type != TokenKeyword || !saveParameters[paramToken.Value] {
+		return p.errorWithHint(paramToken, "supported parameters are FORMAT, COMPRESSION and SHARD",
+			"unknown SAVE parameter: %s", paramToken)
+	}
+
+	switch paramToken.Value {
+	case "FORMAT":
+		format, err := p.parseName("format after FORMAT")
+		if err != nil {
+			return err
+		}
+		saveStmt.Format = strings.ToLower(format)
+
+	case "COMPRESSION":
+		compression, err := p.parseName("compression after COMPRESSION")
+		if err != nil {
+			return err
+		}
+		saveStmt.Compression = strings.ToLower(compression)
+
+	case "SHARD":
+		rows, err := p.parseInt("SHARD")
+		if err != nil {
+			return err
+		}
+		saveStmt.ShardRows = rows
+	}
+
+	return nil
+}
+
+// parseRenameStatement parses RENAME statement: RENAME old -> new
+func (p *Parser) parseRenameStatement() (Node, error) {
+	start := p.nextToken() // Skip RENAME
+
+	from, err := p.parseName("column name after RENAME")
+	if err != nil {
+		return nil, err
+	}
+	if arrow := p.peekToken(); !arrow.Is(TokenOperator, "->") {
+		return nil, p.errorWithHint(arrow, "write RENAME <column> -> <new name>",
+			"expected -> after column name in RENAME, got: %s", arrow)
+	}
+	p.nextToken() // Skip ->
+	to, err := p.parseName("new column name after ->")
+	if err != nil {
+		return nil, err
+	}
+
+	return &RenameStatement{
+		From: from,
+		To:   to,
+		Span: p.spanFrom(start),
+	}, nil
+}
+
+// parseDropStatement parses DROP statement with a column or a list of columns
+func (p *Parser) parseDropStatement() (Node, error) {
+	start := p.nextToken() // Skip DROP
+
+	columns, err := p.parseNameList("column name after DROP")
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, p.errorf(start, "at least one column is required for DROP")
+	}
+
+	return &DropStatement{
+		Columns: columns,
+		Span:    p.spanFrom(start),
+	}, nil
+}
+
+// parseCastStatement parses CAST statement: CAST column AS type
+func (p *Parser) parseCastStatement() (Node, error) {
+	start := p.nextToken() // Skip CAST
+
+	column, err := p.parseName("column name after CAST")
+	if err != nil {
+		return nil, err
+	}
+	if !p.atKeyword("AS") {
+		return nil, p.errorWithHint(p.peekToken(), "write CAST <column> AS int, float, string or bool",
+			"expected AS after column name in CAST, got: %s", p.peekToken())
+	}
+	p.nextToken() // Skip AS
+	typ, err := p.parseName("type after AS")
+	if err != nil {
+		return nil, err
+	}
+
+	return &CastStatement{
+		Column: column,
+		Type:   strings.ToLower(typ),
+		Span:   p.spanFrom(start),
+	}, nil
+}
+
+// parseSetStatement parses SET statement: SET column = expression
+func (p *Parser) parseSetStatement() (Node, error) {
+	start := p.nextToken() // Skip SET
+
+	column, err := p.parseName("column name after SET")
+	if err != nil {
+		return nil, err
+	}
+	if !p.peekToken().Is(TokenOperator, "=") {
+		return nil, p.errorWithHint(p.peekToken(), "write SET <column> = <expression>",
+			"expected = after column name in SET, got: %s", p.peekToken())
+	}
+	p.nextToken() // Skip =
+
+	value, err := p.parseValueExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SetStatement{
+		Column: column,
+		Value:  value,
+		Span:   p.spanFrom(start),
+	}, nil
+}
+
+// parseLimitStatement parses LIMIT statement: LIMIT 100
+func (p *Parser) parseLimitStatement() (Node, error) {
+	start := p.nextToken() // Skip LIMIT
+
+	count, err := p.parseInt("LIMIT")
+	if err != nil {
+		return nil, err
+	}
+
+	return &LimitStatement{
+		Count: count,
+		Span:  p.spanFrom(start),
+	}, nil
+}
+
+// parseSampleStatement parses SAMPLE statement with a number of records or a fraction: SAMPLE 0.1 SEED 42
+func (p *Parser) parseSampleStatement() (Node, error) {
+	start := p.nextToken() // Skip SAMPLE
+
+	token := p.peekToken()
+	size, err := p.parseLiteral("number of records or fraction after SAMPLE")
+	if err != nil {
+		return nil, err
+	}
+	if !size.IsNumber() {
+		return nil, p.errorWithHint(token, "write SAMPLE 100 for a number of records or SAMPLE 0.1 for a fraction",
+			"expected number after SAMPLE, got %s %s", size.Kind, size)
+	}
+	seed, err := p.parseSeed()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SampleStatement{
+		Size: size,
+		Seed: seed,
+		Span: p.spanFrom(start),
+	}, nil
+}
+
+// parseShuffleStatement parses SHUFFLE statement with an optional seed: SHUFFLE SEED 42
+func (p *Parser) parseShuffleStatement() (Node, error) {
+	start := p.nextToken() // Skip SHUFFLE
+
+	seed, err := p.parseSeed()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShuffleStatement{
+		Seed: seed,
+		Span: p.spanFrom(start),
+	}, nil
+}
+
+// parseSeed parses the optional SEED of a random operation
+func (p *Parser) parseSeed() (*Literal, error) {
+	if !p.atKeyword("SEED") {
+		return nil, nil
+	}
+	p.nextToken() // Skip SEED
+	return p.parseInt("SEED")
+}
+
+// parseSortStatement parses SORT BY statement: SORT BY difficulty DESC, id
+func (p *Parser) parseSortStatement() (Node, error) {
+	start := p.nextToken() // Skip SORT
+
+	if !p.atKeyword("BY") {
+		return nil, p.errorWithHint(p.peekToken(), "write SORT BY <field> [ASC|DESC]",
+			"expected BY after SORT, got: %s", p.peekToken())
+	}
+	p.nextToken() // Skip BY
+
+	var keys []SortKey
+	for {
+		field, err := p.parseFieldPath("field name after SORT BY")
+		if err != nil {
+			return nil, err
+		}
+		key := SortKey{Field: field}
+		if p.atKeyword("ASC") || p.atKeyword("DESC") {
+			key.Descending = p.nextToken().Value == "DESC"
+		}
+		keys = append(keys, key)
+
+		if !p.atPunct(",") {
+			break
+		}
+		p.nextToken() // Skip comma
+	}
+
+	return &SortStatement{
+		Keys: keys,
+		Span: p.spanFrom(start),
+	}, nil
+}
+
+// parseDedupStatement parses DEDUP statement:
+// DEDUP BY question [NORMALIZE [case, whitespace]] [FUZZY 0.85] [REMOVED TO "duplicates.jsonl"]
+func (p *Parser) parseDedupStatement() (Node, error) {
+	start := p.nextToken() // Skip DEDUP
+
+	if !p.atKeyword("BY") {
+		return nil, p.errorWithHint(p.peekToken(), "write DEDUP BY <field>",
+			"expected BY after DEDUP, got: %s", p.peekToken())
+	}
+	p.nextToken() // Skip BY
+
+	dedup := &DedupStatement{}
+	for {
+		field, err := p.parseFieldPath("field name after DEDUP BY")
+		if err != nil {
+			return nil, err
+		}
+		dedup.Fields = append(dedup.Fields, field)
+
+		if !p.atPunct(",") {
+			break
+		}
+		p.nextToken() // Skip comma
+	}
+
+	// Options may go in any order, each one at most once
+	seen := make(map[string]bool)
+	for p.atKeyword("NORMALIZE") || p.atKeyword("FUZZY") || p.atKeyword("REMOVED") {
+		option := p.nextToken()
+		if seen[option.Value] {
+			return nil, p.errorf(option, "%s is set twice in DEDUP", option.Value)
+		}
+		seen[option.Value] = true
+
+		switch option.Value {
+		case "NORMALIZE":
+			// NORMALIZE without a list applies all normalizations
+			if token := p.peekToken(); token.Type != TokenIdent && !token.Is(TokenPunct, "[") {
+				dedup.Normalize = sortedKeys(normalizations)
+				continue
+			}
+			names, err := p.parseNameList("normalization after NORMALIZE")
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				dedup.Normalize = append(dedup.Normalize, strings.ToLower(name))
+			}
+
+		case "FUZZY":
+			token := p.peekToken()
+			threshold, err := p.parseLiteral("similarity threshold after FUZZY")
+			if err != nil {
+				return nil, err
+			}
+			if !threshold.IsNumber() {
+				return nil, p.errorWithHint(token, "write FUZZY 0.85 to drop records at least 85% similar to an earlier one",
+					"expected number after FUZZY, got %s %s", threshold.Kind, threshold)
 			}
+			dedup.Threshold = threshold
+
+		case "REMOVED":
+			if !p.atKeyword("TO") {
+				return nil, p.errorWithHint(p.peekToken(), "write REMOVED TO \"duplicates.jsonl\"",
+					"expected TO after REMOVED, got: %s", p.peekToken())
+			}
+			p.nextToken() // Skip TO
+			token := p.peekToken()
+			if token.Type != TokenString {
+				return nil, p.errorf(token, "expected file name in quotes after REMOVED TO, got: %s", token)
+			}
+			p.nextToken()
+			dedup.Removed = &SaveStatement{Filename: token.Value, Span: p.spanFrom(option)}
+		}
+	}
+
+	dedup.Span = p.spanFrom(start)
+	return dedup, nil
+}
+
+// parseAggregateStatement parses AGGREGATE statement:
+// AGGREGATE count(), avg(difficulty) AS mean_difficulty BY source INTO stats
+func (p *Parser) parseAggregateStatement() (Node, error) {
+	start := p.nextToken() // Skip AGGREGATE
+
+	aggregate := &AggregateStatement{}
+	for {
+		item, err := p.parseAggregate()
+		if err != nil {
+			return nil, err
+		}
+		aggregate.Aggregates = append(aggregate.Aggregates, item)
+
+		if !p.atPunct(",") {
+			break
+		}
+		p.nextToken() // Skip comma
+	}
+
+	if p.atKeyword("BY") {
+		p.nextToken() // Skip BY
+		for {
+			column, err := p.parseName("column name after BY")
+			if err != nil {
+				return nil, err
+			}
+			aggregate.By = append(aggregate.By, column)
+
+			if !p.atPunct(",") {
+				break
+			}
+			p.nextToken() // Skip comma
+		}
+	}
+
+	if p.atKeyword("INTO") {
+		p.nextToken() // Skip INTO
+		into, err := p.parseName("dataset name after INTO")
+		if err != nil {
+			return nil, err
+		}
+		aggregate.Into = into
+	}
+
+	aggregate.Span = p.spanFrom(start)
+	return aggregate, nil
+}
+
+// parseAggregate parses an aggregate function call with an optional name of its result: avg(difficulty) AS mean
+func (p *Parser) parseAggregate() (Aggregate, error) {
+	name := p.peekToken()
+	if name.Type != TokenIdent || !p.peekTokenAt(1).Is(TokenPunct, "(") {
+		return Aggregate{}, p.errorWithHint(name, "write a function call such as count() or avg(difficulty)",
+			"expected aggregate function after AGGREGATE, got: %s", name)
+	}
+	p.nextToken()
+	open := p.nextToken() // Skip (
+
+	item := Aggregate{Function: strings.ToLower(name.Value)}
+	for !p.atPunct(")") {
+		if p.isEOF() {
+			return Aggregate{}, p.unclosedError(open, ")")
+		}
+
+		column, err := p.parseName("column name in " + item.Function)
+		if err != nil {
+			return Aggregate{}, err
+		}
+		item.Args = append(item.Args, column)
 
-			paramType := p.nextToken()
-
-			switch paramType {
-			case "MODEL":
-				if p.isEOF() {
-					return nil, errors.New("expected model name after MODEL")
-				}
-				generateStmt.Model = stripQuotes(p.nextToken())
-
-			case "TEMPERATURE":
-				if p.isEOF() {
-					return nil, errors.New("expected value after TEMPERATURE")
-				}
-				tempStr := p.nextToken()
-				tempVal, err := strconv.ParseFloat(tempStr, 64)
-				if err != nil {
-					return nil, fmt.Errorf("expected numeric value for TEMPERATURE, got: %s", tempStr)
-				}
-				generateStmt.Temperature = tempVal
-
-			case "TOKENS":
-				if p.isEOF() {
-					return nil, errors.New("expected value after TOKENS")
-				}
-				tokensStr := p.nextToken()
-				tokensVal, err := strconv.Atoi(tokensStr)
-				if err != nil {
-					return nil, fmt.Errorf("expected integer value for TOKENS, got: %s", tokensStr)
-				}
-				generateStmt.Tokens = tokensVal
-
-			case "PROMPT":
-				if p.isEOF() {
-					return nil, errors.New("expected prompt name after PROMPT")
-				}
-				promptName := stripQuotes(p.nextToken())
-				generateStmt.PromptTemplates = append(generateStmt.PromptTemplates, promptName)
-
-			default:
-				return nil, fmt.Errorf("unknown GENERATE parameter: %s", paramType)
-			}
+		if p.atPunct(",") {
+			p.nextToken() // Skip comma
+		} else if !p.atPunct(")") {
+			return Aggregate{}, p.errorf(p.peekToken(), "expected comma or ) in arguments of %s, got: %s", name.Value, p.peekToken())
+		}
+	}
+	p.nextToken() // Skip )
 
-			// Check for separator
-			if p.peekToken() == ";" {
-				p.nextToken() // Skip ;
-			}
+	if p.atKeyword("AS") {
+		p.nextToken() // Skip AS
+		alias, err := p.parseName("column name after AS")
+		if err != nil {
+			return Aggregate{}, err
 		}
+		item.Alias = alias
+	}
 
-		p.nextToken() // Skip }
+	item.Span = p.spanFrom(name)
+	return item, nil
+}
+
+// parseValueExpr parses an expression computing a value in SET:
+//
+//	value  = term { ( "+" | "-" ) term }
+//	term   = factor { ( "*" | "/" ) factor }
+//	factor = "(" value ")" | call | literal | path
+//	call   = name "(" [ value { "," value } ] ")"
+//
+// A bare word is a field; strings are written in quotes.
+func (p *Parser) parseValueExpr() (ValueExpr, error) {
+	left, err := p.parseValueTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token := p.peekToken()
+		var right ValueExpr
+		switch {
+		case token.Is(TokenOperator, "+"), token.Is(TokenOperator, "-"):
+			p.nextToken()
+			right, err = p.parseValueTerm()
+		default:
+			return left, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		left = &ArithmeticExpr{
+			Operator: token.Value,
+			Left:     left,
+			Right:    right,
+			Span:     Span{Start: left.GetSpan().Start, End: right.GetSpan().End},
+		}
+	}
+}
+
+// parseValueTerm parses operands joined by * or /
+func (p *Parser) parseValueTerm() (ValueExpr, error) {
+	left, err := p.parseValueFactor()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekToken().Is(TokenOperator, "*") || p.peekToken().Is(TokenOperator, "/") {
+		operator := p.nextToken()
+		right, err := p.parseValueFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &ArithmeticExpr{
+			Operator: operator.Value,
+			Left:     left,
+			Right:    right,
+			Span:     Span{Start: left.GetSpan().Start, End: right.GetSpan().End},
+		}
+	}
+
+	return left, nil
+}
+
+// parseValueFactor parses an expression in parentheses, a function call, a constant or a field
+func (p *Parser) parseValueFactor() (ValueExpr, error) {
+	token := p.peekToken()
+
+	switch {
+	case token.Is(TokenPunct, "("):
+		open := p.nextToken() // Skip (
+		value, err := p.parseValueExpr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.atPunct(")") {
+			return nil, p.unclosedError(open, ")")
+		}
+		p.nextToken() // Skip )
+		return value, nil
+
+	case token.Type == TokenIdent && p.peekTokenAt(1).Is(TokenPunct, "("):
+		return p.parseCall()
+
+	case token.Type == TokenString, token.Type == TokenNumber, token.Is(TokenKeyword, "NULL"), token.Is(TokenPunct, "["):
+		return p.parseLiteral("value")
+
+	case token.Type == TokenIdent:
+		switch strings.ToLower(token.Value) {
+		case "true", "false", "null":
+			return p.parseLiteral("value")
+		}
+		field, err := p.parseFieldPath("field")
+		if err != nil {
+			return nil, err
+		}
+		return &FieldRef{Field: field, Span: p.spanFrom(token)}, nil
+
+	default:
+		return nil, p.errorWithHint(token, "write a field, a value in quotes, a number or a function call such as words(question)",
+			"expected value in SET expression, got: %s", token)
+	}
+}
+
+// parseCall parses a function call of a SET expression
+func (p *Parser) parseCall() (ValueExpr, error) {
+	name := p.nextToken()
+	open := p.nextToken() // Skip (
+
+	args := []ValueExpr{}
+	for !p.atPunct(")") {
+		if p.isEOF() {
+			return nil, p.unclosedError(open, ")")
+		}
+
+		arg, err := p.parseValueExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		if p.atPunct(",") {
+			p.nextToken() // Skip comma
+		} else if !p.atPunct(")") {
+			return nil, p.errorf(p.peekToken(), "expected comma or ) in arguments of %s, got: %s", name.Value, p.peekToken())
+		}
+	}
+	p.nextToken() // Skip )
+
+	return &CallExpr{
+		Function: strings.ToLower(name.Value),
+		Args:     args,
+		Span:     p.spanFrom(name),
+	}, nil
+}
+
+// parseBlock parses a block of code in curly braces
+func (p *Parser) parseBlock() (*Block, error) {
+	open := p.nextToken() // Skip {
+
+	block := &Block{
+		Statements: []Node{},
+	}
+
+	for !p.atPunct("}") {
+		if p.isEOF() {
+			p.report(p.unclosedError(open, "}"))
+			block.Span = p.spanFrom(open)
+			return block, nil
+		}
+
+		// Statements on one line may be separated by semicolons
+		if p.atPunct(";") {
+			p.nextToken()
+			continue
+		}
+
+		if stmt := p.parseStatementOrRecover(); stmt != nil {
+			block.Statements = append(block.Statements, stmt)
+		}
+	}
+
+	p.nextToken() // Skip }
+
+	block.Span = p.spanFrom(open)
+	return block, nil
+}
+
+// parseGenerateStatement parses GENERATE statement
+func (p *Parser) parseGenerateStatement() (Node, error) {
+	start := p.nextToken() // Skip GENERATE
+
+	// Check GENERATE format sourceField AS targetField
+	sourceField, err := p.parseName("source field after GENERATE")
+	if err != nil {
+		return nil, err
+	}
+
+	// Expect keyword AS or TO
+	if !p.atKeyword("AS") && !p.atKeyword("TO") {
+		return nil, p.errorf(p.peekToken(), "expected 'AS' or 'TO' after source field, got: %s", p.peekToken())
+	}
+
+	p.nextToken() // Skip AS or TO
+
+	targetField, err := p.parseName("target field after AS/TO")
+	if err != nil {
+		return nil, err
+	}
+
+	// Create base instance with mandatory fields
+	generateStmt := &GenerateStatement{
+		SourceField: sourceField,
+		TargetField: targetField,
+		Temperature: 0.7,  // Default value
+		Tokens:      1024, // Default value
+	}
+
+	// If the next token is a block with parameters
+	if p.atPunct("{") {
+		open := p.nextToken() // Skip {
+
+		// Parse block parameters
+		p.parseParameterBlock(open, generateParameters, func() error {
+			return p.parseGenerateParameter(generateStmt)
+		})
 	}
 
+	generateStmt.Span = p.spanFrom(start)
 	return generateStmt, nil
 }
 
-// parsePromptStatement parses PROMPT statement
-func (p *Parser) parsePromptStatement(promptType string) (Node, error) {
+// parseGenerateParameter parses a single parameter of a GENERATE block
+func (p *Parser) parseGenerateParameter(generateStmt *GenerateStatement) error {
+	paramToken := p.nextToken()
+	if paramToken.Type != TokenKeyword || !generateParameters[paramToken.Value] {
+		return p.errorWithHint(paramToken, "supported parameters are MODEL, TEMPERATURE, TOKENS, PROMPT, ON_ERROR and ERROR_COLUMN",
+			"unknown GENERATE parameter: %s", paramToken)
+	}
+
+	switch paramToken.Value {
+	case "MODEL":
+		model, err := p.parseName("model name after MODEL")
+		if err != nil {
+			return err
+		}
+		generateStmt.Model = model
+
+	case "TEMPERATURE":
+		tempToken := p.peekToken()
+		tempVal, err := p.parseLiteral("value for TEMPERATURE")
+		if err != nil {
+			return err
+		}
+		switch tempVal.Kind {
+		case LiteralInt:
+			generateStmt.Temperature = float64(tempVal.Value.(int))
+		case LiteralFloat:
+			generateStmt.Temperature = tempVal.Value.(float64)
+		default:
+			return p.errorf(tempToken, "expected numeric value for TEMPERATURE, got %s %s", tempVal.Kind, tempVal)
+		}
+
+	case "TOKENS":
+		tokensVal, err := p.parseInt("TOKENS")
+		if err != nil {
+			return err
+		}
+		generateStmt.Tokens = tokensVal.Value.(int)
+
+	case "PROMPT":
+		promptName, err := p.parseName("prompt name after PROMPT")
+		if err != nil {
+			return err
+		}
+		generateStmt.PromptTemplates = append(generateStmt.PromptTemplates, promptName)
+
+	case "ON_ERROR":
+		policy, err := p.parseName("SKIP, KEEP or FAIL after ON_ERROR")
+		if err != nil {
+			return err
+		}
+		generateStmt.OnError = strings.ToLower(policy)
+
+	case "ERROR_COLUMN":
+		generateStmt.ErrorColumn = p.parseFlag(paramToken).Value.(bool)
+	}
+
+	return nil
+}
+
+// parsePromptStatement parses PROMPT statement; start is the first token of the statement
+func (p *Parser) parsePromptStatement(promptType string, start Token) (Node, error) {
 	if promptType == "" {
 		promptType = "user" // Default to user prompt
 	}
 
-	if p.peekToken() == "PROMPT" {
+	if p.atKeyword("PROMPT") {
 		p.nextToken() // Skip PROMPT if not skipped yet
 	}
 
-	if p.isEOF() {
-		return nil, errors.New("expected prompt name after PROMPT")
+	promptName, err := p.parseName("prompt name after PROMPT")
+	if err != nil {
+		return nil, err
 	}
 
-	promptName := p.nextToken()
-
 	// Check if prompt name is followed by block with text or fields
 	var promptTemplate string
 	var fields []string
 
-	if p.peekToken() == "{" {
-		p.nextToken() // Skip {
+	if p.atPunct("{") {
+		open := p.nextToken() // Skip {
 
 		// Check next token - is it FIELDS or text template
-		if p.peekToken() == "FIELDS" {
+		if p.atKeyword("FIELDS") {
 			p.nextToken() // Skip FIELDS
 
-			// If next token is an opening brace, then it's a field list
-			if p.peekToken() == "[" {
-				p.nextToken() // Skip [
-
-				for p.peekToken() != "]" {
-					if p.isEOF() {
-						return nil, errors.New("expected closing brace ]")
-					}
-
-					field := p.nextToken()
-					fields = append(fields, stripQuotes(field))
-
-					if p.peekToken() == "," {
-						p.nextToken() // Skip comma
-					}
-				}
-
-				p.nextToken() // Skip ]
-			} else {
-				// Otherwise it's a single field
-				field := p.nextToken()
-				fields = append(fields, stripQuotes(field))
+			fields, err = p.parseNameList("field name")
+			if err != nil {
+				return nil, err
 			}
 
 			// Expect text template after field list
-			if p.isEOF() || p.peekToken() == "}" {
-				return nil, errors.New("expected text template after field list")
-			}
-
-			// Collect all remaining tokens until } as template
-			templateTokens := []string{}
-			for p.peekToken() != "}" {
-				if p.isEOF() {
-					return nil, errors.New("expected closing brace }")
-				}
-
-				templateTokens = append(templateTokens, p.nextToken())
-			}
-
-			promptTemplate = strings.Join(templateTokens, " ")
-			promptTemplate = stripQuotes(promptTemplate)
-		} else {
-			// Collect all tokens until } as template
-			templateTokens := []string{}
-			for p.peekToken() != "}" {
-				if p.isEOF() {
-					return nil, errors.New("expected closing brace }")
-				}
-
-				templateTokens = append(templateTokens, p.nextToken())
+			if p.isEOF() || p.atPunct("}") {
+				return nil, p.errorf(p.peekToken(), "expected text template after field list")
 			}
+		}
 
-			promptTemplate = strings.Join(templateTokens, " ")
-			promptTemplate = stripQuotes(promptTemplate)
+		promptTemplate, err = p.parseTemplate()
+		if err != nil {
+			return nil, err
 		}
 
+		if !p.atPunct("}") {
+			return nil, p.errorWithHint(p.peekToken(), fmt.Sprintf("the block was opened at %s", open.Pos),
+				"expected closing brace }, got: %s", p.peekToken())
+		}
 		p.nextToken() // Skip }
 	} else {
 		// If no block, expect string as template
-		if p.isEOF() {
-			return nil, errors.New("expected text template")
+		promptTemplate, err = p.parseTemplate()
+		if err != nil {
+			return nil, err
 		}
-
-		promptTemplate = p.nextToken()
-		promptTemplate = stripQuotes(promptTemplate)
 	}
 
 	return &PromptStatement{
-		Name:       stripQuotes(promptName),
+		Name:       promptName,
 		Template:   promptTemplate,
 		Fields:     fields,
 		PromptType: promptType,
+		Span:       p.spanFrom(start),
 	}, nil
 }
 
+// parseTemplate parses a prompt template: one or more adjacent string literals
+func (p *Parser) parseTemplate() (string, error) {
+	if p.peekToken().Type != TokenString {
+		return "", p.errorf(p.peekToken(), "expected text template in quotes, got: %s", p.peekToken())
+	}
+
+	var sb strings.Builder
+	for p.peekToken().Type == TokenString {
+		sb.WriteString(p.nextToken().Value)
+	}
+
+	return sb.String(), nil
+}
+
 // parsePragmaStatement parses compiler PRAGMA directives
 func (p *Parser) parsePragmaStatement() (Node, error) {
-	p.nextToken() // Skip PRAGMA
+	start := p.nextToken() // Skip PRAGMA
 
 	if p.isEOF() {
-		return nil, errors.New("expected pragma type after PRAGMA")
+		return nil, p.errorf(p.peekToken(), "expected pragma type after PRAGMA")
 	}
 
-	pragmaType := p.nextToken()
+	pragmaToken := p.nextToken()
 
-	switch pragmaType {
-	case "AUTOSAVE":
+	switch {
+	case pragmaToken.Is(TokenKeyword, "AUTOSAVE"):
 		return &PragmaStatement{
-			Type:  pragmaType,
-			Value: true,
+			Type:  pragmaToken.Value,
+			Value: p.parseFlag(pragmaToken),
+			Span:  p.spanFrom(start),
 		}, nil
-	case "CONCURRENCY":
+	case pragmaToken.Is(TokenKeyword, "CONCURRENCY"):
 		// Check if after CONCURRENCY follows a number
-		if p.isEOF() {
-			return nil, errors.New("expected value after PRAGMA CONCURRENCY")
-		}
-
-		concurrencyStr := p.nextToken()
-		concurrency, err := strconv.Atoi(concurrencyStr)
+		concurrency, err := p.parseInt("PRAGMA CONCURRENCY")
 		if err != nil {
-			return nil, fmt.Errorf("expected integer value for PRAGMA CONCURRENCY, got: %s", concurrencyStr)
+			return nil, err
 		}
 
 		return &PragmaStatement{
-			Type:  pragmaType,
+			Type:  pragmaToken.Value,
 			Value: concurrency,
+			Span:  p.spanFrom(start),
+		}, nil
+	case pragmaToken.Is(TokenKeyword, "CACHE"):
+		// The cache file of model responses is given in quotes
+		token := p.peekToken()
+		if token.Type != TokenString {
+			return nil, p.errorWithHint(token, "write PRAGMA CACHE \"cache/responses.db\"",
+				"expected cache file name in quotes after PRAGMA CACHE, got: %s", token)
+		}
+		p.nextToken()
+
+		return &PragmaStatement{
+			Type:  pragmaToken.Value,
+			Value: &Literal{Kind: LiteralString, Value: token.Value, Span: tokenSpan(token)},
+			Span:  p.spanFrom(start),
 		}, nil
 	default:
-		return nil, fmt.Errorf("unknown PRAGMA directive: %s", pragmaType)
+		return nil, p.errorWithHint(pragmaToken, "supported directives are AUTOSAVE, CONCURRENCY <number> and CACHE \"file\"",
+			"unknown PRAGMA directive: %s", pragmaToken)
+	}
+}
+
+// parseName parses a name or a value written either as a bare word or in quotes
+func (p *Parser) parseName(what string) (string, error) {
+	token := p.peekToken()
+	if !p.isNameToken(token) {
+		return "", p.errorf(token, "expected %s, got: %s", what, token)
+	}
+	p.nextToken()
+	return token.Value, nil
+}
+
+// parseNameList parses either a single name or a list of names in square brackets
+func (p *Parser) parseNameList(what string) ([]string, error) {
+	names := []string{}
+
+	// If the next token is an opening brace, then it's a list
+	if !p.atPunct("[") {
+		// Otherwise it's a single name
+		name, err := p.parseName(what)
+		if err != nil {
+			return nil, err
+		}
+		return append(names, name), nil
+	}
+
+	open := p.nextToken() // Skip [
+
+	for !p.atPunct("]") {
+		if p.isEOF() {
+			return nil, p.unclosedError(open, "]")
+		}
+
+		name, err := p.parseName(what)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+
+		if p.atPunct(",") {
+			p.nextToken() // Skip comma
+		} else if !p.atPunct("]") {
+			return nil, p.errorf(p.peekToken(), "expected comma or ], got: %s", p.peekToken())
+		}
 	}
+
+	p.nextToken() // Skip ]
+
+	return names, nil
+}
+
+// parseInt parses an integer value of a setting
+func (p *Parser) parseInt(what string) (*Literal, error) {
+	token := p.peekToken()
+	value, err := p.parseLiteral("integer value for " + what)
+	if err != nil {
+		return nil, err
+	}
+	if value.Kind != LiteralInt {
+		return nil, p.errorf(token, "expected integer value for %s, got %s %s", what, value.Kind, value)
+	}
+	return value, nil
+}
+
+// errorf creates an error diagnostic pointing at the given token
+func (p *Parser) errorf(token Token, format string, args ...interface{}) error {
+	return Diagnostic{
+		Severity: SeverityError,
+		Message:  fmt.Sprintf(format, args...),
+		Span:     tokenSpan(token),
+	}
+}
+
+// errorWithHint creates an error diagnostic with a suggestion for the user
+func (p *Parser) errorWithHint(token Token, hint string, format string, args ...interface{}) error {
+	return Diagnostic{
+		Severity: SeverityError,
+		Message:  fmt.Sprintf(format, args...),
+		Span:     tokenSpan(token),
+		Hint:     hint,
+	}
+}
+
+// unclosedError reports a bracket that is never closed
+func (p *Parser) unclosedError(open Token, closing string) error {
+	return p.errorWithHint(p.peekToken(), fmt.Sprintf("the bracket %s was opened at %s", open.Value, open.Pos),
+		"expected closing brace %s", closing)
+}
+
+// parseParameterBlock parses the items of a parameter block up to the closing brace.
+// Items are optionally separated by ';'. An error in one item is reported and parsing
+// continues with the next item.
+func (p *Parser) parseParameterBlock(open Token, parameters map[string]bool, parseItem func() error) {
+	for !p.atPunct("}") {
+		if p.isEOF() {
+			p.report(p.unclosedError(open, "}"))
+			return
+		}
+
+		if err := parseItem(); err != nil {
+			if !p.recoverInBlock(err, parameters) {
+				return
+			}
+			continue
+		}
+
+		// Check for separator
+		if p.atPunct(";") {
+			p.nextToken() // Skip ;
+		}
+	}
+
+	p.nextToken() // Skip }
+}
+
+// recoverInBlock records an error inside a parameter block and skips to the next parameter.
+// It returns false if the parser stopped at a statement that cannot belong to the block,
+// which usually means that the closing brace is missing.
+func (p *Parser) recoverInBlock(err error, parameters map[string]bool) bool {
+	p.report(err)
+
+	stop := make(map[string]bool, len(parameters)+len(statementKeywords))
+	for keyword := range statementKeywords {
+		stop[keyword] = true
+	}
+	for keyword := range parameters {
+		stop[keyword] = true
+	}
+	p.synchronize(stop)
+
+	token := p.peekToken()
+	return !(token.Type == TokenKeyword && statementKeywords[token.Value] && !parameters[token.Value])
+}
+
+// asDiagnostic converts an error into a diagnostic
+func asDiagnostic(err error) Diagnostic {
+	var d Diagnostic
+	if errors.As(err, &d) {
+		return d
+	}
+	return Diagnostic{Severity: SeverityError, Message: err.Error()}
+}
+
+// spanFrom returns the span from the start of the given token to the end of the last consumed token
+func (p *Parser) spanFrom(start Token) Span {
+	end := start.End
+	if p.position > 0 && p.position <= len(p.tokens) {
+		if last := p.tokens[p.position-1]; last.End.Offset > end.Offset {
+			end = last.End
+		}
+	}
+	return Span{Start: start.Pos, End: end}
 }
 
 // peekToken returns the current token without moving the pointer
-func (p *Parser) peekToken() string {
-	if p.isEOF() {
-		return ""
+func (p *Parser) peekToken() Token {
+	if p.position >= len(p.tokens) {
+		return Token{Type: TokenEOF}
 	}
 	return p.tokens[p.position]
 }
 
+// peekTokenAt returns the token n positions after the current one without moving the pointer
+func (p *Parser) peekTokenAt(n int) Token {
+	if p.position+n >= len(p.tokens) {
+		return Token{Type: TokenEOF}
+	}
+	return p.tokens[p.position+n]
+}
+
 // nextToken returns the current token and moves the pointer
-func (p *Parser) nextToken() string {
-	if p.isEOF() {
-		return ""
+func (p *Parser) nextToken() Token {
+	token := p.peekToken()
+	if token.Type != TokenEOF {
+		p.position++
 	}
-	token := p.tokens[p.position]
-	p.position++
 	return token
 }
 
 // isEOF checks if we've reached the end of tokens
 func (p *Parser) isEOF() bool {
-	return p.position >= len(p.tokens)
+	return p.peekToken().Type == TokenEOF
 }
 
-// isKeyword checks if a token is a keyword
-func (p *Parser) isKeyword(token string) bool {
-	_, ok := p.keywords[token]
-	return ok
+// atPunct checks if the current token is the given punctuation
+func (p *Parser) atPunct(value string) bool {
+	return p.peekToken().Is(TokenPunct, value)
 }
 
-// isOperator checks if a token is an operator
-func (p *Parser) isOperator(token string) bool {
-	_, ok := p.operators[token]
-	return ok
+// atKeyword checks if the current token is the given keyword
+func (p *Parser) atKeyword(value string) bool {
+	return p.peekToken().Is(TokenKeyword, value)
 }
 
-// stripQuotes removes quotes around a string if they exist
-func stripQuotes(s string) string {
-	if (strings.HasPrefix(s, "\"") && strings.HasSuffix(s, "\"")) ||
-		(strings.HasPrefix(s, "'") && strings.HasSuffix(s, "'")) {
-		return s[1 : len(s)-1]
+// isOperator checks if a token is a comparison operator
+func (p *Parser) isOperator(token Token) bool {
+	if token.Type != TokenOperator {
+		return false
 	}
-	return s
+	switch token.Value {
+	case "=", "==", ">", "<", ">=", "<=", "!=":
+		return true
+	}
+	return false
+}
+
+// isNameToken checks if a token can be used as a name (see parseName)
+func (p *Parser) isNameToken(token Token) bool {
+	return token.Type == TokenIdent || token.Type == TokenString || token.Type == TokenNumber
+}
+
+// isLocalPath checks if a dataset name written after FROM refers to a local file:
+// it is a relative or absolute path, a glob pattern, or has the extension of a data file
+func isLocalPath(name string) bool {
+	for _, prefix := range []string{"./", "../", "/", "~/"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return strings.ContainsAny(name, "*?") || fileFormat(name) != ""
+}
+
+// fileFormat detects the format of a data file by its extension, ignoring compression
+func fileFormat(path string) string {
+	path = strings.ToLower(path)
+	for _, ext := range compressionExtensions {
+		if strings.HasSuffix(path, ext) {
+			path = strings.TrimSuffix(path, ext)
+			break
+		}
+	}
+	return fileExtensions[filepath.Ext(path)]
+}
+
+// isMatchOperator checks if a token is a keyword operator of a filter condition or its case-insensitive variant
+func (p *Parser) isMatchOperator(token Token) bool {
+	if token.Type != TokenKeyword {
+		return false
+	}
+	return matchOperators[token.Value] || (strings.HasPrefix(token.Value, "I") && matchOperators[token.Value[1:]])
+}
+
+// isUsingType checks if a token is one of the USING parameters
+func (p *Parser) isUsingType(token Token) bool {
+	return token.Type == TokenKeyword && usingParameters[token.Value]
 }
@@ -0,0 +1,329 @@
+package dsl
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parse parses the input and fails the test on syntax errors
+func parse(t *testing.T, input string) *Program {
+	t.Helper()
+	program, diags := NewParser(input).Parse()
+	if len(diags) > 0 {
+		t.Fatalf("Parse: unexpected diagnostics:\n%v", diags)
+	}
+	return program
+}
+
+// messages formats diagnostics as line:column: message
+func messages(diags Diagnostics) []string {
+	var lines []string
+	for _, d := range diags {
+		lines = append(lines, fmt.Sprintf("%s: %s", d.Span.Start, d.Message))
+	}
+	return lines
+}
+
+// nodeTypes returns the node types of the statements
+func nodeTypes(nodes []Node) []string {
+	types := make([]string, len(nodes))
+	for i, node := range nodes {
+		types[i] = node.GetNodeType()
+	}
+	return types
+}
+
+func TestParserStatements(t *testing.T) {
+	program := parse(t, `# Comments and # inside strings
+PRAGMA CONCURRENCY 4
+FROM squad {
+    FIELDS ["question", "context"]
+    USING { MODEL gpt-4o; KEY "sk-#1" }
+    PROMPT numbered {
+        FIELDS ["question"]
+        "Problem #3: {question}"
+    }
+    SAVE "out.json"
+}`)
+
+	if got := nodeTypes(program.Statements); !reflect.DeepEqual(got, []string{"PragmaStatement", "FromStatement"}) {
+		t.Fatalf("statements = %v", got)
+	}
+	from := program.Statements[1].(*FromStatement)
+	want := []string{"FieldsStatement", "UsingBlock", "PromptStatement", "SaveStatement"}
+	if got := nodeTypes(from.Block.Statements); !reflect.DeepEqual(got, want) {
+		t.Fatalf("block statements = %v, want %v", got, want)
+	}
+	if got := from.Block.Statements[2].(*PromptStatement).Template; got != "Problem #3: {question}" {
+		t.Errorf("template = %q, want %q", got, "Problem #3: {question}")
+	}
+	if got := from.Block.Statements[1].(*UsingBlock).Statements[1].Value; got != "sk-#1" {
+		t.Errorf("KEY = %q, want %q", got, "sk-#1")
+	}
+}
+
+func TestParserErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"unknown character", "FROM squad @", `1:12: unexpected character '@'`},
+		{"unclosed list", "FIELDS [\"question\"\nSAVE \"out.json\"", "2:1: expected comma or ], got: SAVE"},
+		{"missing value", "SAVE", "1:5: expected filename after SAVE, got: end of file"},
+		{"unknown statement", "FROM squad\nSELECT question", "2:1: unexpected token: SELECT"},
+		{"SYSTEM without PROMPT", "SYSTEM persona", "1:8: expected PROMPT after SYSTEM, got: persona"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, diags := NewParser(tt.input).Parse()
+			if got := messages(diags); !reflect.DeepEqual(got, []string{tt.want}) {
+				t.Errorf("errors\n got: %q\nwant: %q", got, []string{tt.want})
+			}
+		})
+	}
+}
+
+func TestParserRecovery(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		errors     []string
+		statements []string // Statements parsed despite the errors
+	}{
+		{
+			name: "errors in several statements",
+			input: strings.Join([]string{
+				`PRAGMA CONCURRENCY many`,
+				`FROM squad {`,
+				`    FIELDS ["question"`,
+				`    FILTER question = @`,
+				`    LIMIT 10`,
+				`    SAVE`,
+				`}`,
+				`PROMPT p { FIELDS ["q"] "x {q}" }`,
+				`MERGE`,
+				`FROM other { SAVE "o.json" }`,
+			}, "\n"),
+			errors: []string{
+				`1:20: expected integer value for PRAGMA CONCURRENCY, got string "many"`,
+				`4:5: expected comma or ], got: FILTER`,
+				`4:23: unexpected character '@'`,
+				`5:5: expected value after =, got: LIMIT`,
+				`7:1: expected filename after SAVE, got: }`,
+				`10:1: expected dataset name after MERGE, got: FROM`,
+			},
+			statements: []string{"FromStatement", "PromptStatement", "FromStatement"},
+		},
+		{
+			name:       "statement separated by semicolon",
+			input:      `PRAGMA CONCURRENCY many; FROM squad`,
+			errors:     []string{`1:20: expected integer value for PRAGMA CONCURRENCY, got string "many"`},
+			statements: []string{"FromStatement"},
+		},
+		{
+			name:       "stray closing brace",
+			input:      "}\nFROM squad",
+			errors:     []string{`1:1: unexpected token: }`},
+			statements: []string{"FromStatement"},
+		},
+		{
+			name:       "unknown statement",
+			input:      "SELECT question\nFROM squad",
+			errors:     []string{`1:1: unexpected token: SELECT`},
+			statements: []string{"FromStatement"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program, diags := NewParser(tt.input).Parse()
+			if got := messages(diags); !reflect.DeepEqual(got, tt.errors) {
+				t.Errorf("errors\n got: %q\nwant: %q", got, tt.errors)
+			}
+			if got := nodeTypes(program.Statements); !reflect.DeepEqual(got, tt.statements) {
+				t.Errorf("statements\n got: %v\nwant: %v", got, tt.statements)
+			}
+		})
+	}
+}
+
+// TestParserRecoveryInBlock checks that an error in a block skips only the broken statement
+func TestParserRecoveryInBlock(t *testing.T) {
+	input := `FROM squad {
+    FIELDS question,
+    LIMIT many
+    FILTER question = "x"
+    SAVE "out.json"
+    SAVE
+}`
+
+	program, diags := NewParser(input).Parse()
+	want := []string{
+		`2:20: unexpected token: ,`,
+		`3:11: expected integer value for LIMIT, got string "many"`,
+		`7:1: expected filename after SAVE, got: }`,
+	}
+	if got := messages(diags); !reflect.DeepEqual(got, want) {
+		t.Errorf("errors\n got: %q\nwant: %q", got, want)
+	}
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("got %d statements, want 1", len(program.Statements))
+	}
+	from := program.Statements[0].(*FromStatement)
+	if got := nodeTypes(from.Block.Statements); !reflect.DeepEqual(got, []string{"FieldsStatement", "FilterStatement", "SaveStatement"}) {
+		t.Errorf("block statements = %v, want [FieldsStatement FilterStatement SaveStatement]", got)
+	}
+}
+
+func TestParseJoinStatement(t *testing.T) {
+	tests := []struct {
+		input string
+		want  DatasetJoinStatement
+	}{
+		{
+			input: "JOIN questions, answers ON id",
+			want:  DatasetJoinStatement{Left: "questions", Right: "answers", Keys: []string{"id"}, Mode: "inner"},
+		},
+		{
+			input: `JOIN questions, answers ON ["id", lang] INNER`,
+			want:  DatasetJoinStatement{Left: "questions", Right: "answers", Keys: []string{"id", "lang"}, Mode: "inner"},
+		},
+		{
+			input: "JOIN questions, answers ON id LEFT",
+			want:  DatasetJoinStatement{Left: "questions", Right: "answers", Keys: []string{"id"}, Mode: "left"},
+		},
+		{
+			input: "JOIN questions, answers ON [id] OUTER AS qa",
+			want:  DatasetJoinStatement{Left: "questions", Right: "answers", Keys: []string{"id"}, Mode: "outer", Alias: "qa"},
+		},
+		{
+			input: "JOIN zwhe99/DeepMath-103K, ./answers.jsonl ON id AS qa",
+			want:  DatasetJoinStatement{Left: "zwhe99/DeepMath-103K", Right: "./answers.jsonl", Keys: []string{"id"}, Mode: "inner", Alias: "qa"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program := parse(t, tt.input)
+			if len(program.Statements) != 1 {
+				t.Fatalf("got %d statements, want 1", len(program.Statements))
+			}
+			got, ok := program.Statements[0].(*DatasetJoinStatement)
+			if !ok {
+				t.Fatalf("got %s, want DatasetJoinStatement", program.Statements[0].GetNodeType())
+			}
+			got.Span = Span{}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJoinStatementErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"JOIN questions answers ON id", "1:16: expected comma between datasets in JOIN, got: answers"},
+		{"JOIN questions, answers", "1:24: expected ON after datasets in JOIN, got: end of file"},
+		{"JOIN questions, answers BY id", "1:25: expected ON after datasets in JOIN, got: BY"},
+		{"JOIN questions, answers ON []", "1:1: at least one column is required after ON"},
+		{"JOIN questions, answers ON id AS", "1:33: expected dataset name after AS, got: end of file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, diags := NewParser(tt.input).Parse()
+			if got := messages(diags); !reflect.DeepEqual(got, []string{tt.want}) {
+				t.Errorf("errors\n got: %q\nwant: %q", got, []string{tt.want})
+			}
+		})
+	}
+}
+
+func TestParseAggregateStatement(t *testing.T) {
+	tests := []struct {
+		input string
+		want  AggregateStatement
+	}{
+		{
+			input: "AGGREGATE count()",
+			want:  AggregateStatement{Aggregates: []Aggregate{{Function: "count"}}},
+		},
+		{
+			input: "AGGREGATE AVG(difficulty) BY topic",
+			want: AggregateStatement{
+				Aggregates: []Aggregate{{Function: "avg", Args: []string{"difficulty"}}},
+				By:         []string{"topic"},
+			},
+		},
+		{
+			input: "AGGREGATE count(), max(difficulty) AS hardest, distinct(answer) BY topic, level INTO stats",
+			want: AggregateStatement{
+				Aggregates: []Aggregate{
+					{Function: "count"},
+					{Function: "max", Args: []string{"difficulty"}, Alias: "hardest"},
+					{Function: "distinct", Args: []string{"answer"}},
+				},
+				By:   []string{"topic", "level"},
+				Into: "stats",
+			},
+		},
+		{
+			input: "AGGREGATE sum(a, b) INTO totals",
+			want: AggregateStatement{
+				Aggregates: []Aggregate{{Function: "sum", Args: []string{"a", "b"}}},
+				Into:       "totals",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program := parse(t, tt.input)
+			if len(program.Statements) != 1 {
+				t.Fatalf("got %d statements, want 1", len(program.Statements))
+			}
+			got, ok := program.Statements[0].(*AggregateStatement)
+			if !ok {
+				t.Fatalf("got %s, want AggregateStatement", program.Statements[0].GetNodeType())
+			}
+			got.Span = Span{}
+			for i := range got.Aggregates {
+				got.Aggregates[i].Span = Span{}
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAggregateStatementErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"AGGREGATE difficulty", "1:11: expected aggregate function after AGGREGATE, got: difficulty"},
+		{"AGGREGATE avg(difficulty", "1:25: expected comma or ) in arguments of avg, got: end of file"},
+		{"AGGREGATE avg(a b)", "1:17: expected comma or ) in arguments of avg, got: b"},
+		{"AGGREGATE count() AS", "1:21: expected column name after AS, got: end of file"},
+		{"AGGREGATE count() BY", "1:21: expected column name after BY, got: end of file"},
+		{"AGGREGATE count() INTO", "1:23: expected dataset name after INTO, got: end of file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, diags := NewParser(tt.input).Parse()
+			if got := messages(diags); !reflect.DeepEqual(got, []string{tt.want}) {
+				t.Errorf("errors\n got: %q\nwant: %q", got, []string{tt.want})
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package dsl
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Every value coming from a DSL script is written into the generated Python code
+// through the functions of this file, so that it always stays data and can never
+// change the structure of the program.
+
+// pyString encodes a string as a single-quoted Python string literal
+func pyString(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('\'')
+
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+
+		switch {
+		case r == utf8.RuneError && size == 1:
+			sb.WriteString(`\ufffd`) // Invalid UTF-8
+		case r == '\\':
+			sb.WriteString(`\\`)
+		case r == '\'':
+			sb.WriteString(`\'`)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			sb.WriteString(fmt.Sprintf(`\x%02x`, r))
+		case !unicode.IsPrint(r) && r != ' ':
+			if r <= 0xffff {
+				sb.WriteString(fmt.Sprintf(`\u%04x`, r))
+			} else {
+				sb.WriteString(fmt.Sprintf(`\U%08x`, r))
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+// pyStringList encodes a list of strings as a Python list literal
+func pyStringList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = pyString(item)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// pyStringMap encodes a map of strings as a Python dict literal with sorted keys
+func pyStringMap(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items := make([]string, len(keys))
+	for i, key := range keys {
+		items[i] = pyString(key) + ": " + pyString(m[key])
+	}
+	return "{" + strings.Join(items, ", ") + "}"
+}
+
+// pyFloat encodes a float without losing precision
+func pyFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eEnN") {
+		s += ".0"
+	}
+	return s
+}
+
+// pyBool encodes a boolean
+func pyBool(b bool) string {
+	if b {
+		return "True"
+	}
+	return "False"
+}
+
+// pythonKeywords are the reserved words that cannot be used as Python identifiers
+var pythonKeywords = map[string]bool{
+	"False": true, "None": true, "True": true, "and": true, "as": true, "assert": true,
+	"async": true, "await": true, "break": true, "class": true, "continue": true, "def": true,
+	"del": true, "elif": true, "else": true, "except": true, "finally": true, "for": true,
+	"from": true, "global": true, "if": true, "import": true, "in": true, "is": true,
+	"lambda": true, "nonlocal": true, "not": true, "or": true, "pass": true, "raise": true,
+	"return": true, "try": true, "while": true, "with": true, "yield": true,
+}
+
+// isPythonIdentifier checks that a name can be used as a Python variable name as is
+func isPythonIdentifier(name string) bool {
+	if name == "" || pythonKeywords[name] {
+		return false
+	}
+	for i, r := range name {
+		if r == '_' || (r < utf8.RuneSelf && (unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r)))) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// pyComment makes text safe to put after # in a Python comment
+func pyComment(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+			return ' '
+		}
+		return r
+	}, text)
+}
@@ -0,0 +1,256 @@
+package dsl
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// runPython runs a Python program with the given standard input and returns its output;
+// the test is skipped if python3 is not installed
+func runPython(t *testing.T, program string, input []byte) []byte {
+	t.Helper()
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not installed")
+	}
+	cmd := exec.Command(python, "-c", program)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("python3: %v\n%s", err, stderr.String())
+	}
+	return output
+}
+
+// pyStringTests are strings with their expected encoding by pyString
+var pyStringTests = []struct {
+	name  string
+	input string
+	want  string
+}{
+	{"empty", "", `''`},
+	{"plain", "hello", `'hello'`},
+	{"single quote", "it's", `'it\'s'`},
+	{"triple quote", "'''", `'\'\'\''`},
+	{"double quote", `say "hi"`, `'say "hi"'`},
+	{"backslash", `a\b`, `'a\\b'`},
+	{"trailing backslash", `a\`, `'a\\'`},
+	{"escaped quote", `\'`, `'\\\''`},
+	{"newline", "line\nnext", `'line\nnext'`},
+	{"carriage return and tab", "a\r\tb", `'a\r\tb'`},
+	{"nul", "a\x00b", `'a\x00b'`},
+	{"other control characters", "\x01\x1b\x7f", `'\x01\x1b\x7f'`},
+	{"line separator", "a\u2028b", `'a\u2028b'`},
+	{"paragraph separator", "a\u2029b", `'a\u2029b'`},
+	{"next line", "a\u0085b", `'a\u0085b'`},
+	{"non-printable outside the BMP", "\U000e0001", `'\U000e0001'`},
+	{"invalid utf-8", "a\xffb", `'a\ufffdb'`},
+	{"printable unicode", "привет ✓ 😀", `'привет ✓ 😀'`},
+	{"placeholders", "{question}", `'{question}'`},
+	{"injection", "x'); import os; os.system('rm -rf /') #", `'x\'); import os; os.system(\'rm -rf /\') #'`},
+}
+
+func TestPyString(t *testing.T) {
+	for _, tt := range pyStringTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pyString(tt.input); got != tt.want {
+				t.Errorf("pyString(%q) = %s, want %s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPyStringRoundTrip reads the encoded strings back with Python's ast.literal_eval
+func TestPyStringRoundTrip(t *testing.T) {
+	literals := make([]string, len(pyStringTests))
+	for i, tt := range pyStringTests {
+		literals[i] = pyString(tt.input)
+	}
+	input, err := json.Marshal(literals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := runPython(t, `
+import ast, json, sys
+print(json.dumps([ast.literal_eval(literal) for literal in json.load(sys.stdin)]))
+`, input)
+
+	var values []string
+	if err := json.Unmarshal(output, &values); err != nil {
+		t.Fatalf("python3 output %q: %v", output, err)
+	}
+	for i, tt := range pyStringTests {
+		// Invalid UTF-8 is the only input that does not come back unchanged
+		want := strings.ToValidUTF8(tt.input, "\ufffd")
+		if values[i] != want {
+			t.Errorf("%s: literal_eval(%s) = %q, want %q", tt.name, literals[i], values[i], want)
+		}
+	}
+}
+
+func TestPyComment(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain", "load dataset squad", "load dataset squad"},
+		{"quotes and hashes are kept", `it's "#1"`, `it's "#1"`},
+		{"newline", "a\nimport os", "a import os"},
+		{"carriage return", "a\rimport os", "a import os"},
+		{"line separator", "a\u2028b\u2029c", "a b c"},
+		{"nul and control characters", "a\x00b\x0bc\x0cd\x1ce\u0085f", "a b c d e f"},
+		{"unicode", "датасет", "датасет"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pyComment(tt.input); got != tt.want {
+				t.Errorf("pyComment(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPythonIdentifier(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"ds_squad", true},
+		{"_private", true},
+		{"Name2", true},
+		{"", false},
+		{"2fast", false},
+		{"with-dash", false},
+		{"with space", false},
+		{"dotted.name", false},
+		{"датасет", false},
+		{"class", false},
+		{"None", false},
+		{"lambda", false},
+		{"print", true},
+	}
+
+	for _, tt := range tests {
+		if got := isPythonIdentifier(tt.name); got != tt.want {
+			t.Errorf("isPythonIdentifier(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeVarName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"squad", "squad"},
+		{"my-dataset", "my_dataset"},
+		{"data/train.jsonl", "data_train_jsonl"},
+		{"2024_logs", "_2024_logs"},
+		{"class", "_class"},
+		{"", "_"},
+		{"x'); import os #", "x____import_os__"},
+		{"a\nb", "a_b"},
+		{"датасет", "_______"},
+	}
+
+	for _, tt := range tests {
+		got := sanitizeVarName(tt.name)
+		if got != tt.want {
+			t.Errorf("sanitizeVarName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if !isPythonIdentifier(got) {
+			t.Errorf("sanitizeVarName(%q) = %q is not a Python identifier", tt.name, got)
+		}
+	}
+}
+
+// TestCompileHostileValues checks that names, paths and templates built to break out of
+// a string literal end up in the generated script as single Python literals
+func TestCompileHostileValues(t *testing.T) {
+	const source = `
+FROM "data'''\nimport evil" {
+    FIELDS ["q"]
+    USING {
+        MODEL "gpt'; import evil; os.system('x') #"
+        KEY "k\\"
+        URL "http://h/\u2028x"
+    }
+    SYSTEM PROMPT persona { "You are \"strict\". import evil" }
+    USER PROMPT p {
+        FIELDS ["q"]
+        "a ''' b \\ c {q} nul\u0000 end"
+    }
+    GENERATE q AS answer { PROMPT p }
+    SAVE "out\\'.jsonl"
+}
+`
+
+	script, err := NewDSL("", "").ParseAndCompile(source)
+	if err != nil {
+		t.Fatalf("ParseAndCompile: %v", err)
+	}
+
+	values := []string{
+		"data'''\nimport evil",
+		"gpt'; import evil; os.system('x') #",
+		`k\`,
+		"http://h/\u2028x",
+		"You are \"strict\". import evil",
+		"a ''' b \\ c {q} nul\x00 end",
+		`out\'.jsonl`,
+	}
+	for _, value := range values {
+		if !strings.Contains(script, pyString(value)) {
+			t.Errorf("script does not contain %q as the literal %s", value, pyString(value))
+		}
+	}
+
+	if strings.ContainsAny(script, "\x00\u2028\u2029") {
+		t.Error("script contains a raw NUL or line separator")
+	}
+	for i, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "import evil") {
+			t.Errorf("line %d: injected code became a statement: %s", i+1, line)
+		}
+	}
+	// Parse the generated script with Python: every value must be a string constant of its own,
+	// and the only imports are the ones of the script itself
+	output := runPython(t, `
+import ast, json, sys
+tree = ast.parse(sys.stdin.read())
+print(json.dumps({
+    "strings": sorted({node.value for node in ast.walk(tree) if isinstance(node, ast.Constant) and isinstance(node.value, str)}),
+    "imports": sorted({alias.name for node in ast.walk(tree) if isinstance(node, (ast.Import, ast.ImportFrom)) for alias in node.names}),
+}))
+`, []byte(script))
+
+	var parsed struct {
+		Strings []string
+		Imports []string
+	}
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		t.Fatalf("python3 output %q: %v", output, err)
+	}
+	constants := make(map[string]bool, len(parsed.Strings))
+	for _, constant := range parsed.Strings {
+		constants[constant] = true
+	}
+	for _, value := range values {
+		if !constants[value] {
+			t.Errorf("%q is not a string constant of the generated script", value)
+		}
+	}
+	for _, name := range parsed.Imports {
+		if name == "evil" {
+			t.Errorf("generated script imports %s", name)
+		}
+	}
+}